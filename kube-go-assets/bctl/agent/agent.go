@@ -2,27 +2,77 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	ed "crypto/ed25519"
 
 	cc "bastionzero.com/bctl/v1/bctl/agent/controlchannel"
 	dc "bastionzero.com/bctl/v1/bctl/agent/datachannel"
+	"bastionzero.com/bctl/v1/bctl/agent/health"
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
 	"bastionzero.com/bctl/v1/bctl/agent/vault"
 	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
+	bzcrt "bastionzero.com/bctl/v1/bzerolib/keysplitting/bzcert"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 var (
 	serviceUrl, orgId, clusterName   string
 	environmentId, activationToken   string
 	idpProvider, namespace, idpOrgId string
+
+	// How to verify tokens from identity providers besides Google and Microsoft
+	idpIssuerUrl, idpOrgClaim, idpAudiences string
+
+	// Pinned keys to verify id tokens with instead of fetching them from the IdP, either the JWKS itself
+	// (e.g. from a secret) or a path to a file containing it
+	idpJwks, idpJwksFile string
+
+	// Comma separated "host:port" pairs inside the cluster network the tunnel plugin is allowed to connect to
+	allowedTunnelTargets string
+
+	// The local user the shell plugin starts shells as, shells are disabled unless this is set
+	shellRunAsUser string
+
+	// Whether Bastion can ask us to impersonate kubernetes' or the cloud provider's own groups, e.g. system:masters
+	allowSystemGroups bool
+
+	// How we reach Bastion if we're behind an egress proxy
+	bastionTransport ws.TransportConfig
+
+	// How quickly we notice our connection to Bastion has died
+	bastionHeartbeat ws.HeartbeatConfig
+
+	// How much of us any one daemon, or all of them together, can use up
+	datachannelLimits dc.Limits
+
+	// Where we serve Prometheus metrics, e.g. ":9090". If empty we don't
+	metricsAddress string
+
+	// Where we serve our liveness and readiness probes, e.g. ":8080". If empty we don't
+	healthAddress string
+
+	// Everything that has to finish closing before we exit
+	closing     []<-chan struct{}
+	closingLock sync.Mutex
 )
 
 const (
@@ -31,6 +81,11 @@ const (
 
 	// Disable auto-reconnect
 	autoReconnect = false
+
+	kubeApiCheckTimeout = 3 * time.Second
+
+	// Kubernetes kills us 30 seconds after asking us to stop by default, so we leave ourselves some room
+	shutdownTimeout = 20 * time.Second
 )
 
 func main() {
@@ -52,36 +107,106 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Everything we start closes once this is cancelled, e.g. when our pod is being replaced
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if err := ws.ConfigureTransport(bastionTransport); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	} else if err := ws.ConfigureHeartbeat(bastionHeartbeat); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	} else if err := dc.ConfigureLimits(datachannelLimits); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
+	cc.AllowSystemGroups(allowSystemGroups)
+
+	if err := pinJwks(); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
+	metrics.Serve(logger.GetComponentLogger("Metrics"), metricsAddress)
+
+	// We aren't ready until we've registered and connected, but we're alive the whole time we're trying to
+	health.AddReadinessCheck("vault", checkVault)
+	health.AddReadinessCheck("kubeapi", checkKubeApi)
+	health.AddReadinessCheck("registration", health.Pending("agent has not registered with Bastion yet"))
+	health.AddReadinessCheck("controlchannel", health.Pending("control channel has not started yet"))
+	health.Serve(logger.GetComponentLogger("Health"), healthAddress)
+
 	// Populate keys if they haven't been generated already
-	err = newAgent(logger, serviceUrl, activationToken, agentVersion, orgId, environmentId, clusterName, idpProvider, idpOrgId, namespace)
+	err = newAgent(logger, serviceUrl, activationToken, agentVersion, orgId, environmentId, clusterName, idpProvider, idpOrgId, idpIssuerUrl, idpOrgClaim, idpAudiences, namespace)
 	if err != nil {
 		logger.Error(err)
 		return
 	}
+	health.AddReadinessCheck("registration", health.Done)
 
 	// Connect to the control channel
-	control, err := cc.NewControlChannel(ccLogger, serviceUrl, activationToken, orgId, clusterName, environmentId, agentVersion, controlchannelTargetSelectHandler)
+	control, err := cc.NewControlChannel(ctx, ccLogger, serviceUrl, activationToken, orgId, clusterName, environmentId, agentVersion, controlchannelTargetSelectHandler)
 	if err != nil {
-		select {} // TODO: Should we be trying again here?
+		health.AddLivenessCheck("controlchannel", health.Pending(fmt.Sprintf("control channel failed to start: %s", err)))
+		<-ctx.Done() // TODO: Should we be trying again here?
+		return
 	}
+	health.AddReadinessCheck("controlchannel", control.Ready)
+	health.AddLivenessCheck("controlchannel", control.Alive)
+	trackClosing(control.Done())
 
 	// Subscribe to control channel
 	go func() {
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case message := <-control.NewDatachannelChan:
-				// We have an incoming websocket request, attempt to make a new Daemon Websocket Client for the request
-				startDatachannel(dcLogger, message)
+				// We have an incoming websocket request, attempt to make a new Daemon Websocket Client for the request.
+				// Connecting can back off for a while, so we don't hold up any other requests or our control channel
+				go func(message cc.NewDatachannelMessage) {
+					if err := startDatachannel(ctx, dcLogger, message); err != nil {
+						control.RejectDatachannel(message.ConnectionId, err)
+					}
+				}(message)
 			}
 		}
 	}()
 
-	// Sleep forever because otherwise kube will endlessly try restarting
-	// Ref: https://stackoverflow.com/questions/36419054/go-projects-main-goroutine-sleep-forever
-	select {}
+	// Run until we're told to stop, otherwise kube will endlessly try restarting
+	<-ctx.Done()
+	logger.Info("Shutting down, closing all of our connections to Bastion")
+	waitForClosing(logger)
+}
+
+func trackClosing(done <-chan struct{}) {
+	closingLock.Lock()
+	defer closingLock.Unlock()
+
+	closing = append(closing, done)
+}
+
+// Gives everything we've started a chance to let Bastion and its users know we're going away
+func waitForClosing(logger *lggr.Logger) {
+	closingLock.Lock()
+	toWait := append([]<-chan struct{}{}, closing...)
+	closingLock.Unlock()
+
+	timeout := time.After(shutdownTimeout)
+	for _, done := range toWait {
+		select {
+		case <-done:
+		case <-timeout:
+			logger.Error(fmt.Errorf("timed out after %s waiting for our connections to close", shutdownTimeout))
+			return
+		}
+	}
+	logger.Info("Shut down cleanly")
 }
 
-func startDatachannel(logger *lggr.Logger, message cc.NewDatachannelMessage) {
+func startDatachannel(ctx context.Context, logger *lggr.Logger, message cc.NewDatachannelMessage) error {
 	// Create our headers and params, headers are empty
 	// TODO: We need to drop this session id auth header req and move to a token based system
 	headers := make(map[string]string)
@@ -91,16 +216,25 @@ func startDatachannel(logger *lggr.Logger, message cc.NewDatachannelMessage) {
 	params["daemon_connection_id"] = message.ConnectionId
 	params["token"] = message.Token
 
-	// Create our response channels
-	// TODO: WE NEED TO SEND AN INTERRUPT CHANNEL TO DATACHANNEL FROM CONTROL
-	// or pass a context that we can cancel from the control channel??
-	dc.NewDataChannel(logger, message.Role, serviceUrl, hubEndpoint, params, headers, datachannelTargetSelectHandler, autoReconnect)
+	// The datachannel closes itself once ctx is cancelled, we just have to wait for it to finish
+	datachannel, err := dc.NewDataChannel(ctx, logger, message.ConnectionId, message.Role, message.Groups, getAllowedTunnelTargets(), shellRunAsUser, serviceUrl, hubEndpoint, params, headers, datachannelTargetSelectHandler, autoReconnect)
+	if err != nil {
+		return err
+	}
+	trackClosing(datachannel.Done())
+	return nil
 }
 
 func controlchannelTargetSelectHandler(agentMessage wsmsg.AgentMessage) (string, error) {
 	switch wsmsg.MessageType(agentMessage.MessageType) {
 	case wsmsg.HealthCheck:
 		return "AliveCheckClusterToBastion", nil
+	case wsmsg.ListDatachannels:
+		return "ListDatachannelsClusterToBastion", nil
+	case wsmsg.CloseDatachannel:
+		return "CloseDatachannelClusterToBastion", nil
+	case wsmsg.Error:
+		return "ErrorClusterToBastion", nil
 	default:
 		return "", fmt.Errorf("unsupported message type")
 	}
@@ -121,10 +255,36 @@ func datachannelTargetSelectHandler(agentMessage wsmsg.AgentMessage) (string, er
 					return "ResponseClusterToBastion", nil
 				case "kube/exec/resize":
 					return "ResponseClusterToBastion", nil
+				case "kube/exec/ack":
+					return "ResponseClusterToBastion", nil
 				case "kube/stream/start":
 					return "ResponseClusterToBastion", nil
 				case "kube/stream/stop":
 					return "ResponseClusterToBastion", nil
+				case "kube/portforward/start":
+					return "ResponseClusterToBastion", nil
+				case "kube/portforward/request/start":
+					return "ResponseClusterToBastion", nil
+				case "kube/portforward/datain":
+					return "ResponseClusterToBastion", nil
+				case "kube/portforward/request/stop":
+					return "ResponseClusterToBastion", nil
+				case "kube/portforward/stop":
+					return "ResponseClusterToBastion", nil
+				case "tunnel/open":
+					return "ResponseClusterToBastion", nil
+				case "tunnel/datain":
+					return "ResponseClusterToBastion", nil
+				case "tunnel/close":
+					return "ResponseClusterToBastion", nil
+				case "shell/open":
+					return "ResponseClusterToBastion", nil
+				case "shell/input":
+					return "ResponseClusterToBastion", nil
+				case "shell/resize":
+					return "ResponseClusterToBastion", nil
+				case "shell/close":
+					return "ResponseClusterToBastion", nil
 				}
 			}
 		}
@@ -138,6 +298,18 @@ func datachannelTargetSelectHandler(agentMessage wsmsg.AgentMessage) (string, er
 				return "StderrClusterToBastion", nil
 			case "kube/stream/stdout":
 				return "ResponseHttpStreamClusterToBastion", nil
+			case "kube/portforward/data":
+				return "PortForwardDataClusterToBastion", nil
+			case "kube/portforward/error":
+				return "PortForwardErrorClusterToBastion", nil
+			case "tunnel/data":
+				return "TunnelDataClusterToBastion", nil
+			case "tunnel/close":
+				return "TunnelCloseClusterToBastion", nil
+			case "shell/stdout":
+				return "ShellStdoutClusterToBastion", nil
+			case "shell/quit":
+				return "ShellQuitClusterToBastion", nil
 			}
 		}
 	case wsmsg.Error:
@@ -166,7 +338,42 @@ func parseFlags() error {
 	environmentId = os.Getenv("ENVIRONMENT")
 	idpProvider = os.Getenv("IDP_PROVIDER")
 	idpOrgId = os.Getenv("IDP_ORG_ID")
+	idpIssuerUrl = os.Getenv("IDP_ISSUER_URL")
+	idpOrgClaim = os.Getenv("IDP_ORG_CLAIM")
+	idpAudiences = os.Getenv("IDP_AUDIENCES")
+	idpJwks = os.Getenv("IDP_JWKS")
+	idpJwksFile = os.Getenv("IDP_JWKS_FILE")
 	namespace = os.Getenv("NAMESPACE")
+	allowedTunnelTargets = os.Getenv("TUNNEL_ALLOWED_TARGETS")
+	shellRunAsUser = os.Getenv("SHELL_RUN_AS_USER")
+	metricsAddress = os.Getenv("METRICS_ADDRESS")
+	healthAddress = os.Getenv("HEALTH_ADDRESS")
+	allowSystemGroups = os.Getenv("ALLOW_SYSTEM_GROUPS") == "true"
+	bastionTransport = ws.TransportConfig{
+		ProxyUrl:       os.Getenv("BASTION_PROXY_URL"),
+		CaFile:         os.Getenv("BASTION_CA_FILE"),
+		ClientCertFile: os.Getenv("BASTION_CLIENT_CERT_FILE"),
+		ClientKeyFile:  os.Getenv("BASTION_CLIENT_KEY_FILE"),
+	}
+
+	// Durations like "15s", if they're not set we use our defaults
+	var err error
+	if bastionHeartbeat.Interval, err = getDuration("BASTION_HEARTBEAT_INTERVAL"); err != nil {
+		return err
+	} else if bastionHeartbeat.Timeout, err = getDuration("BASTION_HEARTBEAT_TIMEOUT"); err != nil {
+		return err
+	}
+
+	// Limits on what daemons can ask of us, if they're not set we use our defaults
+	if datachannelLimits.MaxDatachannels, err = getInt("MAX_DATACHANNELS"); err != nil {
+		return err
+	} else if datachannelLimits.MaxActionsPerPlugin, err = getInt("MAX_PLUGIN_ACTIONS"); err != nil {
+		return err
+	} else if datachannelLimits.StreamBufferSize, err = getInt("STREAM_BUFFER_SIZE"); err != nil {
+		return err
+	} else if datachannelLimits.MaxBytesPerSecond, err = getInt("MAX_BYTES_PER_SECOND"); err != nil {
+		return err
+	}
 
 	// Ensure we have all needed vars
 	missing := []string{}
@@ -190,6 +397,79 @@ func parseFlags() error {
 	}
 }
 
+func pinJwks() error {
+	jwks := []byte(idpJwks)
+	if idpJwksFile != "" {
+		if fileJwks, err := ioutil.ReadFile(idpJwksFile); err != nil {
+			return fmt.Errorf("error reading pinned JWKS file: %s", err)
+		} else {
+			jwks = fileJwks
+		}
+	}
+
+	if len(jwks) == 0 {
+		return nil
+	} else if err := bzcrt.PinJwks(jwks); err != nil {
+		return fmt.Errorf("error pinning JWKS: %s", err)
+	}
+	return nil
+}
+
+// Our vault only has anything in it once we've registered, so this just checks we can still reach it
+func checkVault() error {
+	if _, err := vault.LoadVault(); err != nil {
+		return fmt.Errorf("error loading vault: %s", err)
+	}
+	return nil
+}
+
+func checkKubeApi() error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("error getting in cluster config: %s", err)
+	}
+	config.Timeout = kubeApiCheckTimeout
+
+	if clientset, err := kubernetes.NewForConfig(config); err != nil {
+		return fmt.Errorf("error creating kube client: %s", err)
+	} else if _, err := clientset.Discovery().ServerVersion(); err != nil {
+		return fmt.Errorf("could not reach the kube api server: %s", err)
+	}
+	return nil
+}
+
+func getDuration(env string) (time.Duration, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return 0, nil
+	} else if duration, err := time.ParseDuration(value); err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", env, err)
+	} else {
+		return duration, nil
+	}
+}
+
+func getInt(env string) (int, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return 0, nil
+	} else if n, err := strconv.Atoi(value); err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", env, err)
+	} else {
+		return n, nil
+	}
+}
+
+func getAllowedTunnelTargets() []string {
+	targets := []string{}
+	for _, target := range strings.Split(allowedTunnelTargets, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
 func getAgentVersion() string {
 	if os.Getenv("DEV") == "true" {
 		return "1.0"
@@ -198,7 +478,7 @@ func getAgentVersion() string {
 	}
 }
 
-func newAgent(logger *lggr.Logger, serviceUrl string, activationToken string, agentVersion string, orgId string, environmentId string, clusterName string, idpProvider string, idpOrgId string, namespace string) error {
+func newAgent(logger *lggr.Logger, serviceUrl string, activationToken string, agentVersion string, orgId string, environmentId string, clusterName string, idpProvider string, idpOrgId string, idpIssuerUrl string, idpOrgClaim string, idpAudiences string, namespace string) error {
 	config, _ := vault.LoadVault()
 
 	// Check if vault is empty, if so generate a private, public key pair
@@ -220,6 +500,9 @@ func newAgent(logger *lggr.Logger, serviceUrl string, activationToken string, ag
 				Namespace:     namespace,
 				IdpProvider:   idpProvider,
 				IdpOrgId:      idpOrgId,
+				IdpIssuerUrl:  idpIssuerUrl,
+				IdpOrgClaim:   idpOrgClaim,
+				IdpAudiences:  idpAudiences,
 			}
 
 			// Register with Bastion
@@ -240,7 +523,7 @@ func newAgent(logger *lggr.Logger, serviceUrl string, activationToken string, ag
 			}
 
 			// Make our POST request
-			response, err := http.Post("https://"+serviceUrl+registerEndpoint, "application/json",
+			response, err := ws.HttpClient().Post(ws.ServiceHttpUrl(serviceUrl, registerEndpoint), "application/json",
 				bytes.NewBuffer(registerJson))
 			if err != nil || response.StatusCode != http.StatusOK {
 				rerr := fmt.Errorf("error making post request to register agent. Error: %s. Response: %v", err, response)
@@ -253,8 +536,20 @@ func newAgent(logger *lggr.Logger, serviceUrl string, activationToken string, ag
 			}
 		}
 	} else {
-		// If the vault isn't empty, don't do anything
 		logger.Info("Found Previous config data")
+
+		// Unlike the rest of our config, how we verify a custom identity provider's tokens can change after we've
+		// registered, e.g. to restrict them to a new audience, so make sure we're using whatever we've been given
+		if config.Data.IdpIssuerUrl != idpIssuerUrl || config.Data.IdpOrgClaim != idpOrgClaim || config.Data.IdpAudiences != idpAudiences {
+			logger.Info("Updating identity provider settings")
+			config.Data.IdpIssuerUrl = idpIssuerUrl
+			config.Data.IdpOrgClaim = idpOrgClaim
+			config.Data.IdpAudiences = idpAudiences
+
+			if err := config.Save(); err != nil {
+				return fmt.Errorf("error saving vault: %v", err.Error())
+			}
+		}
 	}
 	return nil
 }
@@ -3,15 +3,22 @@ package controlchannel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	dc "bastionzero.com/bctl/v1/bctl/agent/datachannel"
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
 	"bastionzero.com/bctl/v1/bctl/agent/vault"
 	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
 	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
+	rrr "bastionzero.com/bctl/v1/bzerolib/error"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -21,20 +28,57 @@ const (
 	hubEndpoint       = "/api/v1/hub/kube-control"
 	challengeEndpoint = "/api/v1/kube/get-challenge"
 	autoReconnect     = true
+
+	// Nothing else is going to bring our agent back if our control channel gives up, so it never does
+	maxConnectAttempts = 0
+
+	// How long our message loop can spend on a single message before we decide it's stuck. It's idle most of
+	// the time, so we only hold it to this while it's actually handling something
+	maxHandlingTime = 2 * time.Minute
+
+	// Listing every role binding shouldn't take long, but we don't want a slow kube api server to wedge us
+	healthCheckTimeout = 30 * time.Second
+
+	shutdownReason = "agent is shutting down"
+
+	// What we tell users whose datachannel Bastion closes, if Bastion doesn't say why
+	defaultCloseReason = "session was closed by Bastion"
 )
 
+// Users and groups that belong to kubernetes itself or to the cloud provider running it
+var systemSubjectPrefixes = []string{"system:", "eks:"}
+
+// Every user we impersonate is in this group anyway, so asking for it doesn't get them anything more
+const authenticatedGroup = "system:authenticated"
+
+// Whether Bastion can ask us to impersonate groups like system:masters, which would give a user whatever
+// kubernetes or the cloud provider gives themselves
+var allowSystemGroups bool
+
+// Lets Bastion ask us to impersonate system groups, we refuse to by default
+func AllowSystemGroups(allow bool) {
+	allowSystemGroups = allow
+}
+
 type ControlChannel struct {
 	websocket *ws.Websocket
 	logger    *lggr.Logger
+	ctx       context.Context
 
 	// These are all the types of channels we have available
 	NewDatachannelChan chan NewDatachannelMessage
 
+	// When our message loop started handling its current message, zero if it's waiting for one
+	handlingSince time.Time
+	handlingLock  sync.Mutex
+	done          chan struct{}
+
 	SocketLock sync.Mutex // Ref: https://github.com/gorilla/websocket/issues/119#issuecomment-198710015
 }
 
 // Constructor to create a new Control Websocket Client
-func NewControlChannel(logger *lggr.Logger,
+func NewControlChannel(ctx context.Context,
+	logger *lggr.Logger,
 	serviceUrl string,
 	activationToken string,
 	orgId string,
@@ -65,28 +109,43 @@ func NewControlChannel(logger *lggr.Logger,
 	msg := fmt.Sprintf("{serviceURL: %v, hubEndpoint: %v, params: %v, headers: %v}", serviceUrl, hubEndpoint, params, headers)
 	logger.Info(msg)
 
-	ctx := context.TODO()
+	// Our websocket outlives ctx long enough for us to close it properly
+	wsCtx, cancel := context.WithCancel(context.Background())
 
-	wsClient, err := ws.NewWebsocket(ctx, subLogger, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect, true)
+	wsClient, err := ws.NewWebsocket(wsCtx, subLogger, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect, true, maxConnectAttempts)
 	if err != nil {
+		cancel()
 		return &ControlChannel{}, err
 	}
 
 	control := ControlChannel{
 		websocket:          wsClient,
+		ctx:                ctx,
 		NewDatachannelChan: make(chan NewDatachannelMessage),
+		done:               make(chan struct{}),
 		logger:             logger,
 	}
 
 	// Set up our handler to deal with incoming messages
 	go func() {
+		defer close(control.done)
+		defer cancel()
 		for {
 			select {
+			case <-ctx.Done():
+				control.logger.Info("Agent is shutting down, closing controlchannel")
+				control.websocket.Close(shutdownReason)
+				return
 			case <-control.websocket.DoneChan:
 				control.logger.Info("Websocket has been closed, closing controlchannel")
 				return
+			case <-control.websocket.ReconnectedChan:
+				metrics.ControlChannelReconnects.Inc()
 			case agentMessage := <-control.websocket.InputChan:
-				if err := control.Receive(agentMessage); err != nil {
+				control.setHandling(true)
+				err := control.Receive(agentMessage)
+				control.setHandling(false)
+				if err != nil {
 					control.logger.Error(err)
 					return
 				}
@@ -96,14 +155,65 @@ func NewControlChannel(logger *lggr.Logger,
 	return &control, nil
 }
 
+// Closed once we've stopped handling messages from Bastion, and closed our websocket if we were asked to
+func (c *ControlChannel) Done() <-chan struct{} {
+	return c.done
+}
+
+// Returns an error unless we're connected to Bastion and able to receive new datachannel requests
+func (c *ControlChannel) Ready() error {
+	if state := c.websocket.State(); state != ws.Ready {
+		return fmt.Errorf("control channel is %s", state)
+	}
+	return nil
+}
+
+// Returns an error if our message loop has stopped or is stuck, either way we won't hear from Bastion again
+func (c *ControlChannel) Alive() error {
+	select {
+	case <-c.done:
+		return fmt.Errorf("control channel has closed")
+	default:
+	}
+
+	c.handlingLock.Lock()
+	defer c.handlingLock.Unlock()
+
+	if !c.handlingSince.IsZero() {
+		if handling := time.Since(c.handlingSince); handling > maxHandlingTime {
+			return fmt.Errorf("control channel has been stuck on the same message for %s", handling.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+func (c *ControlChannel) setHandling(handling bool) {
+	c.handlingLock.Lock()
+	defer c.handlingLock.Unlock()
+
+	if handling {
+		c.handlingSince = time.Now()
+	} else {
+		c.handlingSince = time.Time{}
+	}
+}
+
 func (c *ControlChannel) Receive(agentMessage wsmsg.AgentMessage) error {
 	switch wsmsg.MessageType(agentMessage.MessageType) {
 	case wsmsg.NewDatachannel:
 		var dataMessage NewDatachannelMessage
 		if err := json.Unmarshal(agentMessage.MessagePayload, &dataMessage); err != nil {
 			return fmt.Errorf("error unmarshalling new controlchannel request: %v", err.Error())
+		} else if groups := systemGroups(dataMessage.Groups); len(groups) > 0 && !allowSystemGroups {
+			// Bastion is still waiting to hear back about this datachannel, but nothing else is wrong
+			rerr := fmt.Errorf("refusing to start datachannel %s impersonating system groups %v", dataMessage.ConnectionId, groups)
+			c.logger.Error(rerr)
+			c.RejectDatachannel(dataMessage.ConnectionId, rerr)
 		} else {
-			c.NewDatachannelChan <- dataMessage
+			select {
+			case <-c.ctx.Done():
+			case c.NewDatachannelChan <- dataMessage:
+			}
 		}
 	case wsmsg.HealthCheck:
 		if msg, err := healthCheck(); err != nil {
@@ -115,16 +225,65 @@ func (c *ControlChannel) Receive(agentMessage wsmsg.AgentMessage) error {
 				MessagePayload: msg,
 			}
 		}
+	case wsmsg.ListDatachannels:
+		list := ListDatachannelsResponse{
+			Datachannels: dc.List(),
+		}
+		c.send(wsmsg.ListDatachannels, list)
+	case wsmsg.CloseDatachannel:
+		var closeMessage CloseDatachannelMessage
+		if err := json.Unmarshal(agentMessage.MessagePayload, &closeMessage); err != nil {
+			return fmt.Errorf("error unmarshalling close datachannel request: %s", err)
+		}
+
+		reason := closeMessage.Reason
+		if reason == "" {
+			reason = defaultCloseReason
+		}
+
+		response := CloseDatachannelResponse{
+			ConnectionId: closeMessage.ConnectionId,
+			Closing:      true,
+		}
+		if err := dc.Close(closeMessage.ConnectionId, reason); err != nil {
+			c.logger.Error(err)
+			response.Closing = false
+			response.Error = err.Error()
+		} else {
+			c.logger.Info(fmt.Sprintf("Bastion asked us to close datachannel %s: %s", closeMessage.ConnectionId, reason))
+		}
+		c.send(wsmsg.CloseDatachannel, response)
 	default:
 		return fmt.Errorf("Unrecognized controlchannel message type")
 	}
 	return nil
 }
 
+// Lets Bastion know we couldn't open a datachannel for the given daemon connection
+func (c *ControlChannel) RejectDatachannel(connectionId string, err error) {
+	errType := rrr.ComponentStartupError
+	if errors.Is(err, dc.ErrTooManyDatachannels) {
+		errType = rrr.ComponentProcessingError
+	}
+
+	c.send(wsmsg.Error, rrr.ErrorMessage{
+		Type:         string(errType),
+		Message:      err.Error(),
+		ConnectionId: connectionId,
+	})
+}
+
+func (c *ControlChannel) send(messageType wsmsg.MessageType, messagePayload interface{}) {
+	messageBytes, _ := json.Marshal(messagePayload)
+	c.websocket.OutputChan <- wsmsg.AgentMessage{
+		MessageType:    string(messageType),
+		SchemaVersion:  wsmsg.SchemaVersion,
+		MessagePayload: messageBytes,
+	}
+}
+
 func healthCheck() ([]byte, error) {
-	// Also let bastion know a list of valid cluster roles
-	// TODO: break out extracting the list of valid cluster roles
-	// Create our api object
+	// Also let bastion know who it can ask us to impersonate
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return []byte{}, err
@@ -134,57 +293,124 @@ func healthCheck() ([]byte, error) {
 		return []byte{}, err
 	}
 
-	// Then get all cluster roles
-	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []byte{}, err
+	}
+	roleBindings, err := clientset.RbacV1().RoleBindings("").List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return []byte{}, err
 	}
 
-	clusterUsers := make(map[string]bool)
+	subjects := discoverSubjects(clusterRoleBindings.Items, roleBindings.Items)
 
-	for _, clusterRoleBinding := range clusterRoleBindings.Items {
-		// Now loop over the subjects if we can find any user subjects
-		for _, subject := range clusterRoleBinding.Subjects {
-			if subject.Kind == "User" {
-				// We do not consider any system:... or eks:..., basically any system: looking roles as valid. This can be overridden from Bastion
-				var systemRegexPatten = regexp.MustCompile(`[a-zA-Z0-9]*:[a-za-zA-Z0-9-]*`)
-				if !systemRegexPatten.MatchString(subject.Name) {
-					clusterUsers[subject.Name] = true
-				}
-			}
+	// Older Bastions only know about users
+	users := []string{}
+	for _, subject := range subjects {
+		if subject.Kind == rbacv1.UserKind {
+			users = append(users, subject.Name)
 		}
 	}
 
-	// Then get all roles
-	roleBindings, err := clientset.RbacV1().RoleBindings("").List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return []byte{}, err
+	alive := AliveCheckClusterToBastionMessage{
+		Alive:           true,
+		ClusterUsers:    users,
+		ClusterSubjects: subjects,
 	}
 
-	for _, roleBindings := range roleBindings.Items {
-		// Now loop over the subjects if we can find any user subjects
-		for _, subject := range roleBindings.Subjects {
-			if subject.Kind == "User" {
-				// We do not consider any system:... or eks:..., basically any system: looking roles as valid. This can be overridden from Bastion
-				var systemRegexPatten = regexp.MustCompile(`[a-zA-Z0-9]*:[a-za-zA-Z0-9-]*`) // TODO: double check
-				if !systemRegexPatten.MatchString(subject.Name) {
-					clusterUsers[subject.Name] = true
-				}
+	aliveBytes, _ := json.Marshal(alive)
+	return aliveBytes, nil
+}
+
+// Finds every user, group and service account that's bound to a role, along with the roles they're bound to
+func discoverSubjects(clusterRoleBindings []rbacv1.ClusterRoleBinding, roleBindings []rbacv1.RoleBinding) []ClusterSubject {
+	subjects := make(map[string]*ClusterSubject)
+	bind := func(subject rbacv1.Subject, role BoundRole) {
+		if isSystemSubject(subject) {
+			return
+		}
+
+		// Only service accounts live in a namespace
+		namespace := ""
+		if subject.Kind == rbacv1.ServiceAccountKind {
+			namespace = subject.Namespace
+		}
+
+		key := subject.Kind + "/" + namespace + "/" + subject.Name
+		if _, ok := subjects[key]; !ok {
+			subjects[key] = &ClusterSubject{
+				Kind:      subject.Kind,
+				Name:      subject.Name,
+				Namespace: namespace,
+				Roles:     []BoundRole{},
 			}
 		}
+		subjects[key].Roles = append(subjects[key].Roles, role)
 	}
 
-	// Now build our response
-	users := []string{}
-	for key := range clusterUsers {
-		users = append(users, key)
+	for _, binding := range clusterRoleBindings {
+		for _, subject := range binding.Subjects {
+			bind(subject, BoundRole{Kind: binding.RoleRef.Kind, Name: binding.RoleRef.Name})
+		}
+	}
+	for _, binding := range roleBindings {
+		for _, subject := range binding.Subjects {
+			// Service accounts in a role binding default to the binding's namespace
+			if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == "" {
+				subject.Namespace = binding.Namespace
+			}
+			bind(subject, BoundRole{Kind: binding.RoleRef.Kind, Name: binding.RoleRef.Name, Namespace: binding.Namespace})
+		}
 	}
 
-	alive := AliveCheckClusterToBastionMessage{
-		Alive:        true,
-		ClusterUsers: users,
+	// Keep our answer the same from one health check to the next
+	discovered := []ClusterSubject{}
+	for _, subject := range subjects {
+		sort.Slice(subject.Roles, func(i, j int) bool {
+			a, b := subject.Roles[i], subject.Roles[j]
+			return a.Namespace+"/"+a.Kind+"/"+a.Name < b.Namespace+"/"+b.Kind+"/"+b.Name
+		})
+		discovered = append(discovered, *subject)
 	}
+	sort.Slice(discovered, func(i, j int) bool {
+		a, b := discovered[i], discovered[j]
+		return a.Kind+"/"+a.Namespace+"/"+a.Name < b.Kind+"/"+b.Namespace+"/"+b.Name
+	})
+	return discovered
+}
 
-	aliveBytes, _ := json.Marshal(alive)
-	return aliveBytes, nil
+// We don't offer up kubernetes' or the cloud provider's own identities, and we won't impersonate their groups
+// unless we've been told to allow system groups
+func isSystemSubject(subject rbacv1.Subject) bool {
+	switch subject.Kind {
+	case rbacv1.ServiceAccountKind:
+		return subject.Namespace == metav1.NamespaceSystem
+	case rbacv1.UserKind, rbacv1.GroupKind:
+		return isSystemName(subject.Name)
+	default:
+		return true
+	}
+}
+
+func isSystemName(name string) bool {
+	for _, prefix := range systemSubjectPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns any of the groups we've been asked to impersonate that belong to kubernetes or the cloud provider
+func systemGroups(groups []string) []string {
+	system := []string{}
+	for _, group := range groups {
+		if group != authenticatedGroup && isSystemName(group) {
+			system = append(system, group)
+		}
+	}
+	return system
 }
@@ -0,0 +1,112 @@
+package controlchannel
+
+import (
+	"reflect"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func clusterRoleBinding(role string, subjects ...rbacv1.Subject) rbacv1.ClusterRoleBinding {
+	return rbacv1.ClusterRoleBinding{
+		RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: role},
+		Subjects: subjects,
+	}
+}
+
+func roleBinding(namespace string, role string, subjects ...rbacv1.Subject) rbacv1.RoleBinding {
+	return rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: role},
+		Subjects:   subjects,
+	}
+}
+
+func TestDiscoverSubjects(t *testing.T) {
+	alice := rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}
+	developers := rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "developers"}
+
+	tests := []struct {
+		name                string
+		clusterRoleBindings []rbacv1.ClusterRoleBinding
+		roleBindings        []rbacv1.RoleBinding
+		expected            []ClusterSubject
+	}{
+		{
+			name:     "NoBindings",
+			expected: []ClusterSubject{},
+		},
+		{
+			name:                "UsersAndGroups",
+			clusterRoleBindings: []rbacv1.ClusterRoleBinding{clusterRoleBinding("view", alice, developers)},
+			expected: []ClusterSubject{
+				{Kind: rbacv1.GroupKind, Name: "developers", Roles: []BoundRole{{Kind: "ClusterRole", Name: "view"}}},
+				{Kind: rbacv1.UserKind, Name: "alice", Roles: []BoundRole{{Kind: "ClusterRole", Name: "view"}}},
+			},
+		},
+		{
+			name:                "MergesRolesAcrossBindings",
+			clusterRoleBindings: []rbacv1.ClusterRoleBinding{clusterRoleBinding("view", alice)},
+			roleBindings: []rbacv1.RoleBinding{
+				roleBinding("prod", "deployer", alice),
+				roleBinding("dev", "admin", alice),
+			},
+			expected: []ClusterSubject{
+				{Kind: rbacv1.UserKind, Name: "alice", Roles: []BoundRole{
+					{Kind: "ClusterRole", Name: "view"},
+					{Kind: "Role", Name: "admin", Namespace: "dev"},
+					{Kind: "Role", Name: "deployer", Namespace: "prod"},
+				}},
+			},
+		},
+		{
+			// Users and groups aren't namespaced even when they're bound by a role binding
+			name:         "OnlyServiceAccountsHaveNamespaces",
+			roleBindings: []rbacv1.RoleBinding{roleBinding("dev", "edit", developers, rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "ci", Namespace: "build"})},
+			expected: []ClusterSubject{
+				{Kind: rbacv1.GroupKind, Name: "developers", Roles: []BoundRole{{Kind: "Role", Name: "edit", Namespace: "dev"}}},
+				{Kind: rbacv1.ServiceAccountKind, Name: "ci", Namespace: "build", Roles: []BoundRole{{Kind: "Role", Name: "edit", Namespace: "dev"}}},
+			},
+		},
+		{
+			name:         "ServiceAccountsDefaultToTheBindingsNamespace",
+			roleBindings: []rbacv1.RoleBinding{roleBinding("dev", "edit", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "ci"})},
+			expected: []ClusterSubject{
+				{Kind: rbacv1.ServiceAccountKind, Name: "ci", Namespace: "dev", Roles: []BoundRole{{Kind: "Role", Name: "edit", Namespace: "dev"}}},
+			},
+		},
+		{
+			name: "SkipsSystemSubjects",
+			clusterRoleBindings: []rbacv1.ClusterRoleBinding{
+				clusterRoleBinding("cluster-admin",
+					rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "system:masters"},
+					rbacv1.Subject{Kind: rbacv1.UserKind, Name: "eks:node-manager"},
+					rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "coredns", Namespace: metav1.NamespaceSystem},
+					rbacv1.Subject{Kind: "Unknown", Name: "bob"},
+					alice,
+				),
+			},
+			expected: []ClusterSubject{
+				{Kind: rbacv1.UserKind, Name: "alice", Roles: []BoundRole{{Kind: "ClusterRole", Name: "cluster-admin"}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if discovered := discoverSubjects(tt.clusterRoleBindings, tt.roleBindings); !reflect.DeepEqual(discovered, tt.expected) {
+				t.Errorf("expected %+v but discovered %+v", tt.expected, discovered)
+			}
+		})
+	}
+}
+
+func TestSystemGroups(t *testing.T) {
+	groups := []string{"developers", "system:masters", "eks:admins", "systematic", "system:authenticated"}
+
+	expected := []string{"system:masters", "eks:admins"}
+	if system := systemGroups(groups); !reflect.DeepEqual(system, expected) {
+		t.Errorf("expected system groups %v but got %v", expected, system)
+	}
+}
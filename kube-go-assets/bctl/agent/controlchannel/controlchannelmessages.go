@@ -1,14 +1,52 @@
 package controlchannel
 
+import (
+	dc "bastionzero.com/bctl/v1/bctl/agent/datachannel"
+)
+
 type NewDatachannelMessage struct {
 	ConnectionId string `json:"connectionId"`
-	Role         string `json:"role"`
+	Role         string `json:"role"` // the user we impersonate
 	Token        string `json:"token"`
+
+	// The groups we impersonate along with our role, if empty we only impersonate system:authenticated
+	Groups []string `json:"groups,omitempty"`
+}
+
+type ListDatachannelsResponse struct {
+	Datachannels []dc.Summary `json:"datachannels"`
+}
+
+type CloseDatachannelMessage struct {
+	ConnectionId string `json:"connectionId"`
+	Reason       string `json:"reason"`
+}
+
+type CloseDatachannelResponse struct {
+	ConnectionId string `json:"connectionId"`
+	Closing      bool   `json:"closing"`
+	Error        string `json:"error,omitempty"`
 }
 
 type AliveCheckClusterToBastionMessage struct {
-	Alive        bool     `json:"alive"`
-	ClusterUsers []string `json:"clusterUsers"`
+	Alive           bool             `json:"alive"`
+	ClusterUsers    []string         `json:"clusterUsers"`
+	ClusterSubjects []ClusterSubject `json:"clusterSubjects"`
+}
+
+// A user, group or service account Bastion could ask us to impersonate
+type ClusterSubject struct {
+	Kind      string      `json:"kind"`
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace,omitempty"` // only set for service accounts
+	Roles     []BoundRole `json:"roles"`
+}
+
+// A role or cluster role a subject is bound to
+type BoundRole struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"` // where a role binding applies, empty for cluster role bindings
 }
 
 type RegisterAgentMessage struct {
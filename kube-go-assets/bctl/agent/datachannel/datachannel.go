@@ -3,11 +3,17 @@ package datachannel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	ks "bastionzero.com/bctl/v1/bctl/agent/keysplitting"
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
 	kube "bastionzero.com/bctl/v1/bctl/agent/plugin/kube"
+	shell "bastionzero.com/bctl/v1/bctl/agent/plugin/shell"
+	tunnel "bastionzero.com/bctl/v1/bctl/agent/plugin/tunnel"
 	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
 	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
 	rrr "bastionzero.com/bctl/v1/bzerolib/error"
@@ -17,6 +23,21 @@ import (
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
 )
 
+const (
+	// How many times in a row we'll try to connect to Bastion for a daemon before giving up on it
+	maxConnectAttempts = 10
+
+	// How long our plugin gets to say goodbye to its users before we close our websocket anyway
+	pluginShutdownTimeout = 5 * time.Second
+
+	// How many keysplitting sessions a daemon can have open at once, and how long we'll keep one around without
+	// hearing from it. A daemon that comes back after that just gets an error and re-Syns
+	maxSessions        = 16
+	sessionIdleTimeout = 30 * time.Minute
+
+	shutdownReason = "agent is shutting down"
+)
+
 type IDataChannel interface {
 	Send(messageType wsmsg.MessageType, messagePayload interface{})
 	Receive(agentMessage wsmsg.AgentMessage)
@@ -26,16 +47,57 @@ type DataChannel struct {
 	websocket *ws.Websocket
 	logger    *lggr.Logger
 	ctx       context.Context
+	done      chan struct{}
 
-	plugin       plgn.IPlugin
-	keysplitting ks.IKeysplitting
+	// The daemon connection we were opened for, this is how Bastion refers to us
+	connectionId string
+	shutdownOnce sync.Once
+
+	// Closed when we start closing, so we stop handling anything new before our plugin says goodbye. Our
+	// message loop closes inputStopped once it's stopped routing messages
+	closing      chan struct{}
+	inputStopped chan struct{}
+
+	// Keeps any one daemon from hogging our bandwidth
+	inbound  *throttle
+	outbound *throttle
+
+	plugin     plgn.IPlugin
+	pluginLock sync.Mutex
+
+	// The daemon can open several independent hash chains so that its requests don't queue behind each other
+	sessions     map[string]*session
+	sessionsLock sync.Mutex
+	sessionsWg   sync.WaitGroup
 
 	// Kube-specific vars
-	role string
+	role   string
+	groups []string
+
+	// Tunnel-specific vars
+	allowedTunnelTargets []string
+
+	// Shell-specific vars
+	shellRunAsUser string
+}
+
+// A single keysplitting hash chain, identified by the session id the daemon picked in its Syn
+type session struct {
+	id           string
+	keysplitting ks.IKeysplitting
+	inputChan    chan ksmsg.KeysplittingMessage
+
+	// How many messages are on their way into inputChan, guarded by sessionsLock
+	pushing int
 }
 
-func NewDataChannel(logger *lggr.Logger,
+func NewDataChannel(parentCtx context.Context,
+	logger *lggr.Logger,
+	connectionId string,
 	role string,
+	groups []string,
+	allowedTunnelTargets []string,
+	shellRunAsUser string,
 	serviceUrl string,
 	hubEndpoint string,
 	params map[string]string,
@@ -44,39 +106,64 @@ func NewDataChannel(logger *lggr.Logger,
 	autoReconnect bool) (*DataChannel, error) {
 	subLogger := logger.GetWebsocketLogger()
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	wsClient, err := ws.NewWebsocket(ctx, subLogger, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect, false)
-	if err != nil {
-		cancel()
+	if err := reserve(); err != nil {
 		logger.Error(err)
-		return &DataChannel{}, err // TODO: how are we going to report these? control channel, bro
+		return &DataChannel{}, err
 	}
 
-	keysplitter, err := ks.NewKeysplitting()
+	// We don't inherit from parentCtx because we still need to talk to Bastion while we shut down
+	ctx, cancel := context.WithCancel(context.Background())
+
+	wsClient, err := ws.NewWebsocket(ctx, subLogger, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect, false, maxConnectAttempts)
 	if err != nil {
 		cancel()
+		release()
 		logger.Error(err)
-		return &DataChannel{}, err
+		return &DataChannel{}, err // TODO: how are we going to report these? control channel, bro
 	}
 
 	ret := &DataChannel{
-		websocket:    wsClient,
-		keysplitting: keysplitter,
-		role:         role,
-		logger:       logger, // TODO: get debug level from flag
-		ctx:          ctx,
+		websocket:            wsClient,
+		connectionId:         connectionId,
+		inbound:              newThrottle(limitsConfig().MaxBytesPerSecond),
+		outbound:             newThrottle(limitsConfig().MaxBytesPerSecond),
+		sessions:             make(map[string]*session),
+		role:                 role,
+		groups:               groups,
+		allowedTunnelTargets: allowedTunnelTargets,
+		shellRunAsUser:       shellRunAsUser,
+		logger:               logger, // TODO: get debug level from flag
+		ctx:                  ctx,
+		done:                 make(chan struct{}),
+		closing:              make(chan struct{}),
+		inputStopped:         make(chan struct{}),
 	}
+	metrics.ActiveDatachannels.Inc()
+	register(ret)
 
 	// Subscribe to our input channel
 	go func() {
+		defer close(ret.done)
+		defer release()
+		defer unregister(ret)
+		defer metrics.ActiveDatachannels.Dec()
+
+		parentDone := parentCtx.Done()
+		closing := ret.closing
+		inputChan := ret.websocket.InputChan
 		for {
 			select {
-			case agentMessage := <-ret.websocket.InputChan:
-				// Handle each message in its own thread
-				go func() {
-					ret.Receive(agentMessage)
-				}()
+			case <-parentDone:
+				// We keep waiting on our websocket so that everything we've already queued goes out before we close
+				parentDone = nil
+				go ret.shutdown(shutdownReason)
+			case <-closing:
+				closing = nil
+				inputChan = nil
+				close(ret.inputStopped)
+			case agentMessage := <-inputChan:
+				// Each session handles its keysplitting messages in order, this just routes them
+				ret.Receive(agentMessage)
 			case <-ret.websocket.DoneChan:
 				// The websocket has been closed
 				ret.logger.Info("Websocket has been closed, closing datachannel")
@@ -89,6 +176,82 @@ func NewDataChannel(logger *lggr.Logger,
 	return ret, nil
 }
 
+// Closed once our websocket is closed and we've stopped handling messages
+func (d *DataChannel) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *DataChannel) summary() Summary {
+	d.pluginLock.Lock()
+	plugin := d.plugin
+	d.pluginLock.Unlock()
+
+	summary := Summary{
+		ConnectionId: d.connectionId,
+		Role:         d.role,
+		Groups:       d.groups,
+		RequestIds:   []string{},
+	}
+	if plugin != nil {
+		summary.Plugin = string(plugin.GetName())
+	}
+	if p, ok := plugin.(plgn.IRequestPlugin); ok {
+		summary.RequestIds = p.RequestIds()
+	}
+	return summary
+}
+
+// Lets our plugin notify its users and then closes our websocket, which in turn closes us. We only do this
+// once, whether we're shutting down or Bastion asked us to close
+func (d *DataChannel) shutdown(reason string) {
+	d.shutdownOnce.Do(func() {
+		d.close(reason)
+	})
+}
+
+func (d *DataChannel) close(reason string) {
+	d.logger.Info(fmt.Sprintf("Closing datachannel: %s", reason))
+
+	// Stop handling input first, otherwise the daemon could start something new while our plugin is
+	// saying goodbye or while we're sending the last of our output
+	close(d.closing)
+	select {
+	case <-d.inputStopped:
+	case <-d.done:
+	}
+
+	sessionsStopped := make(chan struct{})
+	go func() {
+		d.sessionsWg.Wait()
+		close(sessionsStopped)
+	}()
+	select {
+	case <-sessionsStopped:
+	case <-time.After(pluginShutdownTimeout):
+		d.logger.Error(fmt.Errorf("timed out after %s waiting for our sessions to finish the messages they were handling", pluginShutdownTimeout))
+	}
+
+	d.pluginLock.Lock()
+	plugin := d.plugin
+	d.pluginLock.Unlock()
+
+	if s, ok := plugin.(plgn.IShutdownPlugin); ok {
+		notified := make(chan struct{})
+		go func() {
+			s.Shutdown(reason)
+			close(notified)
+		}()
+
+		select {
+		case <-notified:
+		case <-time.After(pluginShutdownTimeout):
+			d.logger.Error(fmt.Errorf("timed out after %s waiting for %v plugin to shut down", pluginShutdownTimeout, plugin.GetName()))
+		}
+	}
+
+	d.websocket.Close(reason)
+}
+
 // Wraps and sends the payload
 func (d *DataChannel) Send(messageType wsmsg.MessageType, messagePayload interface{}) {
 	// Stop any further messages from being sent once context is cancelled
@@ -107,16 +270,45 @@ func (d *DataChannel) Send(messageType wsmsg.MessageType, messagePayload interfa
 	d.websocket.OutputChan <- agentMessage
 }
 
-func (d *DataChannel) sendError(errType rrr.ErrorType, err error) {
+func (d *DataChannel) sendError(s *session, errType rrr.ErrorType, err error) {
 	d.logger.Error(err)
+	metrics.DatachannelErrors.Inc(string(errType))
 	errMsg := rrr.ErrorMessage{
-		Type:     string(errType),
-		Message:  err.Error(),
-		HPointer: d.keysplitting.GetHpointer(),
+		Type:    string(errType),
+		Message: err.Error(),
+	}
+
+	// Errors that happen before we know which session a message belongs to aren't tied to any hash chain
+	if s != nil {
+		errMsg.HPointer = s.keysplitting.GetHpointer()
+		errMsg.SessionId = s.id
 	}
 	d.Send(wsmsg.Error, errMsg)
 }
 
+// For errors that only affect a single request, the daemon fails that request and carries on with everything else
+func (d *DataChannel) sendRequestError(s *session, requestId string, errType rrr.ErrorType, err error) {
+	d.logger.Error(err)
+	metrics.DatachannelErrors.Inc(string(errType))
+	d.Send(wsmsg.Error, rrr.ErrorMessage{
+		Type:      string(errType),
+		Message:   err.Error(),
+		SessionId: s.id,
+		RequestId: requestId,
+	})
+}
+
+// For errors about a session we don't have, so the daemon can still tell which of its hash chains to restart
+func (d *DataChannel) sendSessionError(sessionId string, errType rrr.ErrorType, err error) {
+	d.logger.Error(err)
+	metrics.DatachannelErrors.Inc(string(errType))
+	d.Send(wsmsg.Error, rrr.ErrorMessage{
+		Type:      string(errType),
+		Message:   err.Error(),
+		SessionId: sessionId,
+	})
+}
+
 func (d *DataChannel) Receive(agentMessage wsmsg.AgentMessage) {
 	d.logger.Info("received message type: " + agentMessage.MessageType)
 
@@ -125,84 +317,253 @@ func (d *DataChannel) Receive(agentMessage wsmsg.AgentMessage) {
 		var ksMessage ksmsg.KeysplittingMessage
 		if err := json.Unmarshal(agentMessage.MessagePayload, &ksMessage); err != nil {
 			rerr := fmt.Errorf("malformed Keysplitting message")
-			d.sendError(rrr.KeysplittingValidationError, rerr)
-		} else {
-			d.handleKeysplittingMessage(&ksMessage)
+			d.sendError(nil, rrr.KeysplittingValidationError, rerr)
+		} else if !d.pushToSession(ksMessage) {
+			if ksMessage.Type == ksmsg.Syn {
+				d.openSession(&ksMessage)
+			} else {
+				rerr := fmt.Errorf("received %v message for unknown session: %s", ksMessage.Type, ksMessage.SessionId)
+				d.sendSessionError(ksMessage.SessionId, rrr.KeysplittingValidationError, rerr)
+			}
 		}
 	default:
 		rerr := fmt.Errorf("unhandled message type: %v", agentMessage.MessageType)
-		d.sendError(rrr.ComponentProcessingError, rerr)
+		d.sendError(nil, rrr.ComponentProcessingError, rerr)
 	}
 }
 
-func (d *DataChannel) handleKeysplittingMessage(keysplittingMessage *ksmsg.KeysplittingMessage) {
-	if err := d.keysplitting.Validate(keysplittingMessage); err != nil {
-		rerr := fmt.Errorf("invalid keysplitting message: %s", err)
-		d.sendError(rrr.KeysplittingValidationError, rerr)
+// Hands a keysplitting message to the session it belongs to, returns false if we don't have that session
+func (d *DataChannel) pushToSession(ksMessage ksmsg.KeysplittingMessage) bool {
+	// A session that's busy can keep us waiting, so we don't hold the lock while we push. Instead we let the
+	// session know a message is on its way, so it isn't removed for being idle out from under it
+	d.sessionsLock.Lock()
+	s, ok := d.sessions[ksMessage.SessionId]
+	if ok {
+		s.pushing++
+	}
+	d.sessionsLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	// Once we're closing, our sessions aren't taking anything else so we drop it
+	select {
+	case s.inputChan <- ksMessage:
+	case <-d.closing:
+	case <-d.ctx.Done():
+	}
+
+	d.sessionsLock.Lock()
+	s.pushing--
+	d.sessionsLock.Unlock()
+	return true
+}
+
+// Only a valid Syn can start a new session, so nobody but the daemon can get us to hold on to one
+func (d *DataChannel) openSession(ksMessage *ksmsg.KeysplittingMessage) {
+	keysplitter, err := ks.NewKeysplitting(ksMessage.SessionId)
+	if err != nil {
+		rerr := fmt.Errorf("could not start keysplitting session: %s", err)
+		d.sendSessionError(ksMessage.SessionId, rrr.KeysplittingValidationError, rerr)
+		return
+	}
+
+	s := &session{
+		id:           ksMessage.SessionId,
+		keysplitting: keysplitter,
+		inputChan:    make(chan ksmsg.KeysplittingMessage, 100),
+	}
+	if !d.validateKeysplittingMessage(s, ksMessage) {
 		return
 	}
 
+	d.sessionsLock.Lock()
+	if len(d.sessions) >= maxSessions {
+		d.sessionsLock.Unlock()
+		rerr := fmt.Errorf("daemon already has the maximum of %d keysplitting sessions open", maxSessions)
+		d.sendError(s, rrr.ComponentProcessingError, rerr)
+		return
+	}
+	d.sessions[s.id] = s
+	d.sessionsLock.Unlock()
+	d.logger.Info(fmt.Sprintf("Started keysplitting session %s", s.id))
+
+	// Only our message loop opens sessions, and it's stopped before we wait on them
+	d.sessionsWg.Add(1)
+	go d.runSession(s, ksMessage)
+}
+
+// Keysplitting messages form a hash chain, so each session has to handle them in the order we receive them
+func (d *DataChannel) runSession(s *session, synMessage *ksmsg.KeysplittingMessage) {
+	defer d.sessionsWg.Done()
+
+	d.processKeysplittingMessage(s, synMessage)
+
+	idle := time.NewTimer(sessionIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		// Whatever the daemon sent that we hadn't started on before we started closing won't be handled
+		select {
+		case <-d.closing:
+			return
+		default:
+		}
+
+		select {
+		case <-d.ctx.Done():
+			d.removeSession(s)
+			return
+		case <-d.closing:
+			return
+		case ksMessage := <-s.inputChan:
+			d.handleKeysplittingMessage(s, &ksMessage)
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(sessionIdleTimeout)
+		case <-idle.C:
+			if d.removeSession(s) {
+				d.logger.Info(fmt.Sprintf("Closed keysplitting session %s after %s without any messages", s.id, sessionIdleTimeout))
+				return
+			}
+			idle.Reset(sessionIdleTimeout)
+		}
+	}
+}
+
+// Forgets about a session, as long as there aren't any messages waiting on it
+func (d *DataChannel) removeSession(s *session) bool {
+	d.sessionsLock.Lock()
+	defer d.sessionsLock.Unlock()
+
+	if len(s.inputChan) > 0 || s.pushing > 0 {
+		return false
+	}
+	delete(d.sessions, s.id)
+	return true
+}
+
+func (d *DataChannel) handleKeysplittingMessage(s *session, keysplittingMessage *ksmsg.KeysplittingMessage) {
+	if d.validateKeysplittingMessage(s, keysplittingMessage) {
+		d.processKeysplittingMessage(s, keysplittingMessage)
+	}
+}
+
+// Lets the daemon know and returns false if the message doesn't belong in this session's hash chain
+func (d *DataChannel) validateKeysplittingMessage(s *session, keysplittingMessage *ksmsg.KeysplittingMessage) bool {
+	if err := s.keysplitting.Validate(keysplittingMessage); err != nil {
+		rerr := fmt.Errorf("invalid keysplitting message: %s", err)
+		switch {
+		case errors.Is(err, ks.ErrBZCertExpired):
+			d.sendError(s, rrr.BZCertExpiredError, rerr)
+		case errors.Is(err, ks.ErrTargetIdMismatch):
+			d.sendError(s, rrr.TargetIdMismatchError, rerr)
+		case errors.Is(err, ks.ErrTimestampSkew):
+			d.sendError(s, rrr.TimestampSkewError, rerr)
+		case errors.Is(err, ks.ErrReplayedNonce):
+			d.sendError(s, rrr.ReplayedNonceError, rerr)
+		default:
+			d.sendError(s, rrr.KeysplittingValidationError, rerr)
+		}
+		return false
+	}
+	return true
+}
+
+func (d *DataChannel) processKeysplittingMessage(s *session, keysplittingMessage *ksmsg.KeysplittingMessage) {
 	switch keysplittingMessage.Type {
 	case ksmsg.Syn:
 		synPayload := keysplittingMessage.KeysplittingPayload.(ksmsg.SynPayload)
 		// Grab user's action
 		if x := strings.Split(synPayload.Action, "/"); len(x) <= 1 {
 			rerr := fmt.Errorf("malformed action: %s", synPayload.Action)
-			d.sendError(rrr.KeysplittingValidationError, rerr)
+			d.sendError(s, rrr.KeysplittingValidationError, rerr)
 			return
 		} else {
-			if d.plugin != nil { // Don't start plugin if there's already one started
-				return
-			}
-
-			// Start plugin
+			// Every session shares the same plugin, so only start it for the first Syn we see
 			if err := d.startPlugin(plgn.PluginName(x[0])); err != nil {
-				d.sendError(rrr.ComponentStartupError, err)
+				d.sendError(s, rrr.ComponentStartupError, err)
 				return
 			}
 
-			d.sendKeysplittingMessage(keysplittingMessage, "", []byte{}) // empty payload
+			d.sendKeysplittingMessage(s, keysplittingMessage, "", []byte{}) // empty payload
 		}
 	case ksmsg.Data:
 		dataPayload := keysplittingMessage.KeysplittingPayload.(ksmsg.DataPayload)
+		if err := d.inbound.wait(d.ctx, len(dataPayload.ActionPayload)); err != nil {
+			return
+		}
 
 		// Send message to plugin and catch response action payload
-		if _, returnPayload, err := d.plugin.InputMessageHandler(dataPayload.Action, dataPayload.ActionPayload); err == nil {
+		_, returnPayload, err := d.plugin.InputMessageHandler(dataPayload.Action, dataPayload.ActionPayload)
+		var requestErr *plgn.RequestError
+		if err == nil {
+
+			// Responses like a kube api response can be as big as anything we stream, so they count against us too
+			if err := d.outbound.wait(d.ctx, len(returnPayload)); err != nil {
+				return
+			}
 
 			// Build and send response
-			d.sendKeysplittingMessage(keysplittingMessage, dataPayload.Action, returnPayload)
+			d.sendKeysplittingMessage(s, keysplittingMessage, dataPayload.Action, returnPayload)
+		} else if errors.Is(err, plgn.ErrTooManyActions) && errors.As(err, &requestErr) {
+			// We're only turning away this one request, so we still ack it to keep the hash chain going for
+			// every other request the daemon has on it
+			d.sendKeysplittingMessage(s, keysplittingMessage, dataPayload.Action, []byte{})
+			d.sendRequestError(s, requestErr.RequestId, rrr.ActionRejectedError, err)
 		} else {
 			rerr := fmt.Errorf("unrecognized keysplitting message type: %s", keysplittingMessage.Type)
-			d.sendError(rrr.KeysplittingValidationError, rerr)
+			d.sendError(s, rrr.KeysplittingValidationError, rerr)
 		}
 	default:
 		rerr := fmt.Errorf("invalid Keysplitting Payload")
-		d.sendError(rrr.KeysplittingValidationError, rerr)
+		d.sendError(s, rrr.KeysplittingValidationError, rerr)
 	}
 }
 
 func (d *DataChannel) startPlugin(plugin plgn.PluginName) error {
+	d.pluginLock.Lock()
+	defer d.pluginLock.Unlock()
+
+	// Don't start plugin if there's already one started, the daemon is just starting another hash chain
+	if d.plugin != nil {
+		return nil
+	}
+
 	msg := fmt.Sprintf("Starting %v plugin", plugin)
 	d.logger.Info(msg)
 
 	switch plugin {
-	case plgn.Kube:
+	case plgn.Kube, plgn.Tunnel, plgn.Shell:
 
 		// create channel and listener and pass it to the new plugin
-		ch := make(chan smsg.StreamMessage)
+		limits := limitsConfig()
+		ch := make(chan smsg.StreamMessage, limits.StreamBufferSize)
 		go func() {
 			for {
 				select {
 				case <-d.ctx.Done():
 					return
 				case streamMessage := <-ch:
+					if err := d.outbound.wait(d.ctx, len(streamMessage.Content)); err != nil {
+						return
+					}
 					d.Send(wsmsg.Stream, streamMessage)
 				}
 			}
 		}()
 
 		subLogger := d.logger.GetPluginLogger(plugin)
-		d.plugin = kube.NewPlugin(d.ctx, subLogger, ch, d.role)
+		switch plugin {
+		case plgn.Kube:
+			d.plugin = kube.NewPlugin(d.ctx, subLogger, ch, d.role, d.groups, limits.MaxActionsPerPlugin)
+		case plgn.Tunnel:
+			d.plugin = tunnel.NewPlugin(d.ctx, subLogger, ch, d.allowedTunnelTargets, limits.MaxActionsPerPlugin)
+		case plgn.Shell:
+			d.plugin = shell.NewPlugin(d.ctx, subLogger, ch, d.shellRunAsUser, limits.MaxActionsPerPlugin)
+		}
 		d.logger.Info("Plugin started!")
 		return nil
 	default:
@@ -210,13 +571,14 @@ func (d *DataChannel) startPlugin(plugin plgn.PluginName) error {
 	}
 }
 
-func (d *DataChannel) sendKeysplittingMessage(keysplittingMessage *ksmsg.KeysplittingMessage, action string, payload []byte) error {
+func (d *DataChannel) sendKeysplittingMessage(s *session, keysplittingMessage *ksmsg.KeysplittingMessage, action string, payload []byte) error {
 	// Build and send response
-	if respKSMessage, err := d.keysplitting.BuildResponse(keysplittingMessage, action, payload); err != nil {
+	if respKSMessage, err := s.keysplitting.BuildResponse(keysplittingMessage, action, payload); err != nil {
 		rerr := fmt.Errorf("could not build response message: %s", err)
 		d.logger.Error(rerr)
 		return rerr
 	} else {
+		respKSMessage.SessionId = s.id
 		d.Send(wsmsg.Keysplitting, respKSMessage)
 		return nil
 	}
@@ -0,0 +1,125 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultMaxDatachannels     = 100
+	defaultMaxActionsPerPlugin = 50
+	defaultStreamBufferSize    = 100
+)
+
+// How much of the agent any one daemon, or all of them together, can use up. Zero values get our defaults,
+// which don't limit bandwidth at all
+type Limits struct {
+	// How many datachannels can be open at once, across every daemon
+	MaxDatachannels int
+
+	// How many requests each datachannel's plugin can be handling at once, e.g. exec sessions or tunnel connections
+	MaxActionsPerPlugin int
+
+	// How many stream messages each plugin can queue up before it has to wait on Bastion
+	StreamBufferSize int
+
+	// How many bytes each datachannel can send and receive per second, in each direction
+	MaxBytesPerSecond int
+}
+
+// NewDataChannel returns an error wrapping this when we already have as many datachannels open as we're allowed
+var ErrTooManyDatachannels = errors.New("too many datachannels")
+
+var (
+	limits = Limits{
+		MaxDatachannels:     defaultMaxDatachannels,
+		MaxActionsPerPlugin: defaultMaxActionsPerPlugin,
+		StreamBufferSize:    defaultStreamBufferSize,
+	}
+	limitsLock sync.Mutex
+
+	// How many datachannels we've agreed to open, including ones that are still connecting
+	openDatachannels int
+)
+
+// Should be called before we open any datachannels
+func ConfigureLimits(config Limits) error {
+	if config.MaxDatachannels < 0 || config.MaxActionsPerPlugin < 0 || config.StreamBufferSize < 0 || config.MaxBytesPerSecond < 0 {
+		return fmt.Errorf("datachannel limits can't be negative: %+v", config)
+	}
+
+	if config.MaxDatachannels == 0 {
+		config.MaxDatachannels = defaultMaxDatachannels
+	}
+	if config.MaxActionsPerPlugin == 0 {
+		config.MaxActionsPerPlugin = defaultMaxActionsPerPlugin
+	}
+	if config.StreamBufferSize == 0 {
+		config.StreamBufferSize = defaultStreamBufferSize
+	}
+
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	limits = config
+	return nil
+}
+
+func limitsConfig() Limits {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	return limits
+}
+
+// Holds a spot for a new datachannel, every successful call has to be matched by a call to release
+func reserve() error {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	if openDatachannels >= limits.MaxDatachannels {
+		return fmt.Errorf("%w: agent already has the maximum of %d open", ErrTooManyDatachannels, limits.MaxDatachannels)
+	}
+	openDatachannels++
+	return nil
+}
+
+func release() {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	openDatachannels--
+}
+
+// Throttles one direction of a datachannel's traffic, doesn't do anything if we don't limit bandwidth
+type throttle struct {
+	limiter *rate.Limiter
+}
+
+func newThrottle(bytesPerSecond int) *throttle {
+	if bytesPerSecond == 0 {
+		return &throttle{}
+	}
+	return &throttle{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond),
+	}
+}
+
+// Blocks until we're allowed to pass along n more bytes, or ctx is done
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.limiter == nil {
+		return nil
+	}
+
+	// Anything bigger than a second's worth has to wait for more than one second's allowance
+	for burst := t.limiter.Burst(); n > burst; n -= burst {
+		if err := t.limiter.WaitN(ctx, burst); err != nil {
+			return err
+		}
+	}
+	return t.limiter.WaitN(ctx, n)
+}
@@ -0,0 +1,69 @@
+package datachannel
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Every datachannel that's currently open, by the connection id of the daemon it was opened for
+var (
+	datachannels     = make(map[string]*DataChannel)
+	datachannelsLock sync.Mutex
+)
+
+// What Bastion needs to know to decide whether a datachannel should be closed
+type Summary struct {
+	ConnectionId string   `json:"connectionId"`
+	Role         string   `json:"role"`
+	Groups       []string `json:"groups,omitempty"`
+	Plugin       string   `json:"plugin"`
+	RequestIds   []string `json:"requestIds"`
+}
+
+func register(d *DataChannel) {
+	datachannelsLock.Lock()
+	defer datachannelsLock.Unlock()
+
+	datachannels[d.connectionId] = d
+}
+
+func unregister(d *DataChannel) {
+	datachannelsLock.Lock()
+	defer datachannelsLock.Unlock()
+
+	// A daemon that reconnected may already have a new datachannel under the same connection id
+	if datachannels[d.connectionId] == d {
+		delete(datachannels, d.connectionId)
+	}
+}
+
+// Returns a summary of every datachannel that's currently open
+func List() []Summary {
+	datachannelsLock.Lock()
+	open := make([]*DataChannel, 0, len(datachannels))
+	for _, d := range datachannels {
+		open = append(open, d)
+	}
+	datachannelsLock.Unlock()
+
+	summaries := []Summary{}
+	for _, d := range open {
+		summaries = append(summaries, d.summary())
+	}
+	return summaries
+}
+
+// Starts closing the datachannel opened for the given connection id, its users are told why. Returns once
+// we've started closing, the datachannel's Done channel is closed once it's finished
+func Close(connectionId string, reason string) error {
+	datachannelsLock.Lock()
+	d, ok := datachannels[connectionId]
+	datachannelsLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no open datachannel for connection id: %s", connectionId)
+	}
+
+	go d.shutdown(reason)
+	return nil
+}
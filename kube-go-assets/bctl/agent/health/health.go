@@ -0,0 +1,148 @@
+/*
+This package serves the probes Kubernetes uses to decide whether to restart the agent (/healthz) and whether
+it's able to do its job (/readyz). Components add named checks as they start up, and each probe passes only
+if every one of its checks does.
+*/
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+)
+
+const (
+	livenessEndpoint  = "/healthz"
+	readinessEndpoint = "/readyz"
+
+	// A check that takes longer than this fails, our probes' timeoutSeconds should be longer so we get to say why
+	checkTimeout = 5 * time.Second
+)
+
+// Returns nil if whatever it checks is healthy
+type Check func() error
+
+var (
+	livenessChecks  = make(map[string]Check)
+	readinessChecks = make(map[string]Check)
+	checksLock      sync.Mutex
+)
+
+// Adds a check that has to pass for us to be considered alive, replacing any other check with the same name
+func AddLivenessCheck(name string, check Check) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+
+	livenessChecks[name] = check
+}
+
+// Adds a check that has to pass for us to be considered ready, replacing any other check with the same name
+func AddReadinessCheck(name string, check Check) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+
+	readinessChecks[name] = check
+}
+
+// For components that haven't started yet, so we aren't ready until they replace it with a real check
+func Pending(reason string) Check {
+	return func() error {
+		return fmt.Errorf("%s", reason)
+	}
+}
+
+// For components that only have to do something once, like registering
+func Done() error {
+	return nil
+}
+
+// Starts serving our probes, if address is empty we don't
+func Serve(logger *lggr.Logger, address string) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(livenessEndpoint, handler(logger, livenessChecks))
+	mux.Handle(readinessEndpoint, handler(logger, readinessChecks))
+
+	go func() {
+		logger.Info(fmt.Sprintf("Serving health probes on %s", address))
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logger.Error(fmt.Errorf("error serving health probes: %s", err))
+		}
+	}()
+}
+
+// Responds with every check and whether it passed, in the same format as the kube api server's own probes
+func handler(logger *lggr.Logger, checks map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checksLock.Lock()
+		names := make([]string, 0, len(checks))
+		toRun := make(map[string]Check, len(checks))
+		for name, check := range checks {
+			names = append(names, name)
+			toRun[name] = check
+		}
+		checksLock.Unlock()
+		sort.Strings(names)
+
+		results := runChecks(toRun)
+
+		var out bytes.Buffer
+		failed := false
+		for _, name := range names {
+			if err := results[name]; err != nil {
+				failed = true
+				fmt.Fprintf(&out, "[-]%s failed: %s\n", name, err)
+			} else {
+				fmt.Fprintf(&out, "[+]%s ok\n", name)
+			}
+		}
+
+		if failed {
+			logger.Debug(fmt.Sprintf("%s check failed:\n%s", r.URL.Path, out.String()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			out.WriteString(r.URL.Path + " check failed\n")
+		} else {
+			out.WriteString(r.URL.Path + " check passed\n")
+		}
+		w.Write(out.Bytes())
+	})
+}
+
+// Runs every check at once, a check that's stuck counts as a failed one
+func runChecks(checks map[string]Check) map[string]error {
+	type result struct {
+		name string
+		err  error
+	}
+	resultChan := make(chan result, len(checks))
+	for name, check := range checks {
+		name, check := name, check
+		go func() {
+			resultChan <- result{name, check()}
+		}()
+	}
+
+	results := make(map[string]error, len(checks))
+	for name := range checks {
+		results[name] = fmt.Errorf("timed out after %s", checkTimeout)
+	}
+
+	timeout := time.After(checkTimeout)
+	for range checks {
+		select {
+		case r := <-resultChan:
+			results[r.name] = r.err
+		case <-timeout:
+			return results
+		}
+	}
+	return results
+}
@@ -1,9 +1,12 @@
 package keysplitting
 
 import (
-	ed "crypto/ed25519"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"bastionzero.com/bctl/v1/bctl/agent/vault"
@@ -12,6 +15,31 @@ import (
 	"bastionzero.com/bctl/v1/bzerolib/keysplitting/util"
 )
 
+const (
+	// The most Data messages we'll let a daemon have in flight at once
+	maxPipelineWindow = 32
+
+	// How far a message's timestamp can be from our clock, this bounds how long a captured Syn could be replayed
+	maxTimestampSkew = 5 * time.Minute
+)
+
+var (
+	// Returned when a Data message is signed with a BZCert whose id token has since expired
+	ErrBZCertExpired = errors.New("BZCert has expired")
+
+	// Returned when a message was meant for a different agent or session
+	ErrTargetIdMismatch = errors.New("TargetId did not match")
+
+	// Returned when a message's timestamp is too far from our clock
+	ErrTimestampSkew = errors.New("timestamp outside of allowed window")
+
+	// Returned when we've already accepted a Syn with the same nonce
+	ErrReplayedNonce = errors.New("nonce has already been used")
+
+	// Returned when a pipelining daemon points at a DataAck we never sent, or sends more than its window
+	ErrPipelineViolation = errors.New("pipelined Data message rejected")
+)
+
 type BZCertMetadata struct {
 	Cert bzcrt.BZCert
 	Exp  time.Time
@@ -27,35 +55,75 @@ type Keysplitting struct {
 	hPointer         string
 	expectedHPointer string
 	bzCerts          map[string]BZCertMetadata // only for agent
-	publickey        string
 	privatekey       string
 	idpProvider      string
 	idpOrgId         string
+	customIdp        bzcrt.CustomIdpConfig
 	orgId            string
+
+	// Our agent's registered public key, daemons bind their messages to it and check our responses are signed with it
+	targetId string
+
+	// The hash chain we were started for, daemons bind their Syns to it too
+	sessionId string
+
+	// If the daemon asked to pipeline its Data messages, this is how many it's allowed in flight
+	pipelineWindow int
+
+	// When pipelining, every Data message points at the latest DataAck the daemon has received. We count the
+	// Data messages we accept and remember which one each of our unreferenced acks was for, so we know how
+	// many the daemon has in flight
+	dataReceived     int
+	lastAckHash      string
+	lastAckSequence  int
+	unreferencedAcks []sentAck
+
+	// The hash of the last Data message we accepted, so a daemon that re-Syns after reconnecting knows
+	// which of its messages it doesn't need to resend
+	lastDataHash string
 }
 
-func NewKeysplitting() (IKeysplitting, error) {
-	// Generate public private key pair along ed25519 curve
-	if publicKey, privateKey, err := ed.GenerateKey(nil); err != nil {
-		return &Keysplitting{}, fmt.Errorf("error generating key pair: %v", err.Error())
-	} else {
-		pubkeyString := base64.StdEncoding.EncodeToString([]byte(publicKey))
-		privkeyString := base64.StdEncoding.EncodeToString([]byte(privateKey))
-
-		// Load in our idp infomation from the vault as well
-		config, _ := vault.LoadVault()
-
-		return &Keysplitting{
-			hPointer:         "",
-			expectedHPointer: "",
-			bzCerts:          make(map[string]BZCertMetadata),
-			publickey:        pubkeyString,
-			privatekey:       privkeyString,
-			idpProvider:      config.Data.IdpProvider,
-			idpOrgId:         config.Data.IdpOrgId,
-			orgId:            config.Data.OrgId,
-		}, nil
+type sentAck struct {
+	hash     string
+	sequence int
+}
+
+func NewKeysplitting(sessionId string) (IKeysplitting, error) {
+	// We sign with the key pair we registered with, so daemons can tell our responses came from us
+	config, err := vault.LoadVault()
+	if err != nil {
+		return &Keysplitting{}, fmt.Errorf("error loading vault: %s", err)
+	} else if config.Data.PublicKey == "" || config.Data.PrivateKey == "" {
+		return &Keysplitting{}, fmt.Errorf("agent has not been registered, no key pair in vault")
+	}
+
+	return &Keysplitting{
+		hPointer:         "",
+		expectedHPointer: "",
+		bzCerts:          make(map[string]BZCertMetadata),
+		privatekey:       config.Data.PrivateKey,
+		idpProvider:      config.Data.IdpProvider,
+		idpOrgId:         config.Data.IdpOrgId,
+		customIdp: bzcrt.CustomIdpConfig{
+			IssuerUrl: config.Data.IdpIssuerUrl,
+			OrgClaim:  config.Data.IdpOrgClaim,
+			Audiences: splitList(config.Data.IdpAudiences),
+		},
+		orgId:     config.Data.OrgId,
+		targetId:  config.Data.PublicKey,
+		sessionId: sessionId,
+	}, nil
+}
+
+// Splits a comma separated list from our vault, ignoring any empty entries
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
 	}
+	return values
 }
 
 func (k *Keysplitting) GetHpointer() string {
@@ -67,8 +135,24 @@ func (k *Keysplitting) Validate(ksMessage *ksmsg.KeysplittingMessage) error {
 	case ksmsg.Syn:
 		synPayload := ksMessage.KeysplittingPayload.(ksmsg.SynPayload)
 
+		// Make sure this Syn was meant for us and not captured on its way to another agent. Daemons that weren't told
+		// which agent they're connecting to leave it empty, and bind their Data messages to the key in our SynAck
+		if synPayload.TargetId != "" && synPayload.TargetId != k.targetId {
+			return fmt.Errorf("%w: syn's TargetId did not match Target's actual ID", ErrTargetIdMismatch)
+		} else if synPayload.SessionId != k.sessionId {
+			return fmt.Errorf("%w: syn's SessionId did not match the session it was sent on", ErrTargetIdMismatch)
+		}
+
+		timestamp, err := validateTimestamp(synPayload.Timestamp)
+		if err != nil {
+			return err
+		}
+
+		// Daemons re-Syn with a new BZCert every time their token is refreshed, so don't hang on to the old ones
+		k.evictExpiredBZCerts()
+
 		// Verify the BZCert
-		if hash, exp, err := synPayload.BZCert.Verify(k.idpProvider, k.idpOrgId); err != nil {
+		if hash, exp, err := synPayload.BZCert.Verify(k.idpProvider, k.idpOrgId, k.customIdp); err != nil {
 			return err
 		} else {
 			k.bzCerts[hash] = BZCertMetadata{
@@ -82,16 +166,43 @@ func (k *Keysplitting) Validate(ksMessage *ksmsg.KeysplittingMessage) error {
 			return err
 		}
 
-		// Make sure targetId matches
-		// if synPayload.TargetId != k.publickey {
-		// 	return fmt.Errorf("syn's TargetId did not match Target's actual ID")
-		// }
+		// Once a Syn's timestamp is outside our window we'd reject it anyway, so that's as long as we need its nonce
+		if !synNonces.add(synPayload.Nonce, timestamp.Add(maxTimestampSkew)) {
+			return fmt.Errorf("%w: %s", ErrReplayedNonce, synPayload.Nonce)
+		}
+
+		// Every Syn starts a new hash chain, so check whether the daemon wants to pipeline this one
+		k.pipelineWindow = 0
+		k.dataReceived = 0
+		k.lastAckHash = ""
+		k.lastAckSequence = 0
+		k.unreferencedAcks = nil
+		var negotiation ksmsg.PipelineNegotiation
+		if err := json.Unmarshal(synPayload.ActionPayload, &negotiation); err == nil && negotiation.PipelineWindow > 1 {
+			k.pipelineWindow = negotiation.PipelineWindow
+			if k.pipelineWindow > maxPipelineWindow {
+				k.pipelineWindow = maxPipelineWindow
+			}
+		}
 	case ksmsg.Data:
 		dataPayload := ksMessage.KeysplittingPayload.(ksmsg.DataPayload)
 
+		// Data messages are bound to our registered key, same as the Syn
+		if dataPayload.TargetId != k.targetId {
+			return fmt.Errorf("%w: data's TargetId did not match Target's actual ID", ErrTargetIdMismatch)
+		}
+
+		if _, err := validateTimestamp(dataPayload.Timestamp); err != nil {
+			return err
+		}
+
 		// Check BZCert matches one we have stored
 		if certMetadata, ok := k.bzCerts[dataPayload.BZCertHash]; !ok {
 			return fmt.Errorf("could not match BZCert hash to one previously received")
+		} else if time.Now().After(certMetadata.Exp) {
+			// A session can't outlive the user's SSO session, they'll have to prove they're still logged in
+			delete(k.bzCerts, dataPayload.BZCertHash)
+			return fmt.Errorf("%w at %s", ErrBZCertExpired, certMetadata.Exp.Format(time.RFC3339))
 		} else {
 
 			// Verify the Signature
@@ -105,23 +216,91 @@ func (k *Keysplitting) Validate(ksMessage *ksmsg.KeysplittingMessage) error {
 			return fmt.Errorf("data's hash pointer did not match expected")
 		}
 
-		// Make sure targetId matches
-		// if dataPayload.TargetId != k.publickey {
-		// 	return fmt.Errorf("data's TargetId did not match Target's actual ID")
-		// }
+		// When pipelining, the next Data message will point at this one rather than at our DataAck
+		if k.pipelineWindow > 0 {
+			if err := k.validateAckHPointer(dataPayload.AckHPointer); err != nil {
+				return err
+			}
+
+			hashBytes, _ := util.HashPayload(dataPayload)
+			k.expectedHPointer = base64.StdEncoding.EncodeToString(hashBytes)
+		}
+		k.dataReceived++
 	default:
 		return fmt.Errorf("error validating unhandled Keysplitting type")
 	}
 	return nil
 }
 
+// Makes sure a pipelined Data message points at a DataAck we actually sent, no older than the last one the
+// daemon pointed at, and that the daemon isn't sending more than its window ahead of our acks
+func (k *Keysplitting) validateAckHPointer(ackHPointer string) error {
+	if ackHPointer != k.lastAckHash {
+		found := false
+		for i, ack := range k.unreferencedAcks {
+			if ack.hash == ackHPointer {
+				k.lastAckHash = ack.hash
+				k.lastAckSequence = ack.sequence
+				k.unreferencedAcks = k.unreferencedAcks[i+1:]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%w: data's ack hash pointer did not match any DataAck we sent", ErrPipelineViolation)
+		}
+	}
+
+	// This message is one more in flight on top of everything we've accepted since the last ack the daemon saw
+	if inFlight := k.dataReceived + 1 - k.lastAckSequence; inFlight > k.pipelineWindow {
+		return fmt.Errorf("%w: %d Data messages in flight exceeds the window of %d", ErrPipelineViolation, inFlight, k.pipelineWindow)
+	}
+	return nil
+}
+
+// Timestamps are unix seconds as a string
+func validateTimestamp(timestamp string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: malformed timestamp %q", ErrTimestampSkew, timestamp)
+	}
+
+	messageTime := time.Unix(seconds, 0)
+	if skew := time.Since(messageTime); skew > maxTimestampSkew || skew < -maxTimestampSkew {
+		return messageTime, fmt.Errorf("%w: %s is %s from our clock", ErrTimestampSkew, messageTime.Format(time.RFC3339), skew)
+	}
+	return messageTime, nil
+}
+
+func (k *Keysplitting) evictExpiredBZCerts() {
+	now := time.Now()
+	for hash, certMetadata := range k.bzCerts {
+		if now.After(certMetadata.Exp) {
+			delete(k.bzCerts, hash)
+		}
+	}
+}
+
 func (k *Keysplitting) BuildResponse(ksMessage *ksmsg.KeysplittingMessage, action string, actionPayload []byte) (ksmsg.KeysplittingMessage, error) {
 	var responseMessage ksmsg.KeysplittingMessage
 
 	switch ksMessage.Type {
 	case ksmsg.Syn:
+		// Let the daemon know how many Data messages we'll accept in flight and where we left off
+		if (k.pipelineWindow > 0 || k.lastDataHash != "") && len(actionPayload) == 0 {
+			actionPayload, _ = json.Marshal(ksmsg.SynAckNegotiation{
+				PipelineNegotiation: ksmsg.PipelineNegotiation{
+					PipelineWindow: k.pipelineWindow,
+				},
+				ResumeNegotiation: ksmsg.ResumeNegotiation{
+					LastDataHash: k.lastDataHash,
+				},
+			})
+		}
+
 		synPayload := ksMessage.KeysplittingPayload.(ksmsg.SynPayload)
-		if synAckPayload, hash, err := synPayload.BuildResponsePayload(actionPayload, k.publickey); err != nil {
+		if synAckPayload, hash, err := synPayload.BuildResponsePayload(actionPayload, k.targetId); err != nil {
 			return ksmsg.KeysplittingMessage{}, err
 		} else {
 			k.hPointer = hash
@@ -132,10 +311,11 @@ func (k *Keysplitting) BuildResponse(ksMessage *ksmsg.KeysplittingMessage, actio
 		}
 	case ksmsg.Data:
 		dataPayload := ksMessage.KeysplittingPayload.(ksmsg.DataPayload)
-		if dataAckPayload, hash, err := dataPayload.BuildResponsePayload(actionPayload, k.publickey); err != nil {
+		if dataAckPayload, hash, err := dataPayload.BuildResponsePayload(actionPayload, k.targetId); err != nil {
 			return ksmsg.KeysplittingMessage{}, err
 		} else {
 			k.hPointer = hash
+			k.lastDataHash = hash
 			responseMessage = ksmsg.KeysplittingMessage{
 				Type:                ksmsg.DataAck,
 				KeysplittingPayload: dataAckPayload,
@@ -143,8 +323,17 @@ func (k *Keysplitting) BuildResponse(ksMessage *ksmsg.KeysplittingMessage, actio
 		}
 	}
 
+	// The first Data message always points at our SynAck, after that we only expect the daemon to point at
+	// our DataAck if it's waiting on them. Otherwise it'll point at our acks as it receives them
 	hashBytes, _ := util.HashPayload(responseMessage.KeysplittingPayload)
-	k.expectedHPointer = base64.StdEncoding.EncodeToString(hashBytes)
+	if ksMessage.Type == ksmsg.Syn || k.pipelineWindow == 0 {
+		k.expectedHPointer = base64.StdEncoding.EncodeToString(hashBytes)
+	} else {
+		k.unreferencedAcks = append(k.unreferencedAcks, sentAck{
+			hash:     base64.StdEncoding.EncodeToString(hashBytes),
+			sequence: k.dataReceived,
+		})
+	}
 
 	// Sign it and send it
 	if err := responseMessage.Sign(k.privatekey); err != nil {
@@ -0,0 +1,33 @@
+package keysplitting
+
+import (
+	"sync"
+	"time"
+)
+
+// Every Syn nonce we've accepted, across all sessions, until its Syn is too old to be accepted again anyway
+type nonceCache struct {
+	nonces map[string]time.Time
+	lock   sync.Mutex
+}
+
+var synNonces = &nonceCache{nonces: make(map[string]time.Time)}
+
+// Returns false if we've already seen this nonce, otherwise remembers it until expiry
+func (c *nonceCache) add(nonce string, expiry time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for seen, seenExpiry := range c.nonces {
+		if now.After(seenExpiry) {
+			delete(c.nonces, seen)
+		}
+	}
+
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = expiry
+	return true
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	"bastionzero.com/bctl/v1/bzerolib/metrics"
+)
+
+const (
+	metricsEndpoint = "/metrics"
+)
+
+// Everything the agent reports, alongside anything shared code like our StdWriters reports for us
+var (
+	ControlChannelReconnects = metrics.NewCounter(
+		"bzero_agent_controlchannel_reconnects_total",
+		"Number of times the control channel has reconnected to Bastion")
+
+	ActiveDatachannels = metrics.NewGauge(
+		"bzero_agent_datachannels_active",
+		"Number of datachannels currently open to Bastion")
+
+	DatachannelErrors = metrics.NewCounter(
+		"bzero_agent_datachannel_errors_total",
+		"Number of errors sent back to Bastion, including keysplitting validation failures",
+		"type")
+
+	KubeRequests = metrics.NewCounter(
+		"bzero_agent_kube_requests_total",
+		"Number of kube plugin requests that have finished",
+		"action")
+
+	KubeRequestDuration = metrics.NewHistogram(
+		"bzero_agent_kube_request_duration_seconds",
+		"How long kube plugin requests took, including streaming their whole response for exec, stream and portforward",
+		metrics.DefaultBuckets,
+		"action")
+
+	KubeApiResponses = metrics.NewCounter(
+		"bzero_agent_kube_api_responses_total",
+		"Responses from the kube api server to requests we made on a user's behalf",
+		"code")
+)
+
+// Records how long a kube request for this action took, once it's finished
+func ObserveKubeRequest(action string, start time.Time) {
+	KubeRequests.Inc(action)
+	KubeRequestDuration.Observe(time.Since(start).Seconds(), action)
+}
+
+// Wraps a transport so that every response it gets from the kube api server is counted
+func InstrumentKubeApi(transport http.RoundTripper) http.RoundTripper {
+	return kubeApiRoundTripper{transport}
+}
+
+type kubeApiRoundTripper struct {
+	transport http.RoundTripper
+}
+
+func (k kubeApiRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := k.transport.RoundTrip(req)
+	if err == nil {
+		KubeApiResponses.Inc(strconv.Itoa(res.StatusCode))
+	}
+	return res, err
+}
+
+// Starts serving our metrics for Prometheus to scrape, if address is empty we don't
+func Serve(logger *lggr.Logger, address string) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsEndpoint, metrics.Handler())
+
+	go func() {
+		logger.Info(fmt.Sprintf("Serving metrics on %s%s", address, metricsEndpoint))
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logger.Error(fmt.Errorf("error serving metrics: %s", err))
+		}
+	}()
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sync"
+	"time"
 
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
 	kubeutils "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/utils"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
@@ -22,23 +24,27 @@ const (
 	StartExec  ExecSubAction = "kube/exec/start"
 	ExecInput  ExecSubAction = "kube/exec/input"
 	ExecResize ExecSubAction = "kube/exec/resize"
+	ExecAck    ExecSubAction = "kube/exec/ack"
 	StopExec   ExecSubAction = "kube/exec/stop"
 )
 
 const (
 	EscChar = "^[" // ESC char
+
+	// The number of unacknowledged stdin chunks, including the end of stream, a daemon that asks for flow
+	// control is allowed to have in flight
+	StdinWindowSize = 16
 )
 
 type ExecAction struct {
-	serviceAccountToken string
-	kubeHost            string
-	impersonateGroup    string
-	role                string
-	logId               string
-	requestId           string
-	closed              bool
-	logger              *lggr.Logger
-	ctx                 context.Context
+	kubeConfig        *kubeutils.KubeConfig
+	impersonateGroups []string
+	role              string
+	logId             string
+	requestId         string
+	closed            bool
+	logger            *lggr.Logger
+	ctx               context.Context
 
 	// output channel to send all of our stream messages directly to datachannel
 	streamOutputChannel chan smsg.StreamMessage
@@ -46,24 +52,37 @@ type ExecAction struct {
 	// To send input/resize to our exec sessions
 	execStdinChannel  chan []byte
 	execResizeChannel chan KubeExecResizeActionPayload
+
+	// Flow control for large transfers e.g. kubectl cp, only used if the daemon asks for it. Stdin waits in
+	// stdinQueue until the pod is ready for it, so a slow pod never holds up the acks for our output
+	flowControl                 bool
+	stdinQueue                  chan KubeStdinActionPayload
+	expectedStdinSequenceNumber int
+	stdinClosed                 bool // once the daemon has told us stdin is done, we close execStdinChannel
+	stdinLock                   sync.Mutex
+
+	// Guards closed and our writers, which are only set once the exec has started
+	lock         sync.Mutex
+	isTty        bool
+	stdoutWriter *stdout.StdWriter
+	stderrWriter *stdout.StdWriter
 }
 
 func NewExecAction(ctx context.Context,
 	logger *lggr.Logger,
-	serviceAccountToken string,
-	kubeHost string,
-	impersonateGroup string,
+	kubeConfig *kubeutils.KubeConfig,
+	impersonateGroups []string,
 	role string,
 	ch chan smsg.StreamMessage) (*ExecAction, error) {
 
 	return &ExecAction{
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		impersonateGroup:    impersonateGroup,
+		kubeConfig:          kubeConfig,
+		impersonateGroups:   impersonateGroups,
 		role:                role,
 		closed:              false,
 		streamOutputChannel: ch,
 		execStdinChannel:    make(chan []byte, 10),
+		stdinQueue:          make(chan KubeStdinActionPayload, StdinWindowSize),
 		execResizeChannel:   make(chan KubeExecResizeActionPayload, 10),
 		logger:              logger,
 		ctx:                 ctx,
@@ -71,9 +90,29 @@ func NewExecAction(ctx context.Context,
 }
 
 func (e *ExecAction) Closed() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
 	return e.closed
 }
 
+// Lets the user know why their session is about to end, e.g. because the agent is being upgraded. With a TTY
+// kubectl doesn't show stderr at all, it all comes out of stdout
+func (e *ExecAction) Shutdown(reason string) {
+	e.lock.Lock()
+	writer := e.stderrWriter
+	if e.isTty {
+		writer = e.stdoutWriter
+	}
+	closed := e.closed
+	e.lock.Unlock()
+
+	if closed || writer == nil {
+		return
+	}
+	writer.Write([]byte(fmt.Sprintf("\r\n%s\r\n", reason)))
+}
+
 func (e *ExecAction) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
 	// TODO: Check request ID matches from startexec
 	switch ExecSubAction(action) {
@@ -103,7 +142,40 @@ func (e *ExecAction) InputMessageHandler(action string, actionPayload []byte) (s
 			return "", []byte{}, err
 		}
 
-		e.execStdinChannel <- execInputAction.Stdin
+		e.stdinLock.Lock()
+		defer e.stdinLock.Unlock()
+
+		// Anything after the end of stdin would have nowhere to go
+		if e.stdinClosed && (!e.flowControl || execInputAction.SequenceNumber >= e.expectedStdinSequenceNumber) {
+			rerr := fmt.Errorf("received stdin after the end of the stream")
+			e.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if !e.flowControl {
+			e.execStdinChannel <- execInputAction.Stdin
+			return string(ExecInput), []byte{}, nil
+		}
+
+		// Make sure we don't write the same chunk twice or skip one, either would corrupt a file transfer
+		if execInputAction.SequenceNumber > e.expectedStdinSequenceNumber {
+			rerr := fmt.Errorf("missing stdin chunk: expected sequence number %d but received %d", e.expectedStdinSequenceNumber, execInputAction.SequenceNumber)
+			e.logger.Error(rerr)
+			return "", []byte{}, rerr
+		} else if execInputAction.SequenceNumber == e.expectedStdinSequenceNumber {
+			// We only ack chunks once the pod has them, so a daemon sticking to its window always has room
+			select {
+			case e.stdinQueue <- execInputAction:
+				e.stdinClosed = execInputAction.EndOfStream
+				e.expectedStdinSequenceNumber++
+			default:
+				rerr := fmt.Errorf("received more than %d unacknowledged stdin chunks", StdinWindowSize)
+				e.logger.Error(rerr)
+				return "", []byte{}, rerr
+			}
+		} else {
+			e.logger.Info(fmt.Sprintf("Ignoring duplicate stdin chunk with sequence number %d", execInputAction.SequenceNumber))
+		}
 		return string(ExecInput), []byte{}, nil
 
 	case ExecResize:
@@ -121,6 +193,36 @@ func (e *ExecAction) InputMessageHandler(action string, actionPayload []byte) (s
 		e.execResizeChannel <- execResizeAction
 		return string(ExecResize), []byte{}, nil
 
+	case ExecAck:
+		var execAckAction KubeExecAckActionPayload
+		if err := json.Unmarshal(actionPayload, &execAckAction); err != nil {
+			rerr := fmt.Errorf("error unmarshaling ack message: %s", err)
+			e.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := e.validateRequestId(execAckAction.RequestId); err != nil {
+			return "", []byte{}, err
+		}
+
+		if !e.flowControl {
+			rerr := fmt.Errorf("received ack for exec without flow control")
+			e.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		switch smsg.StreamType(execAckAction.StreamType) {
+		case smsg.StdOut:
+			e.stdoutWriter.Ack(execAckAction.SequenceNumber)
+		case smsg.StdErr:
+			e.stderrWriter.Ack(execAckAction.SequenceNumber)
+		default:
+			rerr := fmt.Errorf("received ack for unknown stream type: %s", execAckAction.StreamType)
+			e.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+		return string(ExecAck), []byte{}, nil
+
 	default:
 		rerr := fmt.Errorf("unhandled exec action: %v", action)
 		e.logger.Error(rerr)
@@ -136,24 +238,51 @@ func (e *ExecAction) validateRequestId(requestId string) error {
 	return nil
 }
 
-func (e *ExecAction) StartExec(startExecRequest KubeExecStartActionPayload) (string, []byte, error) {
-	// Now open up our local exec session
-	// Create the in-cluster config
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		rerr := fmt.Errorf("error creating in-custer config: %s", err)
-		e.logger.Error(rerr)
-		return "", []byte{}, rerr
+// Hands flow controlled stdin off to the pod in order, acknowledging each chunk once it has it
+func (e *ExecAction) forwardStdin() {
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case chunk := <-e.stdinQueue:
+			if chunk.EndOfStream {
+				// Closing our stdin channel is how we let the pod know there's nothing left to read
+				close(e.execStdinChannel)
+			} else {
+				select {
+				case <-e.ctx.Done():
+					return
+				case e.execStdinChannel <- chunk.Stdin:
+				}
+			}
+
+			message := smsg.StreamMessage{
+				Type:           string(smsg.StdInAck),
+				RequestId:      e.requestId,
+				LogId:          e.logId,
+				SequenceNumber: chunk.SequenceNumber,
+				Content:        "",
+			}
+			select {
+			case <-e.ctx.Done():
+				return
+			case e.streamOutputChannel <- message:
+			}
+
+			if chunk.EndOfStream {
+				return
+			}
+		}
 	}
+}
 
-	// Add our impersonation information
-	config.Impersonate = rest.ImpersonationConfig{
-		UserName: e.role,
-		Groups:   []string{e.impersonateGroup},
-	}
-	config.BearerToken = e.serviceAccountToken
+func (e *ExecAction) StartExec(startExecRequest KubeExecStartActionPayload) (string, []byte, error) {
+	start := time.Now()
+
+	// Now open up our local exec session with our impersonation information
+	config := e.kubeConfig.ImpersonatingRestConfig(e.role, e.impersonateGroups)
 
-	kubeExecApiUrl := e.kubeHost + startExecRequest.Endpoint
+	kubeExecApiUrl := e.kubeConfig.Host() + startExecRequest.Endpoint
 	kubeExecApiUrlParsed, err := url.Parse(kubeExecApiUrl)
 	if err != nil {
 		rerr := fmt.Errorf("could not parse kube exec url: %s", err)
@@ -167,11 +296,22 @@ func (e *ExecAction) StartExec(startExecRequest KubeExecStartActionPayload) (str
 		return string(StartExec), []byte{}, fmt.Errorf("error creating Spdy executor: %s", err)
 	}
 
-	stderrWriter := stdout.NewStdWriter(smsg.StdErr, e.streamOutputChannel, startExecRequest.RequestId, e.logId)
-	stdoutWriter := stdout.NewStdWriter(smsg.StdOut, e.streamOutputChannel, startExecRequest.RequestId, e.logId)
+	// If the daemon will be acknowledging our output, only ever have a window's worth in flight
+	e.flowControl = startExecRequest.WindowSize > 0
+	stderrWriter := stdout.NewFlowControlledStdWriter(smsg.StdErr, e.streamOutputChannel, startExecRequest.RequestId, e.logId, startExecRequest.WindowSize)
+	stdoutWriter := stdout.NewFlowControlledStdWriter(smsg.StdOut, e.streamOutputChannel, startExecRequest.RequestId, e.logId, startExecRequest.WindowSize)
+	e.lock.Lock()
+	e.isTty = startExecRequest.IsTty
+	e.stderrWriter = stderrWriter
+	e.stdoutWriter = stdoutWriter
+	e.lock.Unlock()
 	stdinReader := stdin.NewStdReader(smsg.StdIn, startExecRequest.RequestId, e.execStdinChannel)
 	terminalSizeQueue := NewTerminalSizeQueue(startExecRequest.RequestId, e.execResizeChannel)
 
+	if e.flowControl {
+		go e.forwardStdin()
+	}
+
 	go func() {
 		// This function listens for a closed datachannel.  If the datachannel is closed, it doesn't necessarily mean
 		// that the exec was properly closed, and because the below exec.Stream only returns when it's done, there's
@@ -180,6 +320,10 @@ func (e *ExecAction) StartExec(startExecRequest KubeExecStartActionPayload) (str
 		// https://github.com/kubernetes/client-go/issues/554
 		<-e.ctx.Done()
 		stdinReader.Close()
+
+		// Don't leave anyone waiting on acknowledgements that will never come
+		stdoutWriter.Close()
+		stderrWriter.Close()
 	}()
 
 	go func() {
@@ -212,7 +356,10 @@ func (e *ExecAction) StartExec(startExecRequest KubeExecStartActionPayload) (str
 		// Now close the stream
 		stdoutWriter.Write([]byte(EscChar))
 
+		metrics.ObserveKubeRequest("exec", start)
+		e.lock.Lock()
 		e.closed = true
+		e.lock.Unlock()
 	}()
 
 	return string(StartExec), []byte{}, nil
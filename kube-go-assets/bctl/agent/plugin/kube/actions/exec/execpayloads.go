@@ -8,6 +8,10 @@ type KubeExecStartActionPayload struct {
 	Command         []string `json:"command"`
 	Endpoint        string   `json:"endpoint"`
 	CommandBeingRun string   `json:"commandBeingRun"`
+
+	// The number of unacknowledged stdout/stderr messages the agent is allowed to have in flight. Zero
+	// means the daemon doesn't acknowledge output and we shouldn't wait on it
+	WindowSize int `json:"windowSize"`
 }
 
 // Exec payload for the "kube/exec/input" action
@@ -15,6 +19,19 @@ type KubeStdinActionPayload struct {
 	RequestId string `json:"requestId"`
 	LogId     string `json:"logId"`
 	Stdin     []byte `json:"stdin"`
+
+	// Only used when flow control is enabled, lets us drop duplicates and catch gaps in large transfers
+	SequenceNumber int  `json:"sequenceNumber"`
+	EndOfStream    bool `json:"endOfStream"`
+}
+
+// Exec payload for the "kube/exec/ack" action, acknowledges every stream message up to and
+// including the sequence number
+type KubeExecAckActionPayload struct {
+	RequestId      string `json:"requestId"`
+	LogId          string `json:"logId"`
+	StreamType     string `json:"streamType"`
+	SequenceNumber int    `json:"sequenceNumber"`
 }
 
 // payload for "kube/exec/resize"
@@ -0,0 +1,418 @@
+package portforward
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	kubeportforward "k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
+	kubeutils "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/utils"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+)
+
+type PortForwardSubAction string
+
+const (
+	StartPortForward        PortForwardSubAction = "kube/portforward/start"
+	StartPortForwardRequest PortForwardSubAction = "kube/portforward/request/start"
+	DataInPortForward       PortForwardSubAction = "kube/portforward/datain"
+	StopPortForwardRequest  PortForwardSubAction = "kube/portforward/request/stop"
+	StopPortForward         PortForwardSubAction = "kube/portforward/stop"
+)
+
+const (
+	// Size of the buffer we read from the pod with before sending it to the daemon
+	streamBufferSize = 32 * 1024
+)
+
+type PortForwardAction struct {
+	kubeConfig        *kubeutils.KubeConfig
+	impersonateGroups []string
+	role              string
+	logId             string
+	requestId         string
+	closed            bool
+	logger            *lggr.Logger
+	ctx               context.Context
+	cancel            context.CancelFunc
+	start             time.Time
+
+	// output channel to send all of our stream messages directly to datachannel
+	streamOutputChannel chan smsg.StreamMessage
+
+	// Our SPDY connection to the kube api server and all the streams we have opened on it
+	streamConn      httpstream.Connection
+	requests        map[string]*portForwardRequest
+	requestsMapLock sync.Mutex
+}
+
+// Every local connection kubectl accepts results in a pair of data and error streams against the pod
+type portForwardRequest struct {
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+}
+
+func NewPortForwardAction(ctx context.Context,
+	logger *lggr.Logger,
+	kubeConfig *kubeutils.KubeConfig,
+	impersonateGroups []string,
+	role string,
+	ch chan smsg.StreamMessage) (*PortForwardAction, error) {
+
+	portForwardCtx, cancel := context.WithCancel(ctx)
+
+	return &PortForwardAction{
+		kubeConfig:          kubeConfig,
+		impersonateGroups:   impersonateGroups,
+		role:                role,
+		closed:              false,
+		streamOutputChannel: ch,
+		requests:            make(map[string]*portForwardRequest),
+		logger:              logger,
+		ctx:                 portForwardCtx,
+		cancel:              cancel,
+		start:               time.Now(),
+	}, nil
+}
+
+func (p *PortForwardAction) Closed() bool {
+	p.requestsMapLock.Lock()
+	defer p.requestsMapLock.Unlock()
+
+	return p.closed
+}
+
+func (p *PortForwardAction) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	switch PortForwardSubAction(action) {
+
+	// Start port forward message required before anything else
+	case StartPortForward:
+		var startPortForwardRequest KubePortForwardStartActionPayload
+		if err := json.Unmarshal(actionPayload, &startPortForwardRequest); err != nil {
+			rerr := fmt.Errorf("unable to unmarshal start port forward message: %s", err)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		p.logId = startPortForwardRequest.LogId
+		p.requestId = startPortForwardRequest.RequestId
+		return p.startPortForward(startPortForwardRequest)
+
+	case StartPortForwardRequest:
+		var requestPayload KubePortForwardRequestActionPayload
+		if err := json.Unmarshal(actionPayload, &requestPayload); err != nil {
+			rerr := fmt.Errorf("unable to unmarshal port forward request message: %s", err)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := p.validateRequestId(requestPayload.RequestId); err != nil {
+			return "", []byte{}, err
+		}
+
+		return p.startPortForwardRequest(requestPayload)
+
+	case DataInPortForward:
+		var dataInRequest KubePortForwardDataInActionPayload
+		if err := json.Unmarshal(actionPayload, &dataInRequest); err != nil {
+			rerr := fmt.Errorf("unable to unmarshal port forward data message: %s", err)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := p.validateRequestId(dataInRequest.RequestId); err != nil {
+			return "", []byte{}, err
+		}
+
+		request, ok := p.getRequestsMap(dataInRequest.PortForwardRequestId)
+		if !ok {
+			rerr := fmt.Errorf("unknown port forward request ID: %s", dataInRequest.PortForwardRequestId)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if _, err := request.dataStream.Write(dataInRequest.Data); err != nil {
+			rerr := fmt.Errorf("error writing to port forward data stream: %s", err)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+		return string(DataInPortForward), []byte{}, nil
+
+	case StopPortForwardRequest:
+		var requestPayload KubePortForwardRequestActionPayload
+		if err := json.Unmarshal(actionPayload, &requestPayload); err != nil {
+			rerr := fmt.Errorf("unable to unmarshal port forward request message: %s", err)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := p.validateRequestId(requestPayload.RequestId); err != nil {
+			return "", []byte{}, err
+		}
+
+		p.stopPortForwardRequest(requestPayload.PortForwardRequestId)
+		return string(StopPortForwardRequest), []byte{}, nil
+
+	case StopPortForward:
+		var stopPortForwardRequest KubePortForwardStopActionPayload
+		if err := json.Unmarshal(actionPayload, &stopPortForwardRequest); err != nil {
+			rerr := fmt.Errorf("unable to unmarshal stop port forward message: %s", err)
+			p.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := p.validateRequestId(stopPortForwardRequest.RequestId); err != nil {
+			return "", []byte{}, err
+		}
+
+		p.logger.Info("Stopping Port Forward Action")
+		p.stop()
+		return string(StopPortForward), []byte{}, nil
+
+	default:
+		rerr := fmt.Errorf("unhandled port forward action: %v", action)
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+}
+
+func (p *PortForwardAction) validateRequestId(requestId string) error {
+	if err := kubeutils.ValidateRequestId(requestId, p.requestId); err != nil {
+		p.logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (p *PortForwardAction) startPortForward(startPortForwardRequest KubePortForwardStartActionPayload) (string, []byte, error) {
+	// Add our impersonation information
+	config := p.kubeConfig.ImpersonatingRestConfig(p.role, p.impersonateGroups)
+
+	kubePortForwardApiUrl := p.kubeConfig.Host() + startPortForwardRequest.Endpoint
+	kubePortForwardApiUrlParsed, err := url.Parse(kubePortForwardApiUrl)
+	if err != nil {
+		rerr := fmt.Errorf("could not parse kube port forward url: %s", err)
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+
+	// Build our SPDY dialer and upgrade the connection to the kube api server
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		rerr := fmt.Errorf("error creating SPDY round tripper: %s", err)
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", kubePortForwardApiUrlParsed)
+
+	streamConn, _, err := dialer.Dial(kubeportforward.PortForwardProtocolV1Name)
+	if err != nil {
+		rerr := fmt.Errorf("error dialing port forward connection: %s", err)
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+	p.streamConn = streamConn
+
+	go func() {
+		// Make sure we tear down our connection if the datachannel goes away or the kube api server
+		// hangs up on us
+		select {
+		case <-p.ctx.Done():
+		case <-streamConn.CloseChan():
+			p.logger.Info("Port forward connection closed by the kube api server")
+		}
+		p.stop()
+	}()
+
+	return string(StartPortForward), []byte{}, nil
+}
+
+func (p *PortForwardAction) startPortForwardRequest(requestPayload KubePortForwardRequestActionPayload) (string, []byte, error) {
+	if p.streamConn == nil {
+		rerr := fmt.Errorf("port forward request received before port forward was started")
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+
+	// Create our error stream, we never write to it so close our half right away
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.FormatInt(requestPayload.PodPort, 10))
+	headers.Set(v1.PortForwardRequestIDHeader, requestPayload.PortForwardRequestId)
+	errorStream, err := p.streamConn.CreateStream(headers)
+	if err != nil {
+		rerr := fmt.Errorf("error creating port forward error stream: %s", err)
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+	errorStream.Close()
+
+	// Then our data stream
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := p.streamConn.CreateStream(headers)
+	if err != nil {
+		errorStream.Reset()
+		rerr := fmt.Errorf("error creating port forward data stream: %s", err)
+		p.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+
+	p.updateRequestsMap(requestPayload.PortForwardRequestId, &portForwardRequest{
+		dataStream:  dataStream,
+		errorStream: errorStream,
+	})
+
+	// kubectl won't let go of a connection until it's read everything off of the error stream, so it needs its
+	// own end of stream. That's also how errors like nothing listening on the port make it back to the user
+	errorDone := make(chan struct{})
+	go func() {
+		defer close(errorDone)
+		sequenceNumber := p.forwardStream(smsg.PortForwardError, requestPayload.PortForwardRequestId, errorStream)
+
+		if _, ok := p.getRequestsMap(requestPayload.PortForwardRequestId); ok {
+			p.sendEndOfStream(smsg.PortForwardError, requestPayload.PortForwardRequestId, sequenceNumber)
+		}
+	}()
+	go func() {
+		sequenceNumber := p.forwardStream(smsg.PortForwardData, requestPayload.PortForwardRequestId, dataStream)
+
+		// The pod closes both streams when it's done, make sure we've passed on whatever error it had for us
+		// before we reset them
+		select {
+		case <-p.ctx.Done():
+		case <-errorDone:
+		}
+
+		// Once the pod stops talking to us, there's nothing left to do for this request. Unless the daemon
+		// stopped it first, it's still waiting on us, so let it know it can close kubectl's connection
+		if _, ok := p.getRequestsMap(requestPayload.PortForwardRequestId); ok {
+			p.sendEndOfStream(smsg.PortForwardData, requestPayload.PortForwardRequestId, sequenceNumber)
+			p.stopPortForwardRequest(requestPayload.PortForwardRequestId)
+		}
+	}()
+
+	return string(StartPortForwardRequest), []byte{}, nil
+}
+
+func (r *portForwardRequest) reset() {
+	r.dataStream.Reset()
+	r.errorStream.Reset()
+}
+
+// Reads everything off of a stream from the pod and sends it back to the daemon, returns the sequence number
+// of the next message we would have sent
+func (p *PortForwardAction) forwardStream(streamType smsg.StreamType, portForwardRequestId string, stream io.Reader) int {
+	buf := make([]byte, streamBufferSize)
+	sequenceNumber := 0
+
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			content := KubePortForwardStreamMessageContent{
+				PortForwardRequestId: portForwardRequestId,
+				Content:              buf[:n],
+			}
+			if !p.sendStreamMessage(streamType, sequenceNumber, content) {
+				return sequenceNumber
+			}
+			sequenceNumber += 1
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Info(fmt.Sprintf("Error reading %s stream: %s", streamType, err))
+			}
+			return sequenceNumber
+		}
+	}
+}
+
+func (p *PortForwardAction) sendEndOfStream(streamType smsg.StreamType, portForwardRequestId string, sequenceNumber int) {
+	content := KubePortForwardStreamMessageContent{
+		PortForwardRequestId: portForwardRequestId,
+		Content:              []byte{},
+		EndOfStream:          true,
+	}
+	p.sendStreamMessage(streamType, sequenceNumber, content)
+}
+
+// Returns false if we're shutting down and the message was never sent
+func (p *PortForwardAction) sendStreamMessage(streamType smsg.StreamType, sequenceNumber int, content KubePortForwardStreamMessageContent) bool {
+	contentBytes, _ := json.Marshal(content)
+	message := smsg.StreamMessage{
+		Type:           string(streamType),
+		RequestId:      p.requestId,
+		LogId:          p.logId,
+		SequenceNumber: sequenceNumber,
+		Content:        base64.StdEncoding.EncodeToString(contentBytes),
+	}
+
+	select {
+	case <-p.ctx.Done():
+		return false
+	case p.streamOutputChannel <- message:
+		return true
+	}
+}
+
+func (p *PortForwardAction) stopPortForwardRequest(portForwardRequestId string) {
+	if request, ok := p.getRequestsMap(portForwardRequestId); ok {
+		p.deleteRequestsMap(portForwardRequestId)
+		request.reset()
+	}
+}
+
+func (p *PortForwardAction) stop() {
+	p.requestsMapLock.Lock()
+	defer p.requestsMapLock.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	for id, request := range p.requests {
+		request.reset()
+		delete(p.requests, id)
+	}
+
+	if p.streamConn != nil {
+		p.streamConn.Close()
+	}
+
+	p.cancel()
+	p.closed = true
+	metrics.ObserveKubeRequest("portforward", p.start)
+}
+
+// Helper functions so we avoid writing to this map at the same time
+func (p *PortForwardAction) updateRequestsMap(id string, request *portForwardRequest) {
+	p.requestsMapLock.Lock()
+	p.requests[id] = request
+	p.requestsMapLock.Unlock()
+}
+
+func (p *PortForwardAction) deleteRequestsMap(id string) {
+	p.requestsMapLock.Lock()
+	delete(p.requests, id)
+	p.requestsMapLock.Unlock()
+}
+
+func (p *PortForwardAction) getRequestsMap(id string) (*portForwardRequest, bool) {
+	p.requestsMapLock.Lock()
+	defer p.requestsMapLock.Unlock()
+	request, ok := p.requests[id]
+	return request, ok
+}
@@ -0,0 +1,41 @@
+package portforward
+
+// Port forward payload for the "kube/portforward/start" and "kube/portforward/stop" actions
+type KubePortForwardStartActionPayload struct {
+	RequestId       string `json:"requestId"`
+	LogId           string `json:"logId"`
+	Endpoint        string `json:"endpoint"`
+	CommandBeingRun string `json:"commandBeingRun"`
+}
+
+type KubePortForwardStopActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+}
+
+// Payload for "kube/portforward/request/start" and "kube/portforward/request/stop", sent once
+// for every local connection kubectl accepts
+type KubePortForwardRequestActionPayload struct {
+	RequestId            string `json:"requestId"`
+	LogId                string `json:"logId"`
+	PortForwardRequestId string `json:"portForwardRequestId"`
+	PodPort              int64  `json:"podPort"`
+}
+
+// Payload for "kube/portforward/datain"
+type KubePortForwardDataInActionPayload struct {
+	RequestId            string `json:"requestId"`
+	LogId                string `json:"logId"`
+	PortForwardRequestId string `json:"portForwardRequestId"`
+	Data                 []byte `json:"data"`
+}
+
+// The content of every "kube/portforward/data" and "kube/portforward/error" stream message,
+// so the daemon knows which local connection the bytes belong to
+type KubePortForwardStreamMessageContent struct {
+	PortForwardRequestId string `json:"portForwardRequestId"`
+	Content              []byte `json:"content"`
+
+	// Set on the last message of a stream, once the pod has nothing more to send
+	EndOfStream bool `json:"endOfStream,omitempty"`
+}
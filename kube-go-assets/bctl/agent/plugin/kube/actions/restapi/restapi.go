@@ -5,28 +5,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
 	kubeutils "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/utils"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 )
 
 type RestApiAction struct {
-	serviceAccountToken string
-	kubeHost            string
-	impersonateGroup    string
-	role                string
-	closed              bool
-	logger              *lggr.Logger
+	kubeConfig        *kubeutils.KubeConfig
+	impersonateGroups []string
+	role              string
+	closed            bool
+	logger            *lggr.Logger
 }
 
-func NewRestApiAction(logger *lggr.Logger, serviceAccountToken string, kubeHost string, impersonateGroup string, role string) (*RestApiAction, error) {
+func NewRestApiAction(logger *lggr.Logger, kubeConfig *kubeutils.KubeConfig, impersonateGroups []string, role string) (*RestApiAction, error) {
 	return &RestApiAction{
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		impersonateGroup:    impersonateGroup,
-		role:                role,
-		logger:              logger,
-		closed:              false,
+		kubeConfig:        kubeConfig,
+		impersonateGroups: impersonateGroups,
+		role:              role,
+		logger:            logger,
+		closed:            false,
 	}, nil
 }
 
@@ -35,6 +35,7 @@ func (r *RestApiAction) Closed() bool {
 }
 
 func (r *RestApiAction) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	defer metrics.ObserveKubeRequest("restapi", time.Now())
 	defer func() {
 		r.closed = true
 	}()
@@ -50,7 +51,7 @@ func (r *RestApiAction) InputMessageHandler(action string, actionPayload []byte)
 	r.logger.Info(fmt.Sprintf("Making request for %s", apiRequest.Endpoint))
 	req := r.buildHttpRequest(apiRequest.Endpoint, apiRequest.Body, apiRequest.Method, apiRequest.Headers)
 
-	httpClient := &http.Client{}
+	httpClient := r.kubeConfig.HttpClient()
 	res, err := httpClient.Do(req)
 	if err != nil {
 		rerr := fmt.Errorf("bad response to API request: %s", err)
@@ -81,5 +82,5 @@ func (r *RestApiAction) InputMessageHandler(action string, actionPayload []byte)
 }
 
 func (r *RestApiAction) buildHttpRequest(endpoint, body, method string, headers map[string][]string) *http.Request {
-	return kubeutils.BuildHttpRequest(r.kubeHost, endpoint, body, method, headers, r.serviceAccountToken, r.role, r.impersonateGroup)
+	return kubeutils.BuildHttpRequest(r.kubeConfig.Host(), endpoint, body, method, headers, r.kubeConfig.ServiceAccountToken(), r.role, r.impersonateGroups)
 }
@@ -0,0 +1,89 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"bastionzero.com/bctl/v1/bctl/agent/plugin/kube/fakeapiserver"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+)
+
+const (
+	podsPath = "/api/v1/namespaces/default/pods"
+)
+
+func TestRequestsImpersonateRoleAndGroups(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		groups         []string
+		headers        map[string][]string
+		expectedStatus int
+	}{
+		{
+			name:           "ImpersonatesRoleAndGroups",
+			role:           "alice",
+			groups:         []string{"devs", "ops"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "IgnoresClientImpersonation",
+			role:   "alice",
+			groups: []string{"devs", "ops"},
+			headers: map[string][]string{
+				"Impersonate-User":  {"admin"},
+				"impersonate-group": {"system:masters"},
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "SomeoneElse",
+			role:           "mallory",
+			groups:         []string{"devs", "ops"},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiServer := fakeapiserver.New()
+			defer apiServer.Close()
+			apiServer.ImpersonateUser = "alice"
+			apiServer.ImpersonateGroups = []string{"devs", "ops"}
+			apiServer.SetResponse(http.MethodGet, podsPath, http.StatusOK, []byte(`{"kind":"PodList"}`))
+
+			kubeConfig, err := apiServer.KubeConfig()
+			if err != nil {
+				t.Fatalf("could not build kube config: %s", err)
+			}
+			logger, _ := lggr.NewLogger(lggr.Error, "")
+			action, _ := NewRestApiAction(logger, kubeConfig, tt.groups, tt.role)
+
+			payload, _ := json.Marshal(KubeRestApiActionPayload{
+				Endpoint:  podsPath,
+				Headers:   tt.headers,
+				Method:    http.MethodGet,
+				RequestId: "request",
+			})
+			_, responseBytes, err := action.InputMessageHandler("kube/restapi", payload)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+
+			var response KubeRestApiActionResponsePayload
+			if err := json.Unmarshal(responseBytes, &response); err != nil {
+				t.Fatalf("could not unmarshal response: %s", err)
+			} else if response.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d but got %d: %s", tt.expectedStatus, response.StatusCode, response.Content)
+			}
+
+			requests := apiServer.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 request to reach the api server but got %d", len(requests))
+			} else if user := requests[0].Header.Get("Impersonate-User"); user != tt.role {
+				t.Errorf("expected to impersonate user %s but impersonated %s", tt.role, user)
+			}
+		})
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
 	kubeutils "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/utils"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
@@ -16,9 +18,8 @@ import (
 
 type StreamAction struct {
 	requestId           string
-	serviceAccountToken string
-	kubeHost            string
-	impersonateGroup    string
+	kubeConfig          *kubeutils.KubeConfig
+	impersonateGroups   []string
 	role                string
 	streamOutputChannel chan smsg.StreamMessage
 	closed              bool
@@ -35,11 +36,10 @@ const (
 	StreamStop  StreamSubAction = "kube/stream/stop"
 )
 
-func NewStreamAction(ctx context.Context, logger *lggr.Logger, serviceAccountToken string, kubeHost string, impersonateGroup string, role string, ch chan smsg.StreamMessage) (*StreamAction, error) {
+func NewStreamAction(ctx context.Context, logger *lggr.Logger, kubeConfig *kubeutils.KubeConfig, impersonateGroups []string, role string, ch chan smsg.StreamMessage) (*StreamAction, error) {
 	return &StreamAction{
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
-		impersonateGroup:    impersonateGroup,
+		kubeConfig:          kubeConfig,
+		impersonateGroups:   impersonateGroups,
 		role:                role,
 		streamOutputChannel: ch,
 		doneChannel:         make(chan bool),
@@ -100,12 +100,14 @@ func (s *StreamAction) validateRequestId(requestId string) error {
 }
 
 func (s *StreamAction) StartStream(streamActionRequest KubeStreamActionPayload, action string) (string, []byte, error) {
+	start := time.Now()
+
 	// Build our request
 	s.logger.Info(fmt.Sprintf("Making request for %s", streamActionRequest.Endpoint))
 	req := s.buildHttpRequest(streamActionRequest.Endpoint, streamActionRequest.Body, streamActionRequest.Method, streamActionRequest.Headers)
 
 	// Make the request and wait for the body to close
-	httpClient := &http.Client{}
+	httpClient := s.kubeConfig.HttpClient()
 	res, err := httpClient.Do(req)
 	if err != nil {
 		rerr := fmt.Errorf("bad response to API request: %s", err)
@@ -140,7 +142,10 @@ func (s *StreamAction) StartStream(streamActionRequest KubeStreamActionPayload,
 
 	sequenceNumber := 1
 
+	// The request isn't done until we've streamed its whole response
 	go func() {
+		defer metrics.ObserveKubeRequest("stream", start)
+
 		for {
 			select {
 			case <-s.ctx.Done():
@@ -193,5 +198,5 @@ func (s *StreamAction) StartStream(streamActionRequest KubeStreamActionPayload,
 }
 
 func (s *StreamAction) buildHttpRequest(endpoint, body, method string, headers map[string][]string) *http.Request {
-	return kubeutils.BuildHttpRequest(s.kubeHost, endpoint, body, method, headers, s.serviceAccountToken, s.role, s.impersonateGroup)
+	return kubeutils.BuildHttpRequest(s.kubeConfig.Host(), endpoint, body, method, headers, s.kubeConfig.ServiceAccountToken(), s.role, s.impersonateGroups)
 }
@@ -0,0 +1,116 @@
+package fakeapiserver
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
+)
+
+const (
+	// How long we give clients to open all the streams they asked for
+	streamCreationTimeout = 10 * time.Second
+
+	// The query params kubectl uses to ask for each stream, these aren't the same as corev1's Exec*Param constants
+	stdinParam  = "stdin"
+	stdoutParam = "stdout"
+	stderrParam = "stderr"
+	ttyParam    = "tty"
+)
+
+func echoExecHandler(command []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	_, err := io.Copy(stdout, stdin)
+	return err
+}
+
+// Upgrades the request to SPDY, waits for the client to open its streams and runs our exec handler against them
+func (f *FakeApiServer) serveExec(w http.ResponseWriter, r *http.Request) {
+	if _, err := httpstream.Handshake(r, w, []string{remotecommandconsts.StreamProtocolV4Name}); err != nil {
+		return
+	}
+
+	streamChannel := make(chan httpstream.Stream, 5)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streamChannel <- stream
+		return nil
+	})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	// The client only opens the streams it asked for in its query, plus one for errors
+	query := r.URL.Query()
+	tty := isSet(query.Get(ttyParam))
+	expected := 1
+	for _, param := range []string{stdinParam, stdoutParam, stderrParam} {
+		// A tty combines stderr with stdout
+		if isSet(query.Get(param)) && !(param == stderrParam && tty) {
+			expected++
+		}
+	}
+	if tty {
+		expected++
+	}
+
+	streams := map[string]httpstream.Stream{}
+	timeout := time.After(streamCreationTimeout)
+	for len(streams) < expected {
+		select {
+		case stream := <-streamChannel:
+			streams[stream.Headers().Get(corev1.StreamType)] = stream
+		case <-timeout:
+			return
+		case <-f.closed:
+			return
+		}
+	}
+
+	// We don't do anything with resizes, but we still have to read them so the client isn't blocked
+	if resize, ok := streams[corev1.StreamTypeResize]; ok {
+		go io.Copy(ioutil.Discard, resize)
+	}
+
+	var stdin io.Reader = eofReader{}
+	if stream, ok := streams[corev1.StreamTypeStdin]; ok {
+		stdin = stream
+	}
+	var stdout io.Writer = ioutil.Discard
+	if stream, ok := streams[corev1.StreamTypeStdout]; ok {
+		stdout = stream
+	}
+	stderr := stdout
+	if stream, ok := streams[corev1.StreamTypeStderr]; ok {
+		stderr = stream
+	}
+
+	status := metav1.Status{Status: metav1.StatusSuccess}
+	if err := f.ExecHandler(query[corev1.ExecCommandParam], stdin, stdout, stderr); err != nil {
+		status = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+	}
+
+	statusBytes, _ := json.Marshal(status)
+	if errorStream, ok := streams[corev1.StreamTypeError]; ok {
+		errorStream.Write(statusBytes)
+	}
+	for _, stream := range streams {
+		stream.Close()
+	}
+}
+
+func isSet(value string) bool {
+	return value == "true" || value == "1"
+}
+
+type eofReader struct{}
+
+func (eofReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
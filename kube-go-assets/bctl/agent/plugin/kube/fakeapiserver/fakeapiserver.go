@@ -0,0 +1,269 @@
+/*
+This package is a stand-in for the kube api server so our kube plugin's actions can be exercised without a
+cluster. It serves canned REST responses, holds watch requests open and streams events to them in chunks, and
+speaks enough of the SPDY remote command protocol to run execs against a handler of our choosing. Every request
+is recorded, and it can reject requests that aren't impersonating the user and groups we expect, the same way
+RBAC would reject requests made as our own service account or as anyone it doesn't bind.
+*/
+package fakeapiserver
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	kubeutils "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// Our service account token unless someone asks for something else
+	defaultServiceAccountToken = "fake-service-account-token"
+)
+
+// A request one of our clients made, along with everything we need to check how it was made
+type RecordedRequest struct {
+	Method   string
+	Path     string
+	RawQuery string
+	Header   http.Header
+	Body     []byte
+}
+
+// Runs a command for an exec request. Whatever it returns is sent back to the client as the command's result
+type ExecHandler func(command []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+
+type FakeApiServer struct {
+	// If set, any request without impersonation headers is forbidden
+	RequireImpersonation bool
+
+	// If set, any request that isn't impersonating exactly this user, or exactly these groups, is forbidden
+	ImpersonateUser   string
+	ImpersonateGroups []string
+
+	// What we run for exec requests, by default we echo stdin back on stdout
+	ExecHandler ExecHandler
+
+	serviceAccountToken string
+	server              *httptest.Server
+
+	lock      sync.Mutex
+	responses map[string]fakeResponse // by method and path
+	requests  []RecordedRequest
+	watches   map[string][]chan []byte // by path
+
+	// Closed when we're shutting down so we don't hold on to any watches
+	closed chan struct{}
+}
+
+type fakeResponse struct {
+	statusCode int
+	body       []byte
+}
+
+func New() *FakeApiServer {
+	return NewWithToken(defaultServiceAccountToken)
+}
+
+// Same as above, but only accepts the given service account token
+func NewWithToken(serviceAccountToken string) *FakeApiServer {
+	f := &FakeApiServer{
+		ExecHandler:         echoExecHandler,
+		serviceAccountToken: serviceAccountToken,
+		responses:           make(map[string]fakeResponse),
+		watches:             make(map[string][]chan []byte),
+		closed:              make(chan struct{}),
+	}
+	f.server = httptest.NewTLSServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *FakeApiServer) Close() {
+	close(f.closed)
+	f.server.Close()
+}
+
+// Returns a config our kube plugin can use to talk to us, which only trusts our certificate
+func (f *FakeApiServer) KubeConfig() (*kubeutils.KubeConfig, error) {
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.server.Certificate().Raw})
+
+	return kubeutils.NewKubeConfig(&rest.Config{
+		Host:            f.server.URL,
+		BearerToken:     f.serviceAccountToken,
+		TLSClientConfig: rest.TLSClientConfig{CAData: caData},
+	})
+}
+
+// Every request with this method and path gets the given response
+func (f *FakeApiServer) SetResponse(method string, path string, statusCode int, body []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.responses[method+" "+path] = fakeResponse{statusCode: statusCode, body: body}
+}
+
+// Sends an event to everyone currently watching this path
+func (f *FakeApiServer) SendWatchEvent(path string, event []byte) {
+	f.lock.Lock()
+	watches := append([]chan []byte{}, f.watches[path]...)
+	f.lock.Unlock()
+
+	for _, watch := range watches {
+		select {
+		case <-f.closed:
+		case watch <- event:
+		}
+	}
+}
+
+// Returns how many clients are currently watching this path
+func (f *FakeApiServer) WatchCount(path string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.watches[path])
+}
+
+// Returns every request we've received so far
+func (f *FakeApiServer) Requests() []RecordedRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]RecordedRequest{}, f.requests...)
+}
+
+func (f *FakeApiServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.lock.Lock()
+	f.requests = append(f.requests, RecordedRequest{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+		Header:   r.Header.Clone(),
+		Body:     body,
+	})
+	f.lock.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+f.serviceAccountToken {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if f.RequireImpersonation && (r.Header.Get("Impersonate-User") == "" || r.Header.Get("Impersonate-Group") == "") {
+		writeStatus(w, http.StatusForbidden, "requests must impersonate a user and group")
+		return
+	} else if f.ImpersonateUser != "" && r.Header.Get("Impersonate-User") != f.ImpersonateUser {
+		writeStatus(w, http.StatusForbidden, fmt.Sprintf("cannot impersonate user %q", r.Header.Get("Impersonate-User")))
+		return
+	} else if f.ImpersonateGroups != nil && !sameGroups(r.Header.Values("Impersonate-Group"), f.ImpersonateGroups) {
+		writeStatus(w, http.StatusForbidden, fmt.Sprintf("cannot impersonate groups %q", r.Header.Values("Impersonate-Group")))
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/exec") || strings.HasSuffix(r.URL.Path, "/attach"):
+		f.serveExec(w, r)
+	case query.Get("watch") == "true" || query.Get("watch") == "1" || query.Get("follow") == "true":
+		f.serveWatch(w, r)
+	default:
+		f.serveRest(w, r)
+	}
+}
+
+func (f *FakeApiServer) serveRest(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	response, ok := f.responses[r.Method+" "+r.URL.Path]
+	f.lock.Unlock()
+
+	if !ok {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.statusCode)
+	w.Write(response.body)
+}
+
+// Holds the request open and writes every event we're given for its path as its own chunk
+func (f *FakeApiServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	events := make(chan []byte)
+	f.lock.Lock()
+	f.watches[r.URL.Path] = append(f.watches[r.URL.Path], events)
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		watches := f.watches[r.URL.Path]
+		for i, watch := range watches {
+			if watch == events {
+				f.watches[r.URL.Path] = append(watches[:i], watches[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			w.Write(event)
+			flusher.Flush()
+		}
+	}
+}
+
+// The order groups are impersonated in doesn't matter to RBAC, but every one of them does
+func sameGroups(groups []string, expected []string) bool {
+	if len(groups) != len(expected) {
+		return false
+	}
+
+	sortedGroups := append([]string{}, groups...)
+	sortedExpected := append([]string{}, expected...)
+	sort.Strings(sortedGroups)
+	sort.Strings(sortedExpected)
+	for i := range sortedGroups {
+		if sortedGroups[i] != sortedExpected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeStatus(w http.ResponseWriter, statusCode int, message string) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Code:     int32(statusCode),
+	}
+	statusBytes, _ := json.Marshal(status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(statusBytes)
+}
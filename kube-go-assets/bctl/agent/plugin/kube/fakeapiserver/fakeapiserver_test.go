@@ -0,0 +1,136 @@
+package fakeapiserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	podsPath = "/api/v1/namespaces/default/pods"
+)
+
+func doRequest(t *testing.T, f *FakeApiServer, method string, path string, header http.Header) *http.Response {
+	kubeConfig, err := f.KubeConfig()
+	if err != nil {
+		t.Fatalf("could not build kube config: %s", err)
+	}
+
+	request, _ := http.NewRequest(method, kubeConfig.Host()+path, nil)
+	for name, values := range header {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+
+	response, err := kubeConfig.HttpClient().Do(request)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func TestImpersonation(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         http.Header
+		expectedStatus int
+	}{
+		{
+			name:           "NoToken",
+			header:         http.Header{"Impersonate-User": {"alice"}, "Impersonate-Group": {"devs"}},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "AsServiceAccount",
+			header:         http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "WrongUser",
+			header:         http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}, "Impersonate-User": {"mallory"}, "Impersonate-Group": {"devs", "ops"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "MissingGroup",
+			header:         http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}, "Impersonate-User": {"alice"}, "Impersonate-Group": {"devs"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "ExtraGroup",
+			header:         http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}, "Impersonate-User": {"alice"}, "Impersonate-Group": {"devs", "ops", "system:masters"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "ExpectedUserAndGroupsInAnyOrder",
+			header:         http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}, "Impersonate-User": {"alice"}, "Impersonate-Group": {"ops", "devs"}},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New()
+			defer f.Close()
+			f.RequireImpersonation = true
+			f.ImpersonateUser = "alice"
+			f.ImpersonateGroups = []string{"devs", "ops"}
+			f.SetResponse(http.MethodGet, podsPath, http.StatusOK, []byte(`{"kind":"PodList"}`))
+
+			response := doRequest(t, f, http.MethodGet, podsPath, tt.header)
+			if response.StatusCode != tt.expectedStatus {
+				body, _ := ioutil.ReadAll(response.Body)
+				t.Errorf("expected status %d but got %d: %s", tt.expectedStatus, response.StatusCode, body)
+			}
+
+			// Even requests we turn away get recorded
+			if requests := f.Requests(); len(requests) != 1 {
+				t.Errorf("expected 1 recorded request but got %d", len(requests))
+			}
+		})
+	}
+}
+
+func TestUnknownPathIsNotFound(t *testing.T) {
+	f := New()
+	defer f.Close()
+
+	response := doRequest(t, f, http.MethodGet, podsPath, http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}})
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d but got %d", http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func TestWatchStreamsEvents(t *testing.T) {
+	f := New()
+	defer f.Close()
+
+	response := doRequest(t, f, http.MethodGet, podsPath+"?watch=true", http.Header{"Authorization": {"Bearer " + defaultServiceAccountToken}})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, response.StatusCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.WatchCount(podsPath) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("watch was never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		event := fmt.Sprintf(`{"type":"ADDED","object":{"kind":"Pod","metadata":{"name":"pod-%d"}}}`, i)
+		f.SendWatchEvent(podsPath, []byte(event))
+
+		buf := make([]byte, len(event))
+		if _, err := io.ReadFull(response.Body, buf); err != nil {
+			t.Fatalf("could not read watch event: %s", err)
+		} else if string(buf) != event {
+			t.Errorf("expected event %s but got %s", event, buf)
+		}
+	}
+}
@@ -6,29 +6,32 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"sync"
 
 	exec "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/exec"
+	portforward "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/portforward"
 	rest "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/restapi"
 	stream "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/stream"
+	kubeutils "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/utils"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
-
-	kuberest "k8s.io/client-go/rest"
 )
 
-const (
-	impersonateGroup = "system:authenticated"
-)
+// Who we impersonate if Bastion doesn't ask for any groups, every user we impersonate is in this one anyway
+var defaultImpersonateGroups = []string{"system:authenticated"}
 
 type IKubeAction interface {
 	InputMessageHandler(action string, actionPayload []byte) (string, []byte, error)
 	Closed() bool
 }
 
+// Actions that have something to tell the user before we close them
+type IShutdownKubeAction interface {
+	Shutdown(reason string)
+}
+
 type JustRequestId struct {
 	RequestId string `json:"requestId"`
 }
@@ -36,40 +39,49 @@ type JustRequestId struct {
 type KubeAction string
 
 const (
-	Exec    KubeAction = "exec"
-	RestApi KubeAction = "restapi"
-	Stream  KubeAction = "stream"
+	Exec        KubeAction = "exec"
+	RestApi     KubeAction = "restapi"
+	Stream      KubeAction = "stream"
+	PortForward KubeAction = "portforward"
 )
 
 type KubePlugin struct {
 	role                string
+	groups              []string
 	streamOutputChannel chan smsg.StreamMessage
-	serviceAccountToken string
-	kubeHost            string
+	kubeConfig          *kubeutils.KubeConfig
 	actions             map[string]IKubeAction
 	actionsMapLock      sync.Mutex
+	maxActions          int // how many actions we'll keep open at once
 	logger              *lggr.Logger
 	ctx                 context.Context
 }
 
-func NewPlugin(ctx context.Context, logger *lggr.Logger, ch chan smsg.StreamMessage, role string) plgn.IPlugin {
+func NewPlugin(ctx context.Context, logger *lggr.Logger, ch chan smsg.StreamMessage, role string, groups []string, maxActions int) plgn.IPlugin {
 	// First load in our Kube variables
-	config, err := kuberest.InClusterConfig()
+	kubeConfig, err := kubeutils.InClusterKubeConfig()
 	if err != nil {
 		cerr := fmt.Errorf("error getting incluser config: %s", err)
 		logger.Error(cerr)
 		return &KubePlugin{}
 	}
 
-	serviceAccountToken := config.BearerToken
-	kubeHost := "https://" + os.Getenv("KUBERNETES_SERVICE_HOST")
+	return NewPluginWithConfig(ctx, logger, ch, role, groups, maxActions, kubeConfig)
+}
+
+// Same as above, but talks to whichever kube api server our config points at
+func NewPluginWithConfig(ctx context.Context, logger *lggr.Logger, ch chan smsg.StreamMessage, role string, groups []string, maxActions int, kubeConfig *kubeutils.KubeConfig) plgn.IPlugin {
+	if len(groups) == 0 {
+		groups = defaultImpersonateGroups
+	}
 
 	return &KubePlugin{
 		role:                role,
+		groups:              groups,
 		streamOutputChannel: ch,
-		serviceAccountToken: serviceAccountToken,
-		kubeHost:            kubeHost,
+		kubeConfig:          kubeConfig,
 		actions:             make(map[string]IKubeAction),
+		maxActions:          maxActions,
 		logger:              logger,
 		ctx:                 ctx,
 	}
@@ -132,13 +144,13 @@ func (k *KubePlugin) InputMessageHandler(action string, actionPayload []byte) (s
 
 		switch KubeAction(kubeAction) {
 		case RestApi:
-			a, err = rest.NewRestApiAction(subLogger, k.serviceAccountToken, k.kubeHost, impersonateGroup, k.role)
+			a, err = rest.NewRestApiAction(subLogger, k.kubeConfig, k.groups, k.role)
 		case Exec:
-			a, err = exec.NewExecAction(k.ctx, subLogger, k.serviceAccountToken, k.kubeHost, impersonateGroup, k.role, k.streamOutputChannel)
-			k.updateActionsMap(a, rid) // save action for later input
+			a, err = exec.NewExecAction(k.ctx, subLogger, k.kubeConfig, k.groups, k.role, k.streamOutputChannel)
 		case Stream:
-			a, err = stream.NewStreamAction(k.ctx, subLogger, k.serviceAccountToken, k.kubeHost, impersonateGroup, k.role, k.streamOutputChannel)
-			k.updateActionsMap(a, rid) // save action for later input
+			a, err = stream.NewStreamAction(k.ctx, subLogger, k.kubeConfig, k.groups, k.role, k.streamOutputChannel)
+		case PortForward:
+			a, err = portforward.NewPortForwardAction(k.ctx, subLogger, k.kubeConfig, k.groups, k.role, k.streamOutputChannel)
 		default:
 			msg := fmt.Sprintf("unhandled kubeAction: %s", kubeAction)
 			err = errors.New(msg)
@@ -149,19 +161,76 @@ func (k *KubePlugin) InputMessageHandler(action string, actionPayload []byte) (s
 			return "", []byte{}, rerr
 		}
 
+		// Only the actions we keep track of stay open after they've responded, so they're the ones we limit.
+		// Nothing's started until the action gets its first message, so we save it for later input first
+		if KubeAction(kubeAction) != RestApi {
+			if err := k.trackAction(a, rid); err != nil {
+				return "", []byte{}, &plgn.RequestError{RequestId: rid, Err: err}
+			}
+		}
+
 		// Send the payload to the action and add it to the map for future incoming requests
 		action, payload, err := a.InputMessageHandler(action, actionPayloadSafe)
 		return action, payload, err
 	}
 }
 
-// Helper function so we avoid writing to this map at the same time
-func (k *KubePlugin) updateActionsMap(newAction IKubeAction, id string) {
+// Saves an action for later input, as long as we aren't already handling as many as we're allowed
+func (k *KubePlugin) trackAction(newAction IKubeAction, id string) error {
 	k.actionsMapLock.Lock()
+	defer k.actionsMapLock.Unlock()
+
+	// Actions that finished on their own are only cleaned up when we hear about them again, they shouldn't count
+	for rid, act := range k.actions {
+		if act.Closed() {
+			delete(k.actions, rid)
+		}
+	}
+
+	if len(k.actions) >= k.maxActions {
+		rerr := fmt.Errorf("%w: already handling the maximum of %d kube requests", plgn.ErrTooManyActions, k.maxActions)
+		k.logger.Error(rerr)
+		return rerr
+	}
 	k.actions[id] = newAction
+	return nil
+}
+
+// Returns the request ids of every action we're still handling
+func (k *KubePlugin) RequestIds() []string {
+	k.actionsMapLock.Lock()
+	defer k.actionsMapLock.Unlock()
+
+	ids := []string{}
+	for id := range k.actions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Gives every open action a chance to say goodbye before our datachannel closes
+func (k *KubePlugin) Shutdown(reason string) {
+	k.actionsMapLock.Lock()
+	actions := make([]IKubeAction, 0, len(k.actions))
+	for _, act := range k.actions {
+		actions = append(actions, act)
+	}
 	k.actionsMapLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, act := range actions {
+		if s, ok := act.(IShutdownKubeAction); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Shutdown(reason)
+			}()
+		}
+	}
+	wg.Wait()
 }
 
+// Helper functions so we avoid writing to this map at the same time
 func (k *KubePlugin) deleteActionsMap(rid string) {
 	k.actionsMapLock.Lock()
 	delete(k.actions, rid)
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"bastionzero.com/bctl/v1/bctl/agent/metrics"
+
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// If set, we trust this CA bundle for the api server instead of our service account's
+	caFileEnvVar = "KUBERNETES_CA_FILE"
+
+	// Connection pool settings for our plain http requests
+	maxIdleConnsPerHost = 25
+	idleConnTimeout     = 90 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// Every datachannel shares one transport so they share one pool of connections to the api server
+	inClusterTransport     http.RoundTripper
+	inClusterTransportLock sync.Mutex
+)
+
+// Everything our actions need to reach the kube api server. In a cluster this comes from our service account,
+// but it can point anywhere, like a fake api server when testing
+type KubeConfig struct {
+	// Host, credentials and TLS settings for every request we make
+	RestConfig *rest.Config
+
+	// What we use for our plain http requests, it has to verify the api server the same way our RestConfig does
+	Transport http.RoundTripper
+}
+
+func NewKubeConfig(config *rest.Config) (*KubeConfig, error) {
+	transport, err := NewTransport(config)
+	if err != nil {
+		return &KubeConfig{}, err
+	}
+
+	return &KubeConfig{
+		RestConfig: config,
+		Transport:  transport,
+	}, nil
+}
+
+func InClusterKubeConfig() (*KubeConfig, error) {
+	// We load this every time since our service account token can be rotated
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return &KubeConfig{}, err
+	}
+
+	// We've always reached the api server on the default https port
+	config.Host = "https://" + os.Getenv("KUBERNETES_SERVICE_HOST")
+
+	if caFile := os.Getenv(caFileEnvVar); caFile != "" {
+		config.TLSClientConfig.CAFile = caFile
+		config.TLSClientConfig.CAData = nil
+	}
+
+	inClusterTransportLock.Lock()
+	defer inClusterTransportLock.Unlock()
+
+	if inClusterTransport == nil {
+		if inClusterTransport, err = NewTransport(config); err != nil {
+			return &KubeConfig{}, err
+		}
+	}
+
+	return &KubeConfig{
+		RestConfig: config,
+		Transport:  inClusterTransport,
+	}, nil
+}
+
+// Builds a pooling transport that only trusts the CA our config does
+func NewTransport(config *rest.Config) (http.RoundTripper, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("error building TLS config for the kube api server: %s", err)
+	}
+
+	// Everything that goes through here is on a user's behalf, so we count how the api server answers them
+	return metrics.InstrumentKubeApi(&http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}), nil
+}
+
+func (k *KubeConfig) Host() string {
+	return k.RestConfig.Host
+}
+
+func (k *KubeConfig) ServiceAccountToken() string {
+	return k.RestConfig.BearerToken
+}
+
+func (k *KubeConfig) HttpClient() *http.Client {
+	return &http.Client{Transport: k.Transport}
+}
+
+// Returns a copy of our config that makes every request as the given user and groups, for our SPDY based actions
+func (k *KubeConfig) ImpersonatingRestConfig(impersonateUser string, impersonateGroups []string) *rest.Config {
+	config := rest.CopyConfig(k.RestConfig)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: impersonateUser,
+		Groups:   append([]string{}, impersonateGroups...),
+	}
+	return config
+}
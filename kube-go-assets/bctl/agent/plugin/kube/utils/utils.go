@@ -2,9 +2,9 @@ package utils
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 func ValidateRequestId(requestIdPassed string, requestIdSaved string) error {
@@ -15,14 +15,18 @@ func ValidateRequestId(requestIdPassed string, requestIdSaved string) error {
 	return nil
 }
 
-func BuildHttpRequest(kubeHost string, endpoint string, body string, method string, headers map[string][]string, serviceAccountToken string, impersonateUser string, impersonateGroup string) *http.Request {
+func BuildHttpRequest(kubeHost string, endpoint string, body string, method string, headers map[string][]string, serviceAccountToken string, impersonateUser string, impersonateGroups []string) *http.Request {
 	// Perform the api request
 	kubeApiUrl := kubeHost + endpoint
 	bodyBytesReader := bytes.NewReader([]byte(body))
 	req, _ := http.NewRequest(method, kubeApiUrl, bodyBytesReader)
 
-	// Add any headers
+	// Add any headers, except for impersonation which is only ever up to us
 	for name, values := range headers {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Impersonate-") {
+			continue
+		}
+
 		// Loop over all values for the name.
 		for _, value := range values {
 			req.Header.Set(name, value)
@@ -32,11 +36,9 @@ func BuildHttpRequest(kubeHost string, endpoint string, body string, method stri
 	// Add our impersonation and token headers
 	req.Header.Set("Authorization", "Bearer "+serviceAccountToken)
 	req.Header.Set("Impersonate-User", impersonateUser)
-	req.Header.Set("Impersonate-Group", impersonateGroup)
-
-	// TODO: Figure out a way around this
-	// CA certs can be found here /var/run/secrets/kubernetes.io/serviceaccount/ca.crt
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	for _, group := range impersonateGroups {
+		req.Header.Add("Impersonate-Group", group)
+	}
 
 	return req
 }
@@ -0,0 +1,348 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+	"bastionzero.com/bctl/v1/bzerolib/stream/stdreader"
+	"bastionzero.com/bctl/v1/bzerolib/stream/stdwriter"
+)
+
+const (
+	// We use the first of these that exists on the host
+	preferredShell = "/bin/bash"
+	fallbackShell  = "/bin/sh"
+
+	defaultTerminalId = "xterm-256color"
+)
+
+// Runs interactive shells on the agent's host inside a PTY
+type ShellPlugin struct {
+	streamOutputChannel chan smsg.StreamMessage
+	logger              *lggr.Logger
+	ctx                 context.Context
+
+	// The local user every shell runs as, we won't open shells as whoever the agent is running as
+	runAsUser string
+
+	shells     map[string]*shellProcess
+	shellsLock sync.Mutex
+
+	// How many shells we'll run at once, and how many we've agreed to run including ones that are still starting
+	maxShells  int
+	openShells int
+}
+
+type shellProcess struct {
+	cmd          *exec.Cmd
+	ptmx         *os.File
+	stdinChannel chan []byte
+	stdin        *stdreader.StdReader
+	stdout       *stdwriter.StdWriter
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func NewPlugin(ctx context.Context, logger *lggr.Logger, ch chan smsg.StreamMessage, runAsUser string, maxShells int) plgn.IPlugin {
+	return &ShellPlugin{
+		streamOutputChannel: ch,
+		logger:              logger,
+		ctx:                 ctx,
+		runAsUser:           runAsUser,
+		shells:              make(map[string]*shellProcess),
+		maxShells:           maxShells,
+	}
+}
+
+func (s *ShellPlugin) GetName() plgn.PluginName {
+	return plgn.Shell
+}
+
+func (s *ShellPlugin) PushStreamInput(smessage smsg.StreamMessage) error {
+	return fmt.Errorf("")
+}
+
+func (s *ShellPlugin) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	msg := fmt.Sprintf("Plugin received Data message with %v action", action)
+	s.logger.Info(msg)
+
+	// Our daemon marshals its action payloads a second time, so strip the quotes and decode them
+	if len(actionPayload) > 0 {
+		actionPayload = actionPayload[1 : len(actionPayload)-1]
+	}
+	actionPayloadSafe, _ := base64.StdEncoding.DecodeString(string(actionPayload))
+
+	switch ShellSubAction(action) {
+	case OpenShell:
+		var openRequest ShellOpenActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &openRequest); err != nil {
+			rerr := fmt.Errorf("malformed shell open payload %v", actionPayloadSafe)
+			s.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := s.reserve(); err != nil {
+			s.logger.Error(err)
+			return "", []byte{}, &plgn.RequestError{RequestId: openRequest.RequestId, Err: err}
+		}
+
+		s.open(openRequest)
+		return string(OpenShell), []byte{}, nil
+
+	case ShellInput:
+		var inputRequest ShellInputActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &inputRequest); err != nil {
+			rerr := fmt.Errorf("malformed shell input payload %v", actionPayloadSafe)
+			s.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if shell, ok := s.getShell(inputRequest.RequestId); !ok {
+			s.logger.Info(fmt.Sprintf("Dropping input for closed shell %s", inputRequest.RequestId))
+		} else {
+			select {
+			case <-s.ctx.Done():
+			case <-shell.done:
+			case shell.stdinChannel <- inputRequest.Stdin:
+			}
+		}
+		return string(ShellInput), []byte{}, nil
+
+	case ShellResize:
+		var resizeRequest ShellResizeActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &resizeRequest); err != nil {
+			rerr := fmt.Errorf("malformed shell resize payload %v", actionPayloadSafe)
+			s.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if shell, ok := s.getShell(resizeRequest.RequestId); ok {
+			if err := pty.Setsize(shell.ptmx, &pty.Winsize{Cols: resizeRequest.Width, Rows: resizeRequest.Height}); err != nil {
+				s.logger.Error(fmt.Errorf("error resizing shell: %s", err))
+			}
+		}
+		return string(ShellResize), []byte{}, nil
+
+	case CloseShell:
+		var closeRequest ShellCloseActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &closeRequest); err != nil {
+			rerr := fmt.Errorf("malformed shell close payload %v", actionPayloadSafe)
+			s.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if shell, ok := s.getShell(closeRequest.RequestId); ok {
+			shell.close()
+		}
+		return string(CloseShell), []byte{}, nil
+
+	default:
+		rerr := fmt.Errorf("unhandled shell action: %v", action)
+		s.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+}
+
+func (s *ShellPlugin) open(openRequest ShellOpenActionPayload) {
+	if _, ok := s.getShell(openRequest.RequestId); ok {
+		s.release()
+		s.logger.Error(fmt.Errorf("shell %s is already open", openRequest.RequestId))
+		return
+	}
+
+	// The PTY combines stdout and stderr for us
+	stdout := stdwriter.NewStdWriter(smsg.ShellStdOut, s.streamOutputChannel, openRequest.RequestId, openRequest.LogId)
+
+	// A shell that fails to start only affects this one user, so we let them know in their terminal instead of
+	// failing the keysplitting message
+	cmd, err := s.buildCommand(openRequest)
+	if err == nil {
+		var ptmx *os.File
+		if ptmx, err = pty.StartWithSize(cmd, &pty.Winsize{Cols: openRequest.Width, Rows: openRequest.Height}); err == nil {
+			s.start(openRequest, cmd, ptmx, stdout)
+			return
+		}
+		err = fmt.Errorf("error starting shell: %s", err)
+	}
+
+	s.release()
+	s.logger.Error(err)
+	stdout.Write([]byte(err.Error() + "\r\n"))
+	s.sendQuit(stdout, 1)
+}
+
+func (s *ShellPlugin) start(openRequest ShellOpenActionPayload, cmd *exec.Cmd, ptmx *os.File, stdout *stdwriter.StdWriter) {
+	s.logger.Info(fmt.Sprintf("Started shell %s with pid %d", openRequest.RequestId, cmd.Process.Pid))
+
+	stdinChannel := make(chan []byte, 10)
+	shell := &shellProcess{
+		cmd:          cmd,
+		ptmx:         ptmx,
+		stdinChannel: stdinChannel,
+		stdin:        stdreader.NewStdReader(smsg.ShellStdIn, openRequest.RequestId, stdinChannel),
+		stdout:       stdout,
+		done:         make(chan struct{}),
+	}
+	s.shellsLock.Lock()
+	s.shells[openRequest.RequestId] = shell
+	s.shellsLock.Unlock()
+
+	// Set up a go function for stdin, closing the shell closes our reader which ends the copy
+	go io.Copy(ptmx, shell.stdin)
+
+	// Set up a go function for stdout
+	go func() {
+		io.Copy(stdout, ptmx)
+
+		err := cmd.Wait()
+		s.logger.Info(fmt.Sprintf("Shell %s exited: %v", openRequest.RequestId, err))
+
+		s.shellsLock.Lock()
+		delete(s.shells, openRequest.RequestId)
+		s.openShells--
+		s.shellsLock.Unlock()
+		shell.close()
+
+		exitCode := 0
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		s.sendQuit(stdout, exitCode)
+	}()
+
+	// Make sure we don't leave shells running once the datachannel goes away
+	go func() {
+		<-s.ctx.Done()
+		shell.close()
+	}()
+}
+
+// Lets everyone with a shell open know why it's about to end, e.g. because the agent is being upgraded
+func (s *ShellPlugin) Shutdown(reason string) {
+	s.shellsLock.Lock()
+	shells := make([]*shellProcess, 0, len(s.shells))
+	for _, shell := range s.shells {
+		shells = append(shells, shell)
+	}
+	s.shellsLock.Unlock()
+
+	for _, shell := range shells {
+		select {
+		case <-shell.done:
+		default:
+			shell.stdout.Write([]byte(fmt.Sprintf("\r\n%s\r\n", reason)))
+		}
+	}
+}
+
+// Holds a spot for a new shell, every successful call has to be matched by a call to release
+func (s *ShellPlugin) reserve() error {
+	s.shellsLock.Lock()
+	defer s.shellsLock.Unlock()
+
+	if s.openShells >= s.maxShells {
+		return fmt.Errorf("%w: already running the maximum of %d shells", plgn.ErrTooManyActions, s.maxShells)
+	}
+	s.openShells++
+	return nil
+}
+
+func (s *ShellPlugin) release() {
+	s.shellsLock.Lock()
+	defer s.shellsLock.Unlock()
+
+	s.openShells--
+}
+
+// Our quit message carries the next sequence number so the daemon only acts on it once it's seen all our output
+func (s *ShellPlugin) sendQuit(stdout *stdwriter.StdWriter, exitCode int) {
+	message := smsg.StreamMessage{
+		Type:           string(smsg.ShellQuit),
+		RequestId:      stdout.RequestId,
+		SequenceNumber: stdout.NextSequenceNumber(),
+		Content:        base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(exitCode))),
+	}
+
+	select {
+	case <-s.ctx.Done():
+	case s.streamOutputChannel <- message:
+	}
+}
+
+func (s *ShellPlugin) buildCommand(openRequest ShellOpenActionPayload) (*exec.Cmd, error) {
+	shellPath := preferredShell
+	if _, err := os.Stat(shellPath); err != nil {
+		shellPath = fallbackShell
+	}
+
+	// Start a login shell so the user gets their usual profile
+	cmd := exec.Command(shellPath, "-l")
+
+	terminalId := openRequest.TerminalId
+	if terminalId == "" {
+		terminalId = defaultTerminalId
+	}
+	cmd.Env = []string{"TERM=" + terminalId, "PATH=" + os.Getenv("PATH")}
+
+	// The agent usually runs as root, which is far more access than we want to hand out by default
+	if s.runAsUser == "" {
+		return cmd, fmt.Errorf("shells are disabled on this agent, set SHELL_RUN_AS_USER to enable them")
+	}
+
+	runAs, err := user.Lookup(s.runAsUser)
+	if err != nil {
+		return cmd, fmt.Errorf("could not find run as user %s: %s", s.runAsUser, err)
+	}
+
+	uid, err := strconv.ParseUint(runAs.Uid, 10, 32)
+	if err != nil {
+		return cmd, fmt.Errorf("invalid uid for run as user %s: %s", s.runAsUser, err)
+	}
+	gid, err := strconv.ParseUint(runAs.Gid, 10, 32)
+	if err != nil {
+		return cmd, fmt.Errorf("invalid gid for run as user %s: %s", s.runAsUser, err)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	cmd.Dir = runAs.HomeDir
+	cmd.Env = append(cmd.Env, "HOME="+runAs.HomeDir, "USER="+runAs.Username, "LOGNAME="+runAs.Username)
+	return cmd, nil
+}
+
+func (s *ShellPlugin) getShell(requestId string) (*shellProcess, bool) {
+	s.shellsLock.Lock()
+	defer s.shellsLock.Unlock()
+
+	shell, ok := s.shells[requestId]
+	return shell, ok
+}
+
+// Kills the shell if it's still running, it's fine to call more than once
+func (p *shellProcess) close() {
+	p.closeOnce.Do(func() {
+		// Killing a process that's already exited just returns an error we don't care about
+		p.cmd.Process.Kill()
+		p.ptmx.Close()
+		p.stdin.Close()
+		close(p.done)
+	})
+}
@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package shell
+
+import (
+	"context"
+	"fmt"
+
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+)
+
+// We need a PTY to run shells, which windows doesn't have
+type ShellPlugin struct {
+	logger *lggr.Logger
+}
+
+func NewPlugin(ctx context.Context, logger *lggr.Logger, ch chan smsg.StreamMessage, runAsUser string, maxShells int) plgn.IPlugin {
+	return &ShellPlugin{
+		logger: logger,
+	}
+}
+
+func (s *ShellPlugin) GetName() plgn.PluginName {
+	return plgn.Shell
+}
+
+func (s *ShellPlugin) PushStreamInput(smessage smsg.StreamMessage) error {
+	return fmt.Errorf("")
+}
+
+func (s *ShellPlugin) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	rerr := fmt.Errorf("shells are not supported on windows")
+	s.logger.Error(rerr)
+	return "", []byte{}, rerr
+}
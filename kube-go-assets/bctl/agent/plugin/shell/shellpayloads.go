@@ -0,0 +1,40 @@
+package shell
+
+type ShellSubAction string
+
+const (
+	OpenShell   ShellSubAction = "shell/open"
+	ShellInput  ShellSubAction = "shell/input"
+	ShellResize ShellSubAction = "shell/resize"
+	CloseShell  ShellSubAction = "shell/close"
+)
+
+// payload for "shell/open"
+type ShellOpenActionPayload struct {
+	RequestId  string `json:"requestId"`
+	LogId      string `json:"logId"`
+	TerminalId string `json:"terminalId"` // the value of TERM on the daemon's end
+	Width      uint16 `json:"width"`
+	Height     uint16 `json:"height"`
+}
+
+// payload for "shell/input"
+type ShellInputActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+	Stdin     []byte `json:"stdin"`
+}
+
+// payload for "shell/resize"
+type ShellResizeActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+	Width     uint16 `json:"width"`
+	Height    uint16 `json:"height"`
+}
+
+// payload for "shell/close"
+type ShellCloseActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+}
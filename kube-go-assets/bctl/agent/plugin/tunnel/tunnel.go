@@ -0,0 +1,276 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+	"bastionzero.com/bctl/v1/bzerolib/stream/stdwriter"
+)
+
+type TunnelSubAction string
+
+const (
+	OpenTunnel   TunnelSubAction = "tunnel/open"
+	DataInTunnel TunnelSubAction = "tunnel/datain"
+	CloseTunnel  TunnelSubAction = "tunnel/close"
+)
+
+const (
+	// How long we'll wait on a target inside the cluster to accept our connection
+	dialTimeout = 10 * time.Second
+)
+
+// Forwards TCP connections from the daemon to the hosts inside the cluster network we're allowed to reach
+type TunnelPlugin struct {
+	streamOutputChannel chan smsg.StreamMessage
+	logger              *lggr.Logger
+	ctx                 context.Context
+
+	// Every "host:port" the daemon is allowed to connect to, a port of "*" allows any port on that host
+	allowedTargets []string
+
+	// Every local connection the daemon accepts is identified by its own request id
+	connections     map[string]*tunnelConnection
+	connectionsLock sync.Mutex
+
+	// How many connections we'll keep open at once, and how many we've agreed to open including ones that
+	// are still connecting
+	maxConnections  int
+	openConnections int
+}
+
+type tunnelConnection struct {
+	conn   net.Conn
+	writer *stdwriter.StdWriter
+
+	// Why we closed the connection, if it wasn't just the target hanging up
+	reason string
+	done   chan struct{}
+}
+
+func NewPlugin(ctx context.Context, logger *lggr.Logger, ch chan smsg.StreamMessage, allowedTargets []string, maxConnections int) plgn.IPlugin {
+	return &TunnelPlugin{
+		streamOutputChannel: ch,
+		logger:              logger,
+		ctx:                 ctx,
+		allowedTargets:      allowedTargets,
+		connections:         make(map[string]*tunnelConnection),
+		maxConnections:      maxConnections,
+	}
+}
+
+func (t *TunnelPlugin) GetName() plgn.PluginName {
+	return plgn.Tunnel
+}
+
+func (t *TunnelPlugin) PushStreamInput(smessage smsg.StreamMessage) error {
+	return fmt.Errorf("")
+}
+
+func (t *TunnelPlugin) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	msg := fmt.Sprintf("Plugin received Data message with %v action", action)
+	t.logger.Info(msg)
+
+	// Our daemon marshals its action payloads a second time, so strip the quotes and decode them
+	if len(actionPayload) > 0 {
+		actionPayload = actionPayload[1 : len(actionPayload)-1]
+	}
+	actionPayloadSafe, _ := base64.StdEncoding.DecodeString(string(actionPayload))
+
+	switch TunnelSubAction(action) {
+	case OpenTunnel:
+		var openRequest TunnelOpenActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &openRequest); err != nil {
+			rerr := fmt.Errorf("malformed tunnel open payload %v", actionPayloadSafe)
+			t.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		if err := t.reserve(); err != nil {
+			t.logger.Error(err)
+			return "", []byte{}, &plgn.RequestError{RequestId: openRequest.RequestId, Err: err}
+		}
+
+		t.open(openRequest)
+		return string(OpenTunnel), []byte{}, nil
+
+	case DataInTunnel:
+		var dataInRequest TunnelDataInActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &dataInRequest); err != nil {
+			rerr := fmt.Errorf("malformed tunnel data in payload %v", actionPayloadSafe)
+			t.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		// The connection might have already been closed from our end, that's not worth breaking the datachannel over
+		if connection, ok := t.getConnection(dataInRequest.RequestId); !ok {
+			t.logger.Info(fmt.Sprintf("Dropping data for closed tunnel connection %s", dataInRequest.RequestId))
+		} else if _, err := connection.conn.Write(dataInRequest.Data); err != nil {
+			t.logger.Error(fmt.Errorf("error writing to tunnel connection: %s", err))
+			t.close(dataInRequest.RequestId, err.Error())
+		}
+		return string(DataInTunnel), []byte{}, nil
+
+	case CloseTunnel:
+		var closeRequest TunnelCloseActionPayload
+		if err := json.Unmarshal(actionPayloadSafe, &closeRequest); err != nil {
+			rerr := fmt.Errorf("malformed tunnel close payload %v", actionPayloadSafe)
+			t.logger.Error(rerr)
+			return "", []byte{}, rerr
+		}
+
+		// The daemon is done sending, but the target might still have something to say
+		if connection, ok := t.getConnection(closeRequest.RequestId); ok {
+			if tcpConn, ok := connection.conn.(*net.TCPConn); ok {
+				tcpConn.CloseWrite()
+			} else {
+				t.close(closeRequest.RequestId, "")
+			}
+		}
+		return string(CloseTunnel), []byte{}, nil
+
+	default:
+		rerr := fmt.Errorf("unhandled tunnel action: %v", action)
+		t.logger.Error(rerr)
+		return "", []byte{}, rerr
+	}
+}
+
+func (t *TunnelPlugin) open(openRequest TunnelOpenActionPayload) {
+	writer := stdwriter.NewStdWriter(smsg.TunnelData, t.streamOutputChannel, openRequest.RequestId, openRequest.LogId)
+	target := net.JoinHostPort(openRequest.Host, strconv.Itoa(openRequest.Port))
+
+	// A failed connection only affects this one tunnel, so we let the daemon know over its stream instead of
+	// failing the keysplitting message
+	if !t.isAllowed(openRequest.Host, openRequest.Port) {
+		t.release()
+		t.logger.Error(fmt.Errorf("tunnel target %s is not allowed", target))
+		t.sendClose(writer, fmt.Sprintf("tunnel target %s is not allowed", target))
+		return
+	}
+
+	t.logger.Info(fmt.Sprintf("Opening tunnel connection %s to %s", openRequest.RequestId, target))
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(t.ctx, "tcp", target)
+	if err != nil {
+		t.release()
+		t.logger.Error(fmt.Errorf("error connecting to tunnel target: %s", err))
+		t.sendClose(writer, fmt.Sprintf("could not connect to %s: %s", target, err))
+		return
+	}
+
+	connection := &tunnelConnection{
+		conn:   conn,
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+	t.connectionsLock.Lock()
+	t.connections[openRequest.RequestId] = connection
+	t.connectionsLock.Unlock()
+
+	// Pass along everything the target sends us until either side hangs up
+	go func() {
+		defer close(connection.done)
+
+		_, err := io.Copy(writer, conn)
+		if err != nil && t.ctx.Err() == nil {
+			t.logger.Info(fmt.Sprintf("Tunnel connection %s closed: %s", openRequest.RequestId, err))
+		}
+
+		t.connectionsLock.Lock()
+		delete(t.connections, openRequest.RequestId)
+		t.openConnections--
+		reason := connection.reason
+		t.connectionsLock.Unlock()
+
+		conn.Close()
+		t.sendClose(writer, reason)
+	}()
+
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			t.close(openRequest.RequestId, "")
+		case <-connection.done:
+		}
+	}()
+}
+
+// Holds a spot for a new connection, every successful call has to be matched by a call to release
+func (t *TunnelPlugin) reserve() error {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+
+	if t.openConnections >= t.maxConnections {
+		return fmt.Errorf("%w: tunnel already has the maximum of %d connections open", plgn.ErrTooManyActions, t.maxConnections)
+	}
+	t.openConnections++
+	return nil
+}
+
+func (t *TunnelPlugin) release() {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+
+	t.openConnections--
+}
+
+// Closes our connection to the target, which lets the daemon know once we've sent everything we read from it
+func (t *TunnelPlugin) close(requestId string, reason string) {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+
+	if connection, ok := t.connections[requestId]; ok {
+		if connection.reason == "" {
+			connection.reason = reason
+		}
+		connection.conn.Close()
+	}
+}
+
+// Our close message carries the next sequence number so the daemon only acts on it once it's seen all our data
+func (t *TunnelPlugin) sendClose(writer *stdwriter.StdWriter, reason string) {
+	message := smsg.StreamMessage{
+		Type:           string(smsg.TunnelClose),
+		RequestId:      writer.RequestId,
+		SequenceNumber: writer.SequenceNumber,
+		Content:        base64.StdEncoding.EncodeToString([]byte(reason)),
+	}
+
+	select {
+	case <-t.ctx.Done():
+	case t.streamOutputChannel <- message:
+	}
+}
+
+func (t *TunnelPlugin) getConnection(requestId string) (*tunnelConnection, bool) {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+
+	connection, ok := t.connections[requestId]
+	return connection, ok
+}
+
+func (t *TunnelPlugin) isAllowed(host string, port int) bool {
+	for _, allowed := range t.allowedTargets {
+		allowedHost, allowedPort, err := net.SplitHostPort(allowed)
+		if err != nil || allowedHost != host {
+			continue
+		}
+
+		if allowedPort == "*" || allowedPort == strconv.Itoa(port) {
+			return true
+		}
+	}
+	return false
+}
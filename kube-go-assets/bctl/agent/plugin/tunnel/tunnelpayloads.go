@@ -0,0 +1,22 @@
+package tunnel
+
+// tunnel/open payload
+type TunnelOpenActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+}
+
+// tunnel/datain payload
+type TunnelDataInActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+	Data      []byte `json:"data"`
+}
+
+// tunnel/close payload
+type TunnelCloseActionPayload struct {
+	RequestId string `json:"requestId"`
+	LogId     string `json:"logId"`
+}
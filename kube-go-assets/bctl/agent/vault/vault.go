@@ -34,6 +34,11 @@ type SecretData struct {
 	Namespace     string
 	IdpProvider   string
 	IdpOrgId      string
+
+	// Only needed for identity providers besides Google and Microsoft
+	IdpIssuerUrl string
+	IdpOrgClaim  string
+	IdpAudiences string // comma separated
 }
 
 func LoadVault() (*Vault, error) {
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	dc "bastionzero.com/bctl/v1/bctl/daemon/datachannel"
 	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 )
 
@@ -15,13 +20,29 @@ import (
 var (
 	sessionId, authHeader, assumeRole, assumeClusterId, serviceUrl           string
 	daemonPort, localhostToken, environmentId, certPath, keyPath, configPath string
-	logPath                                                                  string
+	logPath, targetId                                                        string
+
+	// Tunnel plugin variables, if a tunnel target is given we start it instead of the kube plugin
+	tunnelTargetHost string
+	tunnelTargetPort int
+
+	// If set, we connect the terminal we're running in to a shell on the agent's host instead
+	shell bool
+
+	// How we reach Bastion if we're behind an egress proxy
+	bastionTransport ws.TransportConfig
+
+	// How quickly we notice our connection to Bastion has died, e.g. after a laptop wakes up
+	bastionHeartbeat ws.HeartbeatConfig
 )
 
 const (
 	hubEndpoint   = "/api/v1/hub/kube"
 	autoReconnect = true
 	version       = "1.0.0" // TODO: Change this?
+
+	// How long we wait to say goodbye to Bastion before exiting anyway
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -30,20 +51,48 @@ func main() {
 	// Setup our loggers
 	// TODO: Pass in debug level as flag
 	// TODO: Pass in stdout output as flag?
-	logger, err := lggr.NewLogger(lggr.Debug, getLogFilePath())
+	newLogger := lggr.NewLogger
+	if shell {
+		// Our shell owns stdout, anything else we print there would end up in the middle of it
+		newLogger = lggr.NewFileLogger
+	}
+	logger, err := newLogger(lggr.Debug, getLogFilePath())
 	if err != nil {
 		os.Exit(1)
 	}
 	logger.AddDaemonVersion(version)
+
+	if err := ws.ConfigureTransport(bastionTransport); err != nil {
+		logger.Error(err)
+		fmt.Fprintf(os.Stderr, "Could not connect to Bastion: %s\n", err)
+		os.Exit(1)
+	} else if err := ws.ConfigureHeartbeat(bastionHeartbeat); err != nil {
+		logger.Error(err)
+		fmt.Fprintf(os.Stderr, "Could not connect to Bastion: %s\n", err)
+		os.Exit(1)
+	}
 	dcLogger := logger.GetDatachannelLogger()
 
-	logger.Info(fmt.Sprintf("Opening websocket to Bastion: %s", serviceUrl))
-	startDatachannel(dcLogger)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	select {} // sleep forever?
+	logger.Info(fmt.Sprintf("Opening websocket to Bastion: %s", serviceUrl))
+	dataChannel := startDatachannel(ctx, dcLogger)
+
+	// Run until we're told to stop
+	<-ctx.Done()
+	logger.Info("Shutting down, closing our connection to Bastion")
+	if dataChannel != nil {
+		select {
+		case <-dataChannel.ShutdownDone():
+		case <-time.After(shutdownTimeout):
+			logger.Error(fmt.Errorf("timed out after %s waiting for our connection to close", shutdownTimeout))
+		}
+	}
+	os.Exit(0)
 }
 
-func startDatachannel(logger *lggr.Logger) {
+func startDatachannel(ctx context.Context, logger *lggr.Logger) *dc.DataChannel {
 	// Create our headers and params
 	headers := make(map[string]string)
 	headers["Authorization"] = authHeader
@@ -55,11 +104,23 @@ func startDatachannel(logger *lggr.Logger) {
 	params["assume_cluster_id"] = assumeClusterId
 	params["environment_id"] = environmentId
 
-	dataChannel, _ := dc.NewDataChannel(logger, configPath, assumeRole, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect)
+	dataChannel, err := dc.NewDataChannel(ctx, logger, configPath, targetId, assumeRole, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect)
+	if err != nil {
+		return nil
+	}
 
-	if err := dataChannel.StartKubeDaemonPlugin(localhostToken, daemonPort, certPath, keyPath); err != nil {
-		return
+	if shell {
+		if err := dataChannel.StartShellDaemonPlugin(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not start shell: %s\n", err)
+			os.Exit(1)
+		}
+	} else if tunnelTargetHost != "" {
+		// Our plugins log their own startup errors, we still have a datachannel to close either way
+		dataChannel.StartTunnelDaemonPlugin(daemonPort, tunnelTargetHost, tunnelTargetPort)
+	} else {
+		dataChannel.StartKubeDaemonPlugin(localhostToken, daemonPort, certPath, keyPath)
 	}
+	return dataChannel
 }
 
 func targetSelectHandler(agentMessage wsmsg.AgentMessage) (string, error) {
@@ -75,10 +136,36 @@ func targetSelectHandler(agentMessage wsmsg.AgentMessage) (string, error) {
 				return "StdinDaemonToBastion", nil
 			case "kube/exec/resize":
 				return "ResizeTerminalDaemonToBastion", nil
+			case "kube/exec/ack":
+				return "AckExecOutputDaemonToBastion", nil
 			case "kube/stream/start":
 				return "RequestHttpStreamDaemonToBastion", nil
 			case "kube/stream/stop":
 				return "StopHttpStreamDaemonToBastion", nil
+			case "kube/portforward/start":
+				return "StartPortForwardDaemonToBastion", nil
+			case "kube/portforward/request/start":
+				return "StartPortForwardRequestDaemonToBastion", nil
+			case "kube/portforward/datain":
+				return "DataInPortForwardDaemonToBastion", nil
+			case "kube/portforward/request/stop":
+				return "StopPortForwardRequestDaemonToBastion", nil
+			case "kube/portforward/stop":
+				return "StopPortForwardDaemonToBastion", nil
+			case "tunnel/open":
+				return "OpenTunnelDaemonToBastion", nil
+			case "tunnel/datain":
+				return "DataInTunnelDaemonToBastion", nil
+			case "tunnel/close":
+				return "CloseTunnelDaemonToBastion", nil
+			case "shell/open":
+				return "OpenShellDaemonToBastion", nil
+			case "shell/input":
+				return "ShellInputDaemonToBastion", nil
+			case "shell/resize":
+				return "ShellResizeDaemonToBastion", nil
+			case "shell/close":
+				return "CloseShellDaemonToBastion", nil
 			}
 		} else {
 			return "", fmt.Errorf("fail on expected payload: %v", payload["keysplittingPayload"])
@@ -104,17 +191,49 @@ func parseFlags() error {
 	flag.StringVar(&keyPath, "keyPath", "", "Path to key to use for our localhost server")
 	flag.StringVar(&configPath, "configPath", "", "Local storage path to zli config")
 	flag.StringVar(&logPath, "logPath", "", "Path to log file for daemon")
+	flag.StringVar(&targetId, "targetId", "", "Public key of the agent we're connecting to, as reported by Bastion. If empty we trust the first agent to answer")
+
+	// Tunnel plugin variables
+	flag.StringVar(&tunnelTargetHost, "tunnelTargetHost", "", "Host inside the cluster network to tunnel local connections to")
+	flag.IntVar(&tunnelTargetPort, "tunnelTargetPort", 0, "Port on the tunnel target host to connect to")
+
+	// Shell plugin variables
+	flag.BoolVar(&shell, "shell", false, "Open a shell on the agent's host in this terminal")
+
+	// Bastion transport variables, HTTPS_PROXY and NO_PROXY are used if no proxy url is given
+	flag.StringVar(&bastionTransport.ProxyUrl, "proxyUrl", "", "Proxy to connect to Bastion through")
+	flag.StringVar(&bastionTransport.CaFile, "caFile", "", "Path to PEM encoded CAs to trust when connecting to Bastion")
+	flag.StringVar(&bastionTransport.ClientCertFile, "clientCertFile", "", "Path to a client certificate to present when connecting to Bastion")
+	flag.StringVar(&bastionTransport.ClientKeyFile, "clientKeyFile", "", "Path to the key for our client certificate")
+
+	// Bastion heartbeat variables, 0 uses our defaults
+	flag.DurationVar(&bastionHeartbeat.Interval, "heartbeatInterval", 0, "How often to ping Bastion")
+	flag.DurationVar(&bastionHeartbeat.Timeout, "heartbeatTimeout", 0, "How long to go without hearing from Bastion before reconnecting")
 
 	flag.Parse()
 
 	// Check we have all required flags
 	if sessionId == "" || authHeader == "" || assumeRole == "" || assumeClusterId == "" || serviceUrl == "" ||
-		daemonPort == "" || localhostToken == "" || environmentId == "" || certPath == "" || keyPath == "" ||
-		logPath == "" || configPath == "" {
+		environmentId == "" || logPath == "" || configPath == "" {
 		return fmt.Errorf("missing flags")
-	} else {
+	}
+
+	// Our shell doesn't listen on anything locally, everyone else needs a port
+	if shell {
 		return nil
+	} else if daemonPort == "" {
+		return fmt.Errorf("missing flags")
+	}
+
+	// Only our kube plugin needs to validate kubectl and serve TLS
+	if tunnelTargetHost != "" {
+		if tunnelTargetPort <= 0 {
+			return fmt.Errorf("missing flags")
+		}
+	} else if localhostToken == "" || certPath == "" || keyPath == "" {
+		return fmt.Errorf("missing flags")
 	}
+	return nil
 }
 
 func getLogFilePath() string {
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
-	ks "bastionzero.com/bctl/v1/bctl/daemon/keysplitting"
 	kube "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube"
+	shell "bastionzero.com/bctl/v1/bctl/daemon/plugin/shell"
+	tunnel "bastionzero.com/bctl/v1/bctl/daemon/plugin/tunnel"
 	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
 	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
 	rrr "bastionzero.com/bctl/v1/bzerolib/error"
@@ -14,26 +17,58 @@ import (
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
 	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+
+	"github.com/google/uuid"
 )
 
 const (
 	maxRetries = 3
+
+	// How many Data messages we ask the agent to let us have in flight at once
+	pipelineWindow = 8
+
+	// How many keysplitting sessions we'll run in parallel, once we have this many new requests share them
+	maxSessions = 8
+
+	// How long we remember which session a request was assigned to without hearing from it. Nothing can
+	// still be in flight by then, so if the request does come back it's safe to put it on any session
+	requestIdleTimeout = 10 * time.Minute
+
+	// How many times in a row we'll try to connect to Bastion before telling the user we've given up
+	maxConnectAttempts = 10
+
+	shutdownReason = "daemon is shutting down"
 )
 
 type IDataChannel interface {
 	Send(messageType wsmsg.MessageType, messagePayload interface{}) error
 	Receive(agentMessage wsmsg.AgentMessage) error
 	StartKubeDaemonPlugin(localhostToken string, daemonPort string, certPath string, keyPath string) error
+	StartTunnelDaemonPlugin(localPort string, targetHost string, targetPort int) error
+	StartShellDaemonPlugin() error
+}
+
+// Our sessions send each request as soon as they're able to, and pass along responses whenever they come back
+type IDaemonPlugin interface {
+	plgn.IPlugin
+	PushActionResponse(action string, actionPayload []byte) error
+	WaitForRequest(ctx context.Context) (string, []byte, error)
+	RejectRequest(requestId string, reason string)
 }
 
 type DataChannel struct {
-	websocket    *ws.Websocket
-	logger       *lggr.Logger
-	ctx          context.Context
-	cancel       context.CancelFunc
-	plugin       plgn.IPlugin
-	keysplitting ks.IKeysplitting
-	handshook    bool // aka whether we need to send a syn
+	websocket  *ws.Websocket
+	logger     *lggr.Logger
+	ctx        context.Context
+	cancel     context.CancelFunc
+	plugin     IDaemonPlugin
+	configPath string
+
+	// The agent's public key, every Syn we send is bound to it so it can't be replayed to another agent
+	targetId string
+
+	// The agent starts whichever plugin our Syn's action is for
+	synAction string
 
 	// Kube-specific vars aka to-be-removed
 	role string
@@ -41,15 +76,29 @@ type DataChannel struct {
 	// Done channel to bubble up messages to kubectl
 	doneChannel chan string
 
-	// If we need to send a SYN, then we need a way to keep
-	// track of whatever message that triggered the send SYN
-	onDeck      plgn.ActionWrapper
-	lastMessage plgn.ActionWrapper
-	retry       int
+	// Closed once we've said goodbye to Bastion after being asked to shut down
+	shutdownDone chan struct{}
+
+	// Every session is its own keysplitting hash chain. We only open more than one once the agent has
+	// shown it knows how to tell them apart, by echoing our session id back in its SynAck
+	sessions        []*session
+	sessionsById    map[string]*session
+	requestSessions map[string]requestSession
+	lastPruned      time.Time
+	nextSession     int
+	multiplexed     bool
+	sessionsLock    sync.Mutex
+}
+
+type requestSession struct {
+	session  *session
+	lastUsed time.Time
 }
 
-func NewDataChannel(logger *lggr.Logger,
+func NewDataChannel(parentCtx context.Context,
+	logger *lggr.Logger,
 	configPath string,
+	targetId string,
 	role string,
 	serviceUrl string,
 	hubEndpoint string,
@@ -58,39 +107,39 @@ func NewDataChannel(logger *lggr.Logger,
 	targetSelectHandler func(msg wsmsg.AgentMessage) (string, error),
 	autoReconnect bool) (*DataChannel, error) {
 
+	// We don't inherit from parentCtx because we still need to talk to Bastion while we shut down
 	ctx, cancel := context.WithCancel(context.Background())
 
 	subLogger := logger.GetWebsocketLogger()
-	wsClient, err := ws.NewWebsocket(ctx, subLogger, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect, false)
+	wsClient, err := ws.NewWebsocket(ctx, subLogger, serviceUrl, hubEndpoint, params, headers, targetSelectHandler, autoReconnect, false, maxConnectAttempts)
 	if err != nil {
 		cancel()
 		logger.Error(err)
 		return &DataChannel{}, err // TODO: how tf are we going to report these?
 	}
 
-	keysplitter, err := ks.NewKeysplitting("", configPath)
-	if err != nil {
-		cancel()
-		logger.Error(err)
-		return &DataChannel{}, err
-	}
-
 	ret := &DataChannel{
-		websocket:    wsClient,
-		logger:       logger,
-		ctx:          ctx,
-		cancel:       cancel,
-		keysplitting: keysplitter,
-		handshook:    false,
-		doneChannel:  make(chan string),
-		onDeck:       plgn.ActionWrapper{},
-		retry:        0,
+		websocket:       wsClient,
+		logger:          logger,
+		ctx:             ctx,
+		cancel:          cancel,
+		configPath:      configPath,
+		targetId:        targetId,
+		role:            role,
+		doneChannel:     make(chan string),
+		shutdownDone:    make(chan struct{}),
+		sessionsById:    make(map[string]*session),
+		requestSessions: make(map[string]requestSession),
 	}
 
 	// Subscribe to our input channel
 	go func() {
+		parentDone := parentCtx.Done()
 		for {
 			select {
+			case <-parentDone:
+				parentDone = nil
+				go ret.shutdown(shutdownReason)
 			case agentMessage := <-ret.websocket.InputChan:
 				// Handle each message in its own thread
 				go func() {
@@ -98,6 +147,8 @@ func NewDataChannel(logger *lggr.Logger,
 						ret.logger.Error(err)
 					}
 				}()
+			case <-ret.websocket.ReconnectedChan:
+				ret.resumeSessions()
 			case message := <-ret.websocket.DoneChan:
 				// The websocket has been closed
 				msg := fmt.Sprintf("Websocket has been closed, closing datachannel: %s", message)
@@ -116,6 +167,18 @@ func NewDataChannel(logger *lggr.Logger,
 	return ret, nil
 }
 
+// Closed once we've finished shutting down
+func (d *DataChannel) ShutdownDone() <-chan struct{} {
+	return d.shutdownDone
+}
+
+// Sends anything we still have queued and tells Bastion we're going away
+func (d *DataChannel) shutdown(reason string) {
+	d.websocket.Close(reason)
+	d.cancel()
+	close(d.shutdownDone)
+}
+
 func (d *DataChannel) StartKubeDaemonPlugin(localhostToken string, daemonPort string, certPath string, keyPath string) error {
 	subLogger := d.logger.GetPluginLogger(plgn.KubeDaemon)
 	if plugin, err := kube.NewKubeDaemonPlugin(d.ctx, subLogger, localhostToken, daemonPort, certPath, keyPath, d.doneChannel); err != nil {
@@ -123,12 +186,169 @@ func (d *DataChannel) StartKubeDaemonPlugin(localhostToken string, daemonPort st
 		d.logger.Error(rerr)
 		return rerr
 	} else {
-		d.plugin = plugin
+		return d.startPlugin(plugin, "kube/restapi") // placeholder
+	}
+}
 
-		if err := d.sendSyn(); err != nil {
-			return err
+func (d *DataChannel) StartTunnelDaemonPlugin(localPort string, targetHost string, targetPort int) error {
+	subLogger := d.logger.GetPluginLogger(plgn.TunnelDaemon)
+	if plugin, err := tunnel.NewTunnelDaemonPlugin(d.ctx, subLogger, localPort, targetHost, targetPort, d.doneChannel); err != nil {
+		rerr := fmt.Errorf("could not start tunnel daemon plugin: %s", err)
+		d.logger.Error(rerr)
+		return rerr
+	} else {
+		return d.startPlugin(plugin, "tunnel/open")
+	}
+}
+
+func (d *DataChannel) StartShellDaemonPlugin() error {
+	subLogger := d.logger.GetPluginLogger(plgn.ShellDaemon)
+	if plugin, err := shell.NewShellDaemonPlugin(d.ctx, subLogger, d.doneChannel); err != nil {
+		rerr := fmt.Errorf("could not start shell daemon plugin: %s", err)
+		d.logger.Error(rerr)
+		return rerr
+	} else {
+		return d.startPlugin(plugin, "shell/open")
+	}
+}
+
+func (d *DataChannel) startPlugin(plugin IDaemonPlugin, synAction string) error {
+	d.plugin = plugin
+	d.synAction = synAction
+
+	// Everything goes through our first session until we know the agent supports more than one
+	if _, err := d.openSession(); err != nil {
+		return err
+	}
+
+	go d.dispatchRequests()
+	return nil
+}
+
+// Starts a new keysplitting hash chain with the agent, must be called with the sessions lock held
+// or before anyone else can get at our sessions
+func (d *DataChannel) openSession() (*session, error) {
+	s, err := newSession(d, uuid.New().String())
+	if err != nil {
+		rerr := fmt.Errorf("could not start keysplitting session: %s", err)
+		d.logger.Error(rerr)
+		return s, rerr
+	}
+
+	d.sessions = append(d.sessions, s)
+	d.sessionsById[s.id] = s
+
+	if err := s.sendSyn(); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Hands every request our plugin makes to the session its requestId is assigned to
+func (d *DataChannel) dispatchRequests() {
+	for {
+		action, payload, err := d.plugin.WaitForRequest(d.ctx)
+		if d.ctx.Err() != nil {
+			return
+		} else if err != nil {
+			d.logger.Error(err)
+			continue
+		}
+
+		s := d.getRequestSession(payload)
+		select {
+		case <-d.ctx.Done():
+			return
+		case s.requests <- plgn.ActionWrapper{Action: action, ActionPayload: payload}:
+		}
+	}
+}
+
+func (d *DataChannel) getRequestSession(actionPayload []byte) *session {
+	d.sessionsLock.Lock()
+	defer d.sessionsLock.Unlock()
+
+	if !d.multiplexed {
+		return d.sessions[0]
+	}
+
+	// Our plugin marshals its payloads a second time, so unwrap them before looking for the request id
+	var payloadBytes []byte
+	var request kube.JustRequestId
+	if err := json.Unmarshal(actionPayload, &payloadBytes); err != nil {
+		return d.sessions[0]
+	} else if err := json.Unmarshal(payloadBytes, &request); err != nil || request.RequestId == "" {
+		return d.sessions[0]
+	}
+
+	// Every message for a request has to stay on the same hash chain so the agent sees them in order
+	now := time.Now()
+	d.pruneRequestSessions(now)
+	if assigned, ok := d.requestSessions[request.RequestId]; ok {
+		assigned.lastUsed = now
+		d.requestSessions[request.RequestId] = assigned
+		return assigned.session
+	}
+
+	var s *session
+	if len(d.sessions) < maxSessions {
+		if newSession, err := d.openSession(); err == nil {
+			s = newSession
+		}
+	}
+	if s == nil {
+		s = d.sessions[d.nextSession%len(d.sessions)]
+		d.nextSession++
+	}
+
+	d.requestSessions[request.RequestId] = requestSession{
+		session:  s,
+		lastUsed: now,
+	}
+	return s
+}
+
+// Forgets about requests we haven't heard from in a while, must be called with the sessions lock held
+func (d *DataChannel) pruneRequestSessions(now time.Time) {
+	// No need to go through every request each time, nothing expires faster than this anyway
+	if now.Sub(d.lastPruned) < requestIdleTimeout/10 {
+		return
+	}
+	d.lastPruned = now
+
+	for requestId, assigned := range d.requestSessions {
+		if now.Sub(assigned.lastUsed) > requestIdleTimeout {
+			delete(d.requestSessions, requestId)
+		}
+	}
+}
+
+// Finds the session a message from the agent is for, agents that only support a single hash chain won't
+// tell us which session it is so it has to be our first one
+func (d *DataChannel) getSession(sessionId string) (*session, error) {
+	d.sessionsLock.Lock()
+	defer d.sessionsLock.Unlock()
+
+	if sessionId == "" {
+		return d.sessions[0], nil
+	} else if s, ok := d.sessionsById[sessionId]; ok {
+		return s, nil
+	} else {
+		return nil, fmt.Errorf("unknown keysplitting session: %s", sessionId)
+	}
+}
+
+// Our websocket reconnected, so pick every session's hash chain back up where we left off
+func (d *DataChannel) resumeSessions() {
+	d.sessionsLock.Lock()
+	sessions := append([]*session{}, d.sessions...)
+	d.sessionsLock.Unlock()
+
+	d.logger.Info(fmt.Sprintf("Websocket reconnected, resuming %d keysplitting sessions", len(sessions)))
+	for _, s := range sessions {
+		if err := s.resume(); err != nil {
+			d.logger.Error(err)
 		}
-		return nil
 	}
 }
 
@@ -151,25 +371,6 @@ func (d *DataChannel) Send(messageType wsmsg.MessageType, messagePayload interfa
 	return nil
 }
 
-func (d *DataChannel) sendSyn() error {
-	d.logger.Info("Sending SYN")
-	d.handshook = false
-	payload := map[string]string{
-		"Role": d.role,
-	}
-	payloadBytes, _ := json.Marshal(payload)
-
-	action := "kube/restapi" // placeholder
-	if synMessage, err := d.keysplitting.BuildSyn(action, payloadBytes); err != nil {
-		rerr := fmt.Errorf("error building Syn: %s", err)
-		d.logger.Error(rerr)
-		return rerr
-	} else {
-		d.Send(wsmsg.Keysplitting, synMessage)
-	}
-	return nil
-}
-
 func (d *DataChannel) Receive(agentMessage wsmsg.AgentMessage) error {
 	msg := fmt.Sprintf("Datachannel received %v message", wsmsg.MessageType(agentMessage.MessageType))
 	d.logger.Info(msg)
@@ -181,8 +382,18 @@ func (d *DataChannel) Receive(agentMessage wsmsg.AgentMessage) error {
 			rerr := fmt.Errorf("malformed Keysplitting message")
 			d.logger.Error(rerr)
 			return rerr
+		} else if s, err := d.getSession(ksMessage.SessionId); err != nil {
+			d.logger.Error(err)
+			return err
 		} else {
-			if err := d.handleKeysplittingMessage(&ksMessage); err != nil {
+			// The agent echoing our session id back means we can start spreading requests across sessions
+			if ksMessage.Type == ksmsg.SynAck && ksMessage.SessionId != "" {
+				d.sessionsLock.Lock()
+				d.multiplexed = true
+				d.sessionsLock.Unlock()
+			}
+
+			if err := s.handleKeysplittingMessage(&ksMessage); err != nil {
 				d.logger.Error(err)
 				return err
 			}
@@ -205,27 +416,10 @@ func (d *DataChannel) Receive(agentMessage wsmsg.AgentMessage) error {
 			rerr := fmt.Errorf("malformed Error message")
 			d.logger.Error(rerr)
 			return rerr
-		} else {
-			rerr := fmt.Errorf("received error from agent: %s", errMessage.Message)
-			d.logger.Error(rerr)
-
-			// Keysplitting validation errors are probably going to be mostly bzcert renewals and
-			// we don't want to break every time that happens so we need to get back on the ks train
-			// executive decision: we don't retry if we get an error on a syn aka d.handshook == false
-			if rrr.ErrorType(errMessage.Type) == rrr.KeysplittingValidationError && d.handshook {
-				d.retry++
-				d.onDeck = d.lastMessage
-
-				// In order to get back on the keysplitting train, we need to resend the syn, get the synack
-				// so that our input message handler is pointing to the right thing.
-				if err := d.sendSyn(); err != nil {
-					d.logger.Error(err)
-					return err
-				} else {
-					return rerr
-				}
-			}
-
+		} else if s, err := d.getSession(errMessage.SessionId); err != nil {
+			d.logger.Error(err)
+			return err
+		} else if rerr := s.handleError(errMessage); rerr != nil {
 			d.doneChannel <- rerr.Error()
 			d.cancel()
 			return rerr
@@ -237,70 +431,3 @@ func (d *DataChannel) Receive(agentMessage wsmsg.AgentMessage) error {
 	}
 	return nil
 }
-
-// TODO: simplify this and have them both deserialize into a "common keysplitting" message
-func (d *DataChannel) handleKeysplittingMessage(keysplittingMessage *ksmsg.KeysplittingMessage) error {
-	if err := d.keysplitting.Validate(keysplittingMessage); err != nil {
-		rerr := fmt.Errorf("invalid keysplitting message: %s", err)
-		d.logger.Error(rerr)
-		return rerr
-	}
-
-	var action string
-	var actionResponsePayload []byte
-	switch keysplittingMessage.Type {
-	case ksmsg.SynAck:
-		synAckPayload := keysplittingMessage.KeysplittingPayload.(ksmsg.SynAckPayload)
-		action = synAckPayload.Action
-		actionResponsePayload = synAckPayload.ActionResponsePayload
-
-		d.handshook = true
-
-		// If there is a message that wasn't sent because we got a keysplitting validation error on it, send it now
-		if d.onDeck.Action != "" {
-			err := d.sendKeysplittingMessage(keysplittingMessage, d.onDeck.Action, d.onDeck.ActionPayload)
-			return err
-		}
-	case ksmsg.DataAck:
-		// If we had something on deck, then this was the ack for it and we can remove it
-		d.onDeck = plgn.ActionWrapper{}
-		// If we're here, it means that the previous data message that caused the error was accepted
-		d.retry = 0
-
-		dataAckPayload := keysplittingMessage.KeysplittingPayload.(ksmsg.DataAckPayload)
-		action = dataAckPayload.Action
-		actionResponsePayload = dataAckPayload.ActionResponsePayload
-	default:
-		rerr := fmt.Errorf("unhandled Keysplitting type")
-		d.logger.Error(rerr)
-		return rerr
-	}
-
-	// Send message to plugin's input message handler
-	if action, returnPayload, err := d.plugin.InputMessageHandler(action, actionResponsePayload); err == nil {
-
-		// We need to know the last message for invisible response to keysplitting validation errors
-		d.lastMessage = plgn.ActionWrapper{
-			Action:        action,
-			ActionPayload: returnPayload,
-		}
-
-		return d.sendKeysplittingMessage(keysplittingMessage, action, returnPayload)
-
-	} else {
-		d.logger.Error(err)
-		return err
-	}
-}
-
-func (d *DataChannel) sendKeysplittingMessage(keysplittingMessage *ksmsg.KeysplittingMessage, action string, payload []byte) error {
-	// Build and send response
-	if respKSMessage, err := d.keysplitting.BuildResponse(keysplittingMessage, action, payload); err != nil {
-		rerr := fmt.Errorf("could not build response message: %s", err)
-		d.logger.Error(rerr)
-		return rerr
-	} else {
-		d.Send(wsmsg.Keysplitting, respKSMessage)
-		return nil
-	}
-}
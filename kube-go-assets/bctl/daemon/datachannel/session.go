@@ -0,0 +1,463 @@
+package datachannel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	ks "bastionzero.com/bctl/v1/bctl/daemon/keysplitting"
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+	rrr "bastionzero.com/bctl/v1/bzerolib/error"
+	ksmsg "bastionzero.com/bctl/v1/bzerolib/keysplitting/message"
+	"bastionzero.com/bctl/v1/bzerolib/keysplitting/util"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+)
+
+// A Data message we've sent but haven't received a DataAck for
+type inFlightMessage struct {
+	hash    string
+	message plgn.ActionWrapper
+}
+
+// A single keysplitting hash chain with the agent. Every request is assigned to one session for its whole
+// lifetime so its messages stay in order, but requests in different sessions don't wait on each other
+type session struct {
+	id           string
+	datachannel  *DataChannel
+	logger       *lggr.Logger
+	keysplitting ks.IKeysplitting
+	handshook    bool // aka whether we need to send a syn
+
+	// Requests from our plugin that have been assigned to this session
+	requests chan plgn.ActionWrapper
+
+	// If we need to send a SYN, then we need a way to keep
+	// track of whatever message that triggered the send SYN
+	onDeck      plgn.ActionWrapper
+	lastMessage plgn.ActionWrapper
+	retry       int
+
+	// Pipelining vars, only used if the agent agreed to let us have more than one Data message in flight
+	pipelined      bool
+	pipelineCancel context.CancelFunc
+	pipelineSlots  chan struct{}
+	inFlight       []inFlightMessage
+	queued         []plgn.ActionWrapper
+	resyncing      bool
+	staleErrors    int
+	pipelineLock   sync.Mutex
+
+	// The hashes our unacked messages were sent with before we reconnected, in the order we're resending them
+	resumeHashes []string
+}
+
+func newSession(datachannel *DataChannel, id string) (*session, error) {
+	keysplitter, err := ks.NewKeysplitting(id, datachannel.targetId, datachannel.configPath)
+	if err != nil {
+		return &session{}, err
+	}
+
+	return &session{
+		id:           id,
+		datachannel:  datachannel,
+		logger:       datachannel.logger,
+		keysplitting: keysplitter,
+		handshook:    false,
+		requests:     make(chan plgn.ActionWrapper, 100),
+		onDeck:       plgn.ActionWrapper{},
+		retry:        0,
+	}, nil
+}
+
+func (s *session) sendSyn() error {
+	s.logger.Info(fmt.Sprintf("Sending SYN for session %s", s.id))
+	s.handshook = false
+	payload := map[string]interface{}{
+		"Role": s.datachannel.role,
+
+		// Agents that don't support pipelining will ignore this
+		"pipelineWindow": pipelineWindow,
+	}
+	payloadBytes, _ := json.Marshal(payload)
+
+	if synMessage, err := s.keysplitting.BuildSyn(s.datachannel.synAction, payloadBytes); err != nil {
+		rerr := fmt.Errorf("error building Syn: %s", err)
+		s.logger.Error(rerr)
+		return rerr
+	} else {
+		synMessage.SessionId = s.id
+		s.datachannel.Send(wsmsg.Keysplitting, synMessage)
+	}
+	return nil
+}
+
+// Blocks until our plugin has a request for this session or the context is done
+func (s *session) waitForRequest(ctx context.Context) (plgn.ActionWrapper, bool) {
+	select {
+	case <-ctx.Done():
+		return plgn.ActionWrapper{}, false
+	case request := <-s.requests:
+		return request, true
+	}
+}
+
+// Returns an error if the datachannel should be closed because of the error the agent sent us
+func (s *session) handleError(errMessage rrr.ErrorMessage) error {
+	rerr := fmt.Errorf("received error from agent: %s", errMessage.Message)
+	s.logger.Error(rerr)
+
+	// The agent still acked the message, so only the request it turned down needs to fail
+	if rrr.ErrorType(errMessage.Type) == rrr.ActionRejectedError {
+		s.datachannel.plugin.RejectRequest(errMessage.RequestId, errMessage.Message)
+		return nil
+	}
+
+	// Our id token expired, but the zli may well have refreshed it since we last read our config. Starting a
+	// new hash chain picks up whatever token is there now, and if the user's SSO session is over then the
+	// agent will reject our Syn and we'll close
+	if rrr.ErrorType(errMessage.Type) == rrr.BZCertExpiredError && s.handshook {
+		s.logger.Info(fmt.Sprintf("BZCert expired for session %s, re-sending Syn with a refreshed id token", s.id))
+
+		if s.isPipelined() {
+			if s.handlePipelineError() {
+				return nil
+			}
+			return rerr
+		}
+
+		s.onDeck = s.lastMessage
+		return s.sendSyn()
+	}
+
+	// Keysplitting validation errors are probably going to be mostly bzcert renewals and
+	// we don't want to break every time that happens so we need to get back on the ks train
+	// executive decision: we don't retry if we get an error on a syn aka s.handshook == false
+	if rrr.ErrorType(errMessage.Type) == rrr.KeysplittingValidationError && s.isPipelined() {
+		if s.handlePipelineError() {
+			return nil
+		}
+	} else if rrr.ErrorType(errMessage.Type) == rrr.KeysplittingValidationError && s.handshook {
+		s.retry++
+		s.onDeck = s.lastMessage
+
+		// In order to get back on the keysplitting train, we need to resend the syn, get the synack
+		// so that our input message handler is pointing to the right thing.
+		return s.sendSyn()
+	}
+
+	return rerr
+}
+
+// TODO: simplify this and have them both deserialize into a "common keysplitting" message
+func (s *session) handleKeysplittingMessage(keysplittingMessage *ksmsg.KeysplittingMessage) error {
+	if err := s.keysplitting.Validate(keysplittingMessage); err != nil {
+		// Once we've restarted the hash chain, acks for anything we sent before are expected to fail
+		if s.isPipelined() && keysplittingMessage.Type == ksmsg.DataAck {
+			s.logger.Info(fmt.Sprintf("Ignoring DataAck from a previous hash chain: %s", err))
+			return nil
+		}
+
+		rerr := fmt.Errorf("invalid keysplitting message: %s", err)
+		s.logger.Error(rerr)
+		return rerr
+	}
+
+	var action string
+	var actionResponsePayload []byte
+	switch keysplittingMessage.Type {
+	case ksmsg.SynAck:
+		s.handshook = true
+		s.skipAcceptedMessages(keysplittingMessage)
+
+		if s.keysplitting.GetPipelineWindow() > 1 {
+			s.startPipeline(keysplittingMessage)
+			return nil
+		}
+
+		// If there is a message that wasn't sent because we got a keysplitting validation error on it, send it now
+		if s.onDeck.Action != "" {
+			err := s.sendKeysplittingMessage(keysplittingMessage, s.onDeck.Action, s.onDeck.ActionPayload)
+			return err
+		}
+	case ksmsg.DataAck:
+		if s.isPipelined() {
+			return s.handlePipelinedDataAck(keysplittingMessage)
+		}
+
+		// If we had something on deck, then this was the ack for it and we can remove it
+		s.onDeck = plgn.ActionWrapper{}
+		s.pipelineLock.Lock()
+		s.inFlight = []inFlightMessage{}
+		s.pipelineLock.Unlock()
+		// If we're here, it means that the previous data message that caused the error was accepted
+		s.retry = 0
+
+		dataAckPayload := keysplittingMessage.KeysplittingPayload.(ksmsg.DataAckPayload)
+		action = dataAckPayload.Action
+		actionResponsePayload = dataAckPayload.ActionResponsePayload
+	default:
+		rerr := fmt.Errorf("unhandled Keysplitting type")
+		s.logger.Error(rerr)
+		return rerr
+	}
+
+	// Send the response to our plugin and wait for the next request assigned to this session
+	if err := s.datachannel.plugin.PushActionResponse(action, actionResponsePayload); err != nil {
+		s.logger.Error(err)
+		return err
+	}
+
+	if request, ok := s.waitForRequest(s.datachannel.ctx); ok {
+		// We need to know the last message for invisible response to keysplitting validation errors
+		s.lastMessage = request
+
+		return s.sendKeysplittingMessage(keysplittingMessage, request.Action, request.ActionPayload)
+	}
+	return nil
+}
+
+func (s *session) sendKeysplittingMessage(keysplittingMessage *ksmsg.KeysplittingMessage, action string, payload []byte) error {
+	// Build and send response
+	if respKSMessage, err := s.keysplitting.BuildResponse(keysplittingMessage, action, payload); err != nil {
+		rerr := fmt.Errorf("could not build response message: %s", err)
+		s.logger.Error(rerr)
+		return rerr
+	} else {
+		// Keep track of what we're waiting on an ack for in case we lose our connection before we get it
+		hashBytes, _ := util.HashPayload(respKSMessage.KeysplittingPayload)
+		s.pipelineLock.Lock()
+		s.inFlight = []inFlightMessage{{
+			hash:    base64.StdEncoding.EncodeToString(hashBytes),
+			message: plgn.ActionWrapper{Action: action, ActionPayload: payload},
+		}}
+		s.pipelineLock.Unlock()
+
+		respKSMessage.SessionId = s.id
+		s.datachannel.Send(wsmsg.Keysplitting, respKSMessage)
+		return nil
+	}
+}
+
+// Picks our hash chain back up after our websocket reconnects. If we weren't waiting on the agent for anything
+// then our chain is still good, otherwise we re-Syn with the hash of the last message we sent as our nonce and
+// resend whatever the agent didn't get
+func (s *session) resume() error {
+	s.pipelineLock.Lock()
+
+	if s.handshook && len(s.inFlight) == 0 {
+		s.pipelineLock.Unlock()
+		return nil
+	}
+
+	// Anything we didn't get an ack for goes first, in the order we originally sent it
+	s.resumeHashes = []string{}
+	resend := []plgn.ActionWrapper{}
+	for _, message := range s.inFlight {
+		s.resumeHashes = append(s.resumeHashes, message.hash)
+		resend = append(resend, message.message)
+	}
+	s.inFlight = []inFlightMessage{}
+
+	if s.pipelined {
+		s.pipelineCancel()
+		s.resyncing = true
+		s.staleErrors = 0
+		s.queued = append(resend, s.queued...)
+	} else if len(resend) > 0 {
+		s.onDeck = resend[0]
+	}
+	s.pipelineLock.Unlock()
+
+	s.logger.Info(fmt.Sprintf("Resuming session %s with %d unacked messages", s.id, len(resend)))
+	return s.sendSyn()
+}
+
+// Once we've resumed, the agent tells us the last message it accepted from before we lost our connection so we
+// don't run anything twice
+func (s *session) skipAcceptedMessages(synAckMessage *ksmsg.KeysplittingMessage) {
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+
+	hashes := s.resumeHashes
+	s.resumeHashes = nil
+	if len(hashes) == 0 {
+		return
+	}
+
+	var negotiation ksmsg.ResumeNegotiation
+	synAckPayload := synAckMessage.KeysplittingPayload.(ksmsg.SynAckPayload)
+	if err := json.Unmarshal(synAckPayload.ActionResponsePayload, &negotiation); err != nil || negotiation.LastDataHash == "" {
+		return
+	}
+
+	for i, hash := range hashes {
+		if hash == negotiation.LastDataHash {
+			s.logger.Info(fmt.Sprintf("Agent already accepted %d of our unacked messages in session %s", i+1, s.id))
+			if s.pipelined {
+				s.queued = s.queued[i+1:]
+			} else {
+				s.onDeck = plgn.ActionWrapper{}
+			}
+			return
+		}
+	}
+}
+
+func (s *session) isPipelined() bool {
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+
+	return s.pipelined
+}
+
+// Starts sending Data messages off of a freshly validated SynAck without waiting on each DataAck
+func (s *session) startPipeline(synAckMessage *ksmsg.KeysplittingMessage) {
+	window := s.keysplitting.GetPipelineWindow()
+	s.logger.Info(fmt.Sprintf("Pipelining up to %d Data messages in session %s", window, s.id))
+
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+
+	// Anything we still have on deck from lockstep mode gets sent first
+	if s.onDeck.Action != "" {
+		s.queued = append([]plgn.ActionWrapper{s.onDeck}, s.queued...)
+		s.onDeck = plgn.ActionWrapper{}
+	}
+
+	ctx, cancel := context.WithCancel(s.datachannel.ctx)
+	s.pipelined = true
+	s.pipelineCancel = cancel
+	s.pipelineSlots = make(chan struct{}, window)
+	s.resyncing = false
+
+	go s.pipelineSender(ctx, synAckMessage, s.pipelineSlots)
+}
+
+func (s *session) pipelineSender(ctx context.Context, synAckMessage *ksmsg.KeysplittingMessage, slots chan struct{}) {
+	first := true
+
+	for {
+		// Wait until the agent has room for another message
+		select {
+		case <-ctx.Done():
+			return
+		case slots <- struct{}{}:
+		}
+
+		// Messages that need resending after a resync go before anything new
+		var next plgn.ActionWrapper
+		s.pipelineLock.Lock()
+		if len(s.queued) > 0 {
+			next = s.queued[0]
+			s.queued = s.queued[1:]
+		}
+		s.pipelineLock.Unlock()
+
+		if next.Action == "" {
+			next, _ = s.waitForRequest(ctx)
+		}
+
+		if err := s.sendPipelined(ctx, synAckMessage, next, first); err != nil {
+			s.logger.Error(err)
+			return
+		}
+		first = false
+	}
+}
+
+func (s *session) sendPipelined(ctx context.Context, synAckMessage *ksmsg.KeysplittingMessage, message plgn.ActionWrapper, first bool) error {
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+
+	// If we started a resync while waiting on this message, it'll go out once we're back on the hash chain
+	if ctx.Err() != nil {
+		if message.Action != "" {
+			s.queued = append(s.queued, message)
+		}
+		return nil
+	}
+
+	// The first Data message points at the SynAck, every one after points at the Data message before it
+	var dataMessage ksmsg.KeysplittingMessage
+	var err error
+	if first {
+		dataMessage, err = s.keysplitting.BuildResponse(synAckMessage, message.Action, message.ActionPayload)
+	} else {
+		dataMessage, err = s.keysplitting.BuildData(message.Action, message.ActionPayload)
+	}
+	if err != nil {
+		return fmt.Errorf("could not build pipelined Data message: %s", err)
+	}
+	dataMessage.SessionId = s.id
+
+	hashBytes, _ := util.HashPayload(dataMessage.KeysplittingPayload)
+	s.inFlight = append(s.inFlight, inFlightMessage{
+		hash:    base64.StdEncoding.EncodeToString(hashBytes),
+		message: message,
+	})
+	s.lastMessage = message
+
+	return s.datachannel.Send(wsmsg.Keysplitting, dataMessage)
+}
+
+func (s *session) handlePipelinedDataAck(keysplittingMessage *ksmsg.KeysplittingMessage) error {
+	dataAckPayload := keysplittingMessage.KeysplittingPayload.(ksmsg.DataAckPayload)
+
+	s.pipelineLock.Lock()
+	for i, message := range s.inFlight {
+		if message.hash == dataAckPayload.HPointer {
+			s.inFlight = append(s.inFlight[:i], s.inFlight[i+1:]...)
+			break
+		}
+	}
+	s.retry = 0
+
+	// Free up room for the next message
+	select {
+	case <-s.pipelineSlots:
+	default:
+	}
+	s.pipelineLock.Unlock()
+
+	return s.datachannel.plugin.PushActionResponse(dataAckPayload.Action, dataAckPayload.ActionResponsePayload)
+}
+
+// Returns true if the error was handled by restarting the hash chain, or was caused by messages we sent before
+// restarting it
+func (s *session) handlePipelineError() bool {
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+
+	// The agent handles our messages in order, so once one message fails every one we sent after it will too
+	if s.staleErrors > 0 {
+		s.staleErrors--
+		return true
+	} else if s.resyncing {
+		return false
+	}
+
+	s.retry++
+	if s.retry > maxRetries {
+		return false
+	}
+
+	// Stop sending and queue up everything the agent didn't accept so we can resend it in order
+	s.pipelineCancel()
+	s.resyncing = true
+	s.staleErrors = len(s.inFlight) - 1
+	queued := make([]plgn.ActionWrapper, 0, len(s.inFlight)+len(s.queued))
+	for _, message := range s.inFlight {
+		queued = append(queued, message.message)
+	}
+	s.queued = append(queued, s.queued...)
+	s.inFlight = []inFlightMessage{}
+
+	if err := s.sendSyn(); err != nil {
+		s.logger.Error(err)
+		return false
+	}
+	return true
+}
@@ -3,9 +3,11 @@ package keysplitting
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 
 	bzcrt "bastionzero.com/bctl/v1/bzerolib/keysplitting/bzcert"
@@ -17,6 +19,14 @@ const (
 	schemaVersion = "1.0"
 )
 
+var (
+	// Returned when an ack didn't come from the agent we're connecting to
+	ErrTargetIdMismatch = errors.New("TargetId did not match")
+
+	// Returned when an ack doesn't point at a message we sent
+	ErrHPointerMismatch = errors.New("hash pointer did not match")
+)
+
 type Config struct {
 	KSConfig KeysplittingConfig `json:"keySplitting"`
 	TokenSet TokenSetConfig     `json:"tokenSet"`
@@ -43,6 +53,8 @@ type IKeysplitting interface {
 	BuildSyn(action string, payload []byte) (ksmsg.KeysplittingMessage, error)
 	Validate(ksMessage *ksmsg.KeysplittingMessage) error
 	BuildResponse(ksMessage *ksmsg.KeysplittingMessage, action string, actionPayload []byte) (ksmsg.KeysplittingMessage, error)
+	BuildData(action string, actionPayload []byte) (ksmsg.KeysplittingMessage, error)
+	GetPipelineWindow() int
 }
 
 type Keysplitting struct {
@@ -52,46 +64,123 @@ type Keysplitting struct {
 	privatekey       string
 
 	// daemon variables
+	sessionId  string
 	targetId   string
 	configPath string
 	bzcertHash string
+
+	// Pipelining variables, only used if the agent agreed to more than one Data message in flight
+	pipelineWindow int
+	lastDataHash   string
+	pendingAcks    map[string]int // the hash of each Data message in flight and the order we sent it in
+	dataSent       int
+
+	// The latest DataAck we've received, every pipelined Data message points at it so the agent knows
+	// which of its acks we've seen
+	lastAckHash     string
+	lastAckSequence int
+
+	// Acks can be validated at the same time as we're building new Data messages
+	lock sync.Mutex
 }
 
-func NewKeysplitting(targetId string, configPath string) (IKeysplitting, error) {
+func NewKeysplitting(sessionId string, targetId string, configPath string) (IKeysplitting, error) {
 
 	// TODO: load keys from storage
 	keysplitter := &Keysplitting{
 		hPointer:         "",
 		expectedHPointer: "",
+		sessionId:        sessionId,
 		targetId:         targetId,
 		configPath:       configPath,
+		pendingAcks:      make(map[string]int),
 	}
 
 	return keysplitter, nil
 }
 
 func (k *Keysplitting) Validate(ksMessage *ksmsg.KeysplittingMessage) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
 	var hpointer string
 	switch ksMessage.Type {
 	case ksmsg.SynAck:
 		synAckPayload := ksMessage.KeysplittingPayload.(ksmsg.SynAckPayload)
 		hpointer = synAckPayload.HPointer
+
+		// Only the agent we meant to connect to can answer our Syn, every Data message we send is bound to its key.
+		// If we weren't told which agent that is, we hold ourselves to the first one that answers
+		targetId := k.targetId
+		if targetId == "" {
+			targetId = synAckPayload.TargetPublicKey
+		}
+		if synAckPayload.TargetPublicKey != targetId {
+			return fmt.Errorf("%w: synack's TargetPublicKey did not match the agent we're connecting to", ErrTargetIdMismatch)
+		} else if err := ksMessage.VerifySignature(targetId); err != nil {
+			return fmt.Errorf("%w: synack was not signed by the agent we're connecting to: %s", ErrTargetIdMismatch, err)
+		}
+
+		if hpointer != k.expectedHPointer {
+			return fmt.Errorf("%w: %T hash pointer did not match expected", ErrHPointerMismatch, ksMessage.KeysplittingPayload)
+		}
+		k.targetId = targetId
+
+		// Agents that support pipelining will tell us how many Data messages we can have in flight
+		k.pipelineWindow = 0
+		var negotiation ksmsg.PipelineNegotiation
+		if err := json.Unmarshal(synAckPayload.ActionResponsePayload, &negotiation); err == nil && negotiation.PipelineWindow > 1 {
+			k.pipelineWindow = negotiation.PipelineWindow
+		}
+		return nil
 	case ksmsg.DataAck:
 		dataAckPayload := ksMessage.KeysplittingPayload.(ksmsg.DataAckPayload)
 		hpointer = dataAckPayload.HPointer
+
+		if dataAckPayload.TargetPublicKey != k.targetId {
+			return fmt.Errorf("%w: dataack's TargetPublicKey did not match the agent we're connecting to", ErrTargetIdMismatch)
+		} else if err := ksMessage.VerifySignature(k.targetId); err != nil {
+			return fmt.Errorf("%w: dataack was not signed by the agent we're connecting to: %s", ErrTargetIdMismatch, err)
+		}
+
+		// When pipelining, acks can come back for any of the Data messages we have in flight
+		if k.pipelineWindow > 0 {
+			sequence, ok := k.pendingAcks[hpointer]
+			if !ok {
+				return fmt.Errorf("%w: %T hash pointer did not match any Data message in flight", ErrHPointerMismatch, ksMessage.KeysplittingPayload)
+			}
+			delete(k.pendingAcks, hpointer)
+
+			if sequence > k.lastAckSequence {
+				hashBytes, _ := util.HashPayload(dataAckPayload)
+				k.lastAckHash = base64.StdEncoding.EncodeToString(hashBytes)
+				k.lastAckSequence = sequence
+			}
+			return nil
+		}
 	default:
 		return fmt.Errorf("error validating unhandled Keysplitting type")
 	}
 
 	// Verify recieved hash pointer matches expected
 	if hpointer != k.expectedHPointer {
-		return fmt.Errorf("%T hash pointer did not match expected", ksMessage.KeysplittingPayload)
+		return fmt.Errorf("%w: %T hash pointer did not match expected", ErrHPointerMismatch, ksMessage.KeysplittingPayload)
 	} else {
 		return nil
 	}
 }
 
+func (k *Keysplitting) GetPipelineWindow() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.pipelineWindow
+}
+
 func (k *Keysplitting) BuildResponse(ksMessage *ksmsg.KeysplittingMessage, action string, actionPayload []byte) (ksmsg.KeysplittingMessage, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
 	var responseMessage ksmsg.KeysplittingMessage
 
 	switch ksMessage.Type {
@@ -119,17 +208,68 @@ func (k *Keysplitting) BuildResponse(ksMessage *ksmsg.KeysplittingMessage, actio
 		}
 	}
 
-	hashBytes, _ := util.HashPayload(responseMessage.KeysplittingPayload)
-	k.expectedHPointer = base64.StdEncoding.EncodeToString(hashBytes)
+	return k.signData(responseMessage)
+}
 
-	if err := responseMessage.Sign(k.privatekey); err != nil {
-		return responseMessage, fmt.Errorf("could not sign payload: %v", err.Error())
+// Only used when pipelining, builds a Data message that points at the last Data message we sent rather than
+// waiting on its DataAck, along with the latest DataAck we have received
+func (k *Keysplitting) BuildData(action string, actionPayload []byte) (ksmsg.KeysplittingMessage, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.pipelineWindow == 0 || k.lastDataHash == "" {
+		return ksmsg.KeysplittingMessage{}, fmt.Errorf("cannot build a pipelined Data message before the first Data message is sent")
+	}
+
+	dataPayload := ksmsg.DataPayload{
+		Timestamp:     fmt.Sprint(time.Now().Unix()),
+		SchemaVersion: schemaVersion,
+		Type:          string(ksmsg.Data),
+		Action:        action,
+		TargetId:      k.targetId,
+		HPointer:      k.lastDataHash,
+		ActionPayload: actionPayload,
+		BZCertHash:    k.bzcertHash,
+		AckHPointer:   k.lastAckHash,
+	}
+	k.hPointer = k.lastDataHash
+
+	return k.signData(ksmsg.KeysplittingMessage{
+		Type:                ksmsg.Data,
+		KeysplittingPayload: dataPayload,
+	})
+}
+
+func (k *Keysplitting) signData(dataMessage ksmsg.KeysplittingMessage) (ksmsg.KeysplittingMessage, error) {
+	hashBytes, _ := util.HashPayload(dataMessage.KeysplittingPayload)
+	hash := base64.StdEncoding.EncodeToString(hashBytes)
+	k.expectedHPointer = hash
+
+	if k.pipelineWindow > 0 {
+		k.dataSent++
+		k.lastDataHash = hash
+		k.pendingAcks[hash] = k.dataSent
+	}
+
+	if err := dataMessage.Sign(k.privatekey); err != nil {
+		return dataMessage, fmt.Errorf("could not sign payload: %v", err.Error())
 	} else {
-		return responseMessage, nil
+		return dataMessage, nil
 	}
 }
 
 func (k *Keysplitting) BuildSyn(action string, payload []byte) (ksmsg.KeysplittingMessage, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	// Every Syn starts a new chain, anything we had in flight is gone
+	k.pipelineWindow = 0
+	k.lastDataHash = ""
+	k.pendingAcks = make(map[string]int)
+	k.dataSent = 0
+	k.lastAckHash = ""
+	k.lastAckSequence = 0
+
 	// If this is the beginning of the hash chain, then we create a nonce with a random value,
 	// otherwise we use the hash of the previous value to maintain the hash chain and immutability
 	var nonce string
@@ -158,9 +298,10 @@ func (k *Keysplitting) BuildSyn(action string, payload []byte) (ksmsg.Keysplitti
 		Type:          string(ksmsg.Syn),
 		Action:        action,
 		ActionPayload: payload,
-		TargetId:      k.targetId, // TODO
+		TargetId:      k.targetId,
 		Nonce:         nonce,
 		BZCert:        bzCert,
+		SessionId:     k.sessionId,
 	}
 
 	ksMessage := ksmsg.KeysplittingMessage{
@@ -2,12 +2,13 @@ package exec
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
 	kubeexec "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/exec"
 	kubeutils "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube/utils"
 	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
@@ -15,6 +16,33 @@ import (
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
 )
 
+// Both SPDY and WebSocket connections to kubectl give us the same set of streams
+type RemoteCommandService interface {
+	Stdin() io.Reader
+	Stdout() io.Writer
+	Stderr() io.Writer
+	Resize() io.Reader
+	WriteStatus(status *StatusError) error
+	Close() error
+}
+
+const (
+	// Large writes to stdin get split up into chunks no bigger than this
+	stdinChunkSize = 64 * 1024
+
+	// The number of unacknowledged stdin chunks we're allowed to have in flight
+	stdinWindowSize = kubeexec.StdinWindowSize
+
+	// The number of unacknowledged stdout/stderr messages the agent is allowed to have in flight,
+	// we acknowledge them every half window so the agent never has to stop and wait for us
+	outputWindowSize  = 64
+	outputAckInterval = outputWindowSize / 2
+
+	// How many output messages we'll hold on to while waiting for one that's gone missing. Agents that don't
+	// know about our window can have more than it in flight, so we leave them some room
+	maxOutOfOrderMessages = 4 * outputWindowSize
+)
+
 type ExecAction struct {
 	requestId         string
 	logId             string
@@ -22,6 +50,7 @@ type ExecAction struct {
 	ksResponseChannel chan plgn.ActionWrapper
 	RequestChannel    chan plgn.ActionWrapper
 	streamChannel     chan smsg.StreamMessage
+	rejectChannel     chan string
 	logger            *lggr.Logger
 	ctx               context.Context
 }
@@ -41,14 +70,23 @@ func NewExecAction(ctx context.Context,
 		RequestChannel:    ch,
 		ksResponseChannel: make(chan plgn.ActionWrapper),
 		streamChannel:     make(chan smsg.StreamMessage, 100),
+		rejectChannel:     make(chan string, 1),
 		logger:            logger,
 		ctx:               ctx,
 	}, nil
 }
 
 func (r *ExecAction) InputMessageHandler(writer http.ResponseWriter, request *http.Request) error {
-	subLogger := r.logger.GetComponentLogger("SPDY")
-	spdy, err := NewSPDYService(subLogger, writer, request)
+	// Newer versions of kubectl speak WebSockets instead of SPDY, so check which one we're being asked to upgrade to
+	var service RemoteCommandService
+	var err error
+	if isWebSocketRequest(request) {
+		subLogger := r.logger.GetComponentLogger("WebSocket")
+		service, err = NewWebSocketService(subLogger, writer, request)
+	} else {
+		subLogger := r.logger.GetComponentLogger("SPDY")
+		service, err = NewSPDYService(subLogger, writer, request)
+	}
 	if err != nil {
 		r.logger.Error(err)
 		return err
@@ -60,65 +98,108 @@ func (r *ExecAction) InputMessageHandler(writer http.ResponseWriter, request *ht
 	// Now since we made our local connection to kubectl, initiate a connection with Bastion
 	r.RequestChannel <- wrapStartPayload(isTty, r.requestId, r.logId, request.URL.Query()["command"], request.URL.String())
 
-	// Set up a go function for stdout
+	// Only ever have a window's worth of stdin in flight so large transfers don't blow up our memory
+	stdinWindow := newStdinWindow(stdinWindowSize)
+
+	// Set up a go function for stdout and stderr, which is also where the agent acks our stdin
 	go func() {
-		streamQueue := make(map[int]smsg.StreamMessage)
-		seqNumber := 0
+		outputStreams := map[smsg.StreamType]*outputStream{
+			smsg.StdOut: newOutputStream(service.Stdout()),
+			smsg.StdErr: newOutputStream(service.Stderr()),
+		}
+
 		for {
 			select {
 			case <-r.ctx.Done():
 				return
+			case reason := <-r.rejectChannel:
+				r.logger.Error(fmt.Errorf("agent rejected exec: %s", reason))
+				service.WriteStatus(&StatusError{ErrStatus: metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonTooManyRequests, Message: reason}})
+				service.Close()
+				return
 			case streamMessage := <-r.streamChannel:
-				contentBytes, _ := base64.StdEncoding.DecodeString(streamMessage.Content)
+				streamType := smsg.StreamType(streamMessage.Type)
+				if streamType == smsg.StdInAck {
+					if !stdinWindow.ack(streamMessage.SequenceNumber) {
+						r.logger.Error(fmt.Errorf("received unexpected ack for stdin chunk %d", streamMessage.SequenceNumber))
+					}
+					continue
+				}
+
+				output, ok := outputStreams[streamType]
+				if !ok {
+					r.logger.Error(fmt.Errorf("unhandled exec stream type: %s", streamMessage.Type))
+					continue
+				}
 
 				// Check for agent-initiated end e.g. user typing 'exit'
-				if string(contentBytes) == kubeexec.EscChar {
+				ended, err := output.push(streamMessage)
+				if err != nil {
+					r.logger.Error(err)
+					service.WriteStatus(&StatusError{ErrStatus: metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}})
+					service.Close()
+					return
+				} else if ended {
 					r.logger.Info("stream ended")
-					spdy.conn.Close()
+
+					// Let kubectl know the command finished before hanging up
+					service.WriteStatus(&StatusError{ErrStatus: metav1.Status{Status: metav1.StatusSuccess}})
+					service.Close()
 					return
 				}
 
-				// Check sequence number is correct, if not store it for later
-				if streamMessage.SequenceNumber == seqNumber {
-					spdy.stdoutStream.Write(contentBytes)
-					seqNumber++
-
-					// Process any existing messages that were recieved out of order
-					msg, ok := streamQueue[seqNumber]
-					for ok {
-						moreBytes, _ := base64.StdEncoding.DecodeString(msg.Content)
-						spdy.stdoutStream.Write(moreBytes)
-						delete(streamQueue, seqNumber)
-						seqNumber++
-						msg, ok = streamQueue[seqNumber]
-					}
-				} else {
-					streamQueue[streamMessage.SequenceNumber] = streamMessage
+				// Let the agent know it can keep sending
+				if output.expectedSequenceNumber-output.lastAcked-1 >= outputAckInterval {
+					output.lastAcked = output.expectedSequenceNumber - 1
+					r.RequestChannel <- wrapAckPayload(r.requestId, r.logId, streamType, output.lastAcked)
 				}
 			}
 		}
-
 	}()
 
-	// Set up a go function for stdin
+	// We get the response to every message we send, but there's nothing in them we need
 	go func() {
-		// Keep the buffer big incase we are passing data to the pod
-		buf := make([]byte, 1024*1024)
 		for {
 			select {
 			case <-r.ctx.Done():
 				return
-			default:
-				n, err := spdy.stdinStream.Read(buf)
-				if err == io.EOF {
+			case <-r.ksResponseChannel:
+			}
+		}
+	}()
+
+	// Set up a go function for stdin, if kubectl asked for it
+	go func() {
+		if service.Stdin() == nil {
+			return
+		}
+
+		buf := make([]byte, stdinChunkSize)
+		sequenceNumber := 0
+		for {
+			n, err := service.Stdin().Read(buf)
+			if n > 0 {
+				if !stdinWindow.send(r.ctx, sequenceNumber) {
 					return
 				}
 
 				// Send message to agent
-				r.RequestChannel <- wrapStdinPayload(r.requestId, r.logId, buf[:n])
+				r.RequestChannel <- wrapStdinPayload(r.requestId, r.logId, buf[:n], sequenceNumber, false)
+				sequenceNumber++
 			}
-		}
 
+			if err != nil {
+				if err == io.EOF {
+					// Let the pod know we're done sending stdin e.g. so tar knows the file is complete
+					if stdinWindow.send(r.ctx, sequenceNumber) {
+						r.RequestChannel <- wrapStdinPayload(r.requestId, r.logId, []byte{}, sequenceNumber, true)
+					}
+				} else {
+					r.logger.Error(fmt.Errorf("error reading stdin: %s", err))
+				}
+				return
+			}
+		}
 	}()
 
 	if isTty {
@@ -129,7 +210,7 @@ func (r *ExecAction) InputMessageHandler(writer http.ResponseWriter, request *ht
 				case <-r.ctx.Done():
 					return
 				default:
-					decoder := json.NewDecoder(spdy.resizeStream)
+					decoder := json.NewDecoder(service.Resize())
 
 					size := TerminalSize{}
 					if err := decoder.Decode(&size); err != nil {
@@ -150,6 +231,14 @@ func (r *ExecAction) InputMessageHandler(writer http.ResponseWriter, request *ht
 	return nil
 }
 
+// The agent turned down our request, so let kubectl know why instead of waiting on it
+func (r *ExecAction) Reject(reason string) {
+	select {
+	case r.rejectChannel <- reason:
+	default:
+	}
+}
+
 func (r *ExecAction) PushKSResponse(wrappedAction plgn.ActionWrapper) {
 	r.ksResponseChannel <- wrappedAction
 }
@@ -160,11 +249,12 @@ func (r *ExecAction) PushStreamResponse(stream smsg.StreamMessage) {
 
 func wrapStartPayload(isTty bool, requestId string, logId string, command []string, endpoint string) plgn.ActionWrapper {
 	payload := kubeexec.KubeExecStartActionPayload{
-		RequestId: requestId,
-		LogId:     logId,
-		IsTty:     isTty,
-		Command:   command,
-		Endpoint:  endpoint,
+		RequestId:  requestId,
+		LogId:      logId,
+		IsTty:      isTty,
+		Command:    command,
+		Endpoint:   endpoint,
+		WindowSize: outputWindowSize,
 	}
 
 	payloadBytes, _ := json.Marshal(payload)
@@ -189,11 +279,13 @@ func wrapResizePayload(requestId string, logId string, width uint16, height uint
 	}
 }
 
-func wrapStdinPayload(requestId string, logId string, stdin []byte) plgn.ActionWrapper {
+func wrapStdinPayload(requestId string, logId string, stdin []byte, sequenceNumber int, endOfStream bool) plgn.ActionWrapper {
 	payload := kubeexec.KubeStdinActionPayload{
-		RequestId: requestId,
-		LogId:     logId,
-		Stdin:     stdin,
+		RequestId:      requestId,
+		LogId:          logId,
+		Stdin:          stdin,
+		SequenceNumber: sequenceNumber,
+		EndOfStream:    endOfStream,
 	}
 
 	payloadBytes, _ := json.Marshal(payload)
@@ -202,3 +294,18 @@ func wrapStdinPayload(requestId string, logId string, stdin []byte) plgn.ActionW
 		ActionPayload: payloadBytes,
 	}
 }
+
+func wrapAckPayload(requestId string, logId string, streamType smsg.StreamType, sequenceNumber int) plgn.ActionWrapper {
+	payload := kubeexec.KubeExecAckActionPayload{
+		RequestId:      requestId,
+		LogId:          logId,
+		StreamType:     string(streamType),
+		SequenceNumber: sequenceNumber,
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	return plgn.ActionWrapper{
+		Action:        string(kubeexec.ExecAck),
+		ActionPayload: payloadBytes,
+	}
+}
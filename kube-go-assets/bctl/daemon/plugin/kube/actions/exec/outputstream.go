@@ -0,0 +1,64 @@
+package exec
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	kubeexec "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/exec"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+)
+
+// The agent numbers stdout and stderr messages separately and they can arrive out of order,
+// so we keep track of where we are in each stream on its own
+type outputStream struct {
+	writer                 io.Writer
+	expectedSequenceNumber int
+	lastAcked              int
+	outOfOrderMessages     map[int]smsg.StreamMessage
+}
+
+func newOutputStream(writer io.Writer) *outputStream {
+	// kubectl might not have asked for this stream at all
+	if writer == nil {
+		writer = ioutil.Discard
+	}
+
+	return &outputStream{
+		writer:                 writer,
+		expectedSequenceNumber: 0,
+		lastAcked:              -1,
+		outOfOrderMessages:     make(map[int]smsg.StreamMessage),
+	}
+}
+
+// Writes the message, and any we were holding onto because of it, to kubectl. Returns true once
+// we've reached the agent's end of stream message
+func (o *outputStream) push(message smsg.StreamMessage) (bool, error) {
+	// Check sequence number is correct, if not store it for later. The agent never has more than a window's
+	// worth in flight, so if we're holding onto more than that the one we're waiting on isn't coming
+	if message.SequenceNumber != o.expectedSequenceNumber {
+		if len(o.outOfOrderMessages) >= maxOutOfOrderMessages {
+			return false, fmt.Errorf("gave up waiting for exec message %d after receiving %d messages past it", o.expectedSequenceNumber, len(o.outOfOrderMessages))
+		}
+		o.outOfOrderMessages[message.SequenceNumber] = message
+		return false, nil
+	}
+
+	ok := true
+	for ok {
+		delete(o.outOfOrderMessages, o.expectedSequenceNumber)
+		o.expectedSequenceNumber++
+
+		contentBytes, _ := base64.StdEncoding.DecodeString(message.Content)
+		if string(contentBytes) == kubeexec.EscChar {
+			return true, nil
+		}
+		o.writer.Write(contentBytes)
+
+		// Process any existing messages that were recieved out of order
+		message, ok = o.outOfOrderMessages[o.expectedSequenceNumber]
+	}
+	return false, nil
+}
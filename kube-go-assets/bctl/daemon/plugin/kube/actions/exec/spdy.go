@@ -131,6 +131,33 @@ func NewSPDYService(logger *lggr.Logger, writer http.ResponseWriter, request *ht
 	}
 }
 
+func (s *SPDYService) Stdin() io.Reader {
+	return s.stdinStream
+}
+
+func (s *SPDYService) Stdout() io.Writer {
+	return s.stdoutStream
+}
+
+func (s *SPDYService) Stderr() io.Writer {
+	return s.stderrStream
+}
+
+func (s *SPDYService) Resize() io.Reader {
+	return s.resizeStream
+}
+
+func (s *SPDYService) WriteStatus(status *StatusError) error {
+	if s.writeStatus == nil {
+		return nil
+	}
+	return s.writeStatus(status)
+}
+
+func (s *SPDYService) Close() error {
+	return s.conn.Close()
+}
+
 func (s *SPDYService) waitForStreams(connContext context.Context,
 	streams <-chan streamAndReply,
 	expectedStreams int,
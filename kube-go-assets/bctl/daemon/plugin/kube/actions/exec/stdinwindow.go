@@ -0,0 +1,50 @@
+package exec
+
+import (
+	"context"
+	"sync"
+)
+
+// Keeps track of which stdin chunks the agent has yet to acknowledge, so that only the ack for a chunk we're
+// actually waiting on lets us send another one
+type stdinWindow struct {
+	slots chan struct{}
+
+	inFlight     map[int]bool
+	inFlightLock sync.Mutex
+}
+
+func newStdinWindow(size int) *stdinWindow {
+	return &stdinWindow{
+		slots:    make(chan struct{}, size),
+		inFlight: make(map[int]bool),
+	}
+}
+
+// Blocks until there's room for another chunk, returns false if ctx is done first
+func (w *stdinWindow) send(ctx context.Context, sequenceNumber int) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case w.slots <- struct{}{}:
+	}
+
+	w.inFlightLock.Lock()
+	defer w.inFlightLock.Unlock()
+
+	w.inFlight[sequenceNumber] = true
+	return true
+}
+
+// Returns false if we weren't waiting on an ack for this chunk, e.g. because the agent already acked it
+func (w *stdinWindow) ack(sequenceNumber int) bool {
+	w.inFlightLock.Lock()
+	defer w.inFlightLock.Unlock()
+
+	if !w.inFlight[sequenceNumber] {
+		return false
+	}
+	delete(w.inFlight, sequenceNumber)
+	<-w.slots
+	return true
+}
@@ -0,0 +1,221 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// The WebSocket subprotocols newer kubectl versions negotiate for exec and attach. v5 is the same as v4
+	// except that it adds a close channel so the client can signal it is done sending stdin
+	// Ref: https://github.com/kubernetes/enhancements/tree/master/keps/sig-api-machinery/4006-transition-spdy-to-websockets
+	WebSocketProtocolV5Name = "v5.channel.k8s.io"
+	WebSocketProtocolV4Name = "v4.channel.k8s.io"
+	WebSocketProtocolV3Name = "v3.channel.k8s.io"
+	WebSocketProtocolV2Name = "v2.channel.k8s.io"
+	WebSocketProtocolV1Name = "channel.k8s.io"
+
+	// Every WebSocket message is prefixed with a single byte that identifies the channel it belongs to
+	stdinChannel  byte = 0
+	stdoutChannel byte = 1
+	stderrChannel byte = 2
+	errorChannel  byte = 3
+	resizeChannel byte = 4
+	closeChannel  byte = 255
+
+	// How long we give kubectl to acknowledge our close message
+	closeGracePeriod = time.Second
+)
+
+type WebSocketService struct {
+	conn     *websocket.Conn
+	protocol string
+
+	// kubectl sends us stdin and resize messages over the same socket, so we demultiplex
+	// them into pipes that can be read just like their SPDY stream counterparts
+	stdinReader  *io.PipeReader
+	stdinWriter  *io.PipeWriter
+	resizeReader *io.PipeReader
+	resizeWriter *io.PipeWriter
+
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+
+	// Ref: https://github.com/gorilla/websocket/issues/119#issuecomment-198710015
+	writeLock sync.Mutex
+	closeOnce sync.Once
+
+	logger *lggr.Logger
+}
+
+// Writes anything it is given to a single WebSocket channel
+type channelWriter struct {
+	service *WebSocketService
+	channel byte
+}
+
+func NewWebSocketService(logger *lggr.Logger, writer http.ResponseWriter, request *http.Request) (*WebSocketService, error) {
+	// Extract the options of the exec
+	options := extractExecOptions(request)
+
+	logger.Info(fmt.Sprintf("Starting Exec for command: %s\n", options.Command))
+
+	// Upgrade the request, preferring the newest protocol kubectl supports
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{WebSocketProtocolV5Name, WebSocketProtocolV4Name, WebSocketProtocolV3Name, WebSocketProtocolV2Name, WebSocketProtocolV1Name},
+	}
+	conn, err := upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		// The upgrader is responsible for notifying the client of any errors that occurred during upgrading
+		return &WebSocketService{}, fmt.Errorf("unable to upgrade request: %s", err)
+	}
+
+	protocol := conn.Subprotocol()
+	if protocol == "" {
+		conn.Close()
+		return &WebSocketService{}, fmt.Errorf("kubectl did not negotiate a supported remote command protocol")
+	}
+	logger.Info(fmt.Sprintf("Using protocol: %s\n", protocol))
+
+	stdinReader, stdinWriter := io.Pipe()
+	resizeReader, resizeWriter := io.Pipe()
+
+	service := &WebSocketService{
+		conn:         conn,
+		protocol:     protocol,
+		stdinReader:  stdinReader,
+		stdinWriter:  stdinWriter,
+		resizeReader: resizeReader,
+		resizeWriter: resizeWriter,
+		logger:       logger,
+	}
+	service.stdoutWriter = &channelWriter{service: service, channel: stdoutChannel}
+	service.stderrWriter = &channelWriter{service: service, channel: stderrChannel}
+
+	// Let kubectl know we're ready by sending an empty message on the lowest writable channel
+	if err := service.writeChannel(stdoutChannel, []byte{}); err != nil {
+		conn.Close()
+		return &WebSocketService{}, fmt.Errorf("error notifying kubectl that exec is ready: %s", err)
+	}
+
+	go service.readLoop()
+
+	return service, nil
+}
+
+func (w *WebSocketService) Stdin() io.Reader {
+	return w.stdinReader
+}
+
+func (w *WebSocketService) Stdout() io.Writer {
+	return w.stdoutWriter
+}
+
+func (w *WebSocketService) Stderr() io.Writer {
+	return w.stderrWriter
+}
+
+func (w *WebSocketService) Resize() io.Reader {
+	return w.resizeReader
+}
+
+func (w *WebSocketService) WriteStatus(status *StatusError) error {
+	// Only v4 and above send the full status object, earlier versions only expect a message
+	var statusBytes []byte
+	switch w.protocol {
+	case WebSocketProtocolV5Name, WebSocketProtocolV4Name:
+		bs, err := json.Marshal(status.ErrStatus)
+		if err != nil {
+			return err
+		}
+		statusBytes = bs
+	default:
+		statusBytes = []byte(status.ErrStatus.Message)
+	}
+	return w.writeChannel(errorChannel, statusBytes)
+}
+
+func (w *WebSocketService) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		w.writeLock.Lock()
+		w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeGracePeriod))
+		w.writeLock.Unlock()
+
+		w.stdinWriter.Close()
+		w.resizeWriter.Close()
+		err = w.conn.Close()
+	})
+	return err
+}
+
+// Reads every message kubectl sends us and routes it to the right channel
+func (w *WebSocketService) readLoop() {
+	defer func() {
+		w.stdinWriter.Close()
+		w.resizeWriter.Close()
+	}()
+
+	for {
+		messageType, message, err := w.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				w.logger.Info(fmt.Sprintf("Exec websocket closed: %s", err))
+			}
+			return
+		}
+
+		if messageType != websocket.BinaryMessage || len(message) == 0 {
+			continue
+		}
+
+		channel, data := message[0], message[1:]
+		switch channel {
+		case stdinChannel:
+			if _, err := w.stdinWriter.Write(data); err != nil {
+				w.logger.Error(fmt.Errorf("error passing along stdin: %s", err))
+			}
+		case resizeChannel:
+			if _, err := w.resizeWriter.Write(data); err != nil {
+				w.logger.Error(fmt.Errorf("error passing along resize message: %s", err))
+			}
+		case closeChannel:
+			// Only v5 clients will send this, it means they won't be writing to the given channel anymore
+			if w.protocol == WebSocketProtocolV5Name && len(data) > 0 {
+				switch data[0] {
+				case stdinChannel:
+					w.stdinWriter.Close()
+				case resizeChannel:
+					w.resizeWriter.Close()
+				}
+			}
+		default:
+			w.logger.Info(fmt.Sprintf("Ignoring message on unexpected channel: %d", channel))
+		}
+	}
+}
+
+func (w *WebSocketService) writeChannel(channel byte, data []byte) error {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	return w.conn.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, data...))
+}
+
+func (c *channelWriter) Write(p []byte) (int, error) {
+	if err := c.service.writeChannel(c.channel, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func isWebSocketRequest(request *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(request)
+}
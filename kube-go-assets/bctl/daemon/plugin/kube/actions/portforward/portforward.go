@@ -0,0 +1,391 @@
+package portforward
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	kubeportforward "k8s.io/client-go/tools/portforward"
+
+	kubeportforwardaction "bastionzero.com/bctl/v1/bctl/agent/plugin/kube/actions/portforward"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+)
+
+const (
+	// Same as the kubelet's default streaming connection idle timeout
+	portForwardIdleTimeout = 4 * time.Hour
+
+	// Size of the buffer we read from kubectl with before sending it to the agent
+	streamBufferSize = 32 * 1024
+
+	// How many messages we'll hold on to while waiting for one that's gone missing, about 8MB of data
+	maxOutOfOrderMessages = 256
+)
+
+type PortForwardAction struct {
+	requestId         string
+	logId             string
+	commandBeingRun   string
+	ksResponseChannel chan plgn.ActionWrapper
+	RequestChannel    chan plgn.ActionWrapper
+	streamChannel     chan smsg.StreamMessage
+	rejectChannel     chan string
+	logger            *lggr.Logger
+	ctx               context.Context
+
+	// Every local connection kubectl accepts is identified by its own port forward request id
+	requests        map[string]*portForwardRequest
+	requestsMapLock sync.Mutex
+}
+
+type portForwardRequest struct {
+	podPort     int64
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+	dataWriter  *orderedWriter
+	errorWriter *orderedWriter
+}
+
+// Our agent sends us sequence numbered messages which might arrive out of order
+type orderedWriter struct {
+	writer                 io.WriteCloser
+	expectedSequenceNumber int
+	outOfOrderMessages     map[int]orderedMessage
+}
+
+type orderedMessage struct {
+	content     []byte
+	endOfStream bool
+}
+
+func NewPortForwardAction(ctx context.Context,
+	logger *lggr.Logger,
+	requestId string,
+	logId string,
+	ch chan plgn.ActionWrapper,
+	commandBeingRun string) (*PortForwardAction, error) {
+
+	return &PortForwardAction{
+		requestId:         requestId,
+		logId:             logId,
+		commandBeingRun:   commandBeingRun,
+		RequestChannel:    ch,
+		ksResponseChannel: make(chan plgn.ActionWrapper),
+		streamChannel:     make(chan smsg.StreamMessage, 100),
+		rejectChannel:     make(chan string, 1),
+		requests:          make(map[string]*portForwardRequest),
+		logger:            logger,
+		ctx:               ctx,
+	}, nil
+}
+
+func (p *PortForwardAction) InputMessageHandler(writer http.ResponseWriter, request *http.Request) error {
+	// Initiate a handshake and upgrade the request
+	supportedProtocols := []string{kubeportforward.PortForwardProtocolV1Name}
+	protocol, err := httpstream.Handshake(request, writer, supportedProtocols)
+	if err != nil {
+		rerr := fmt.Errorf("could not complete http stream handshake: %s", err)
+		p.logger.Error(rerr)
+		return rerr
+	}
+	p.logger.Info(fmt.Sprintf("Using protocol: %s", protocol))
+
+	// Every stream kubectl creates will come in through this channel
+	streamCh := make(chan httpstream.Stream, 100)
+	upgrader := spdy.NewResponseUpgrader()
+	conn := upgrader.UpgradeResponse(writer, request, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streamCh <- stream
+		return nil
+	})
+	if conn == nil {
+		// The upgrader is responsible for notifying the client of any errors that
+		// occurred during upgrading. All we can do is return here at this point
+		rerr := fmt.Errorf("unable to upgrade request")
+		p.logger.Error(rerr)
+		return rerr
+	}
+	conn.SetIdleTimeout(portForwardIdleTimeout)
+
+	// Now since we made our local connection to kubectl, initiate a connection with Bastion
+	p.RequestChannel <- wrapStartPayload(p.requestId, p.logId, request.URL.String(), p.commandBeingRun)
+
+	// Set up a go function to pair up the data and error streams that kubectl opens for each connection
+	go func() {
+		defer conn.Close()
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-conn.CloseChan():
+				p.logger.Info("Port forward connection closed by kubectl")
+				p.RequestChannel <- wrapStopPayload(p.requestId, p.logId)
+				return
+			case reason := <-p.rejectChannel:
+				// kubectl only sees its connection close, so this is as much as we can tell the user
+				p.logger.Error(fmt.Errorf("agent rejected port forward: %s", reason))
+				return
+			case stream := <-streamCh:
+				if err := p.handleNewStream(stream); err != nil {
+					p.logger.Error(err)
+					stream.Reset()
+				}
+			}
+		}
+	}()
+
+	// Set up a go function for all data and errors coming back from the pod
+	go func() {
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-conn.CloseChan():
+				return
+			case streamMessage := <-p.streamChannel:
+				if err := p.handleStreamMessage(streamMessage); err != nil {
+					p.logger.Error(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (p *PortForwardAction) handleNewStream(stream httpstream.Stream) error {
+	portForwardRequestId := stream.Headers().Get(v1.PortForwardRequestIDHeader)
+	if portForwardRequestId == "" {
+		return fmt.Errorf("port forward stream is missing the %s header", v1.PortForwardRequestIDHeader)
+	}
+
+	podPort, err := strconv.ParseInt(stream.Headers().Get(v1.PortHeader), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid port in port forward stream: %s", err)
+	}
+
+	p.requestsMapLock.Lock()
+	request, ok := p.requests[portForwardRequestId]
+	if !ok {
+		request = &portForwardRequest{
+			podPort: podPort,
+		}
+		p.requests[portForwardRequestId] = request
+	}
+
+	streamType := stream.Headers().Get(v1.StreamType)
+	switch streamType {
+	case v1.StreamTypeError:
+		request.errorStream = stream
+		request.errorWriter = newOrderedWriter(stream)
+	case v1.StreamTypeData:
+		request.dataStream = stream
+		request.dataWriter = newOrderedWriter(stream)
+	default:
+		p.requestsMapLock.Unlock()
+		return fmt.Errorf("unexpected port forward stream type: %q", streamType)
+	}
+	paired := request.dataStream != nil && request.errorStream != nil
+	p.requestsMapLock.Unlock()
+
+	// Once we have both halves we can ask the agent to open the same pair against the pod
+	if paired {
+		p.logger.Info(fmt.Sprintf("Starting port forward request %s for port %d", portForwardRequestId, podPort))
+		p.RequestChannel <- wrapRequestPayload(kubeportforwardaction.StartPortForwardRequest, p.requestId, p.logId, portForwardRequestId, podPort)
+
+		go p.forwardDataStream(portForwardRequestId, request)
+	}
+	return nil
+}
+
+// Reads everything kubectl sends us for a single connection and passes it along to the agent
+func (p *PortForwardAction) forwardDataStream(portForwardRequestId string, request *portForwardRequest) {
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := request.dataStream.Read(buf)
+		if n > 0 {
+			select {
+			case <-p.ctx.Done():
+				return
+			case p.RequestChannel <- wrapDataInPayload(p.requestId, p.logId, portForwardRequestId, buf[:n]):
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Info(fmt.Sprintf("Error reading port forward data stream: %s", err))
+			}
+			break
+		}
+	}
+
+	// The local connection is done, let the agent know and clean up after ourselves
+	p.RequestChannel <- wrapRequestPayload(kubeportforwardaction.StopPortForwardRequest, p.requestId, p.logId, portForwardRequestId, request.podPort)
+
+	p.requestsMapLock.Lock()
+	delete(p.requests, portForwardRequestId)
+	p.requestsMapLock.Unlock()
+
+	request.dataStream.Reset()
+	request.errorStream.Reset()
+}
+
+func (p *PortForwardAction) handleStreamMessage(streamMessage smsg.StreamMessage) error {
+	contentBytes, _ := base64.StdEncoding.DecodeString(streamMessage.Content)
+
+	var content kubeportforwardaction.KubePortForwardStreamMessageContent
+	if err := json.Unmarshal(contentBytes, &content); err != nil {
+		return fmt.Errorf("could not unmarshal port forward stream message: %s", err)
+	}
+
+	// Writing to kubectl can block, so we don't hold onto the lock while we do it. We're the only ones
+	// writing, so nobody else is using the writers
+	p.requestsMapLock.Lock()
+	request, ok := p.requests[content.PortForwardRequestId]
+	p.requestsMapLock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown port forward request ID: %s", content.PortForwardRequestId)
+	}
+
+	message := orderedMessage{
+		content:     content.Content,
+		endOfStream: content.EndOfStream,
+	}
+
+	var err error
+	switch smsg.StreamType(streamMessage.Type) {
+	case smsg.PortForwardData:
+		err = request.dataWriter.write(streamMessage.SequenceNumber, message)
+	case smsg.PortForwardError:
+		// kubectl reads its error stream until we close it, so the agent ends this one separately too
+		err = request.errorWriter.write(streamMessage.SequenceNumber, message)
+	default:
+		return fmt.Errorf("unhandled port forward stream type: %s", streamMessage.Type)
+	}
+
+	// Resetting kubectl's streams makes forwardDataStream stop the request on the agent and clean up after it
+	if err != nil {
+		request.dataStream.Reset()
+		request.errorStream.Reset()
+	}
+	return err
+}
+
+// The agent turned down our request, so let kubectl know why instead of waiting on it
+func (p *PortForwardAction) Reject(reason string) {
+	select {
+	case p.rejectChannel <- reason:
+	default:
+	}
+}
+
+func (p *PortForwardAction) PushKSResponse(wrappedAction plgn.ActionWrapper) {
+	p.ksResponseChannel <- wrappedAction
+}
+
+func (p *PortForwardAction) PushStreamResponse(stream smsg.StreamMessage) {
+	p.streamChannel <- stream
+}
+
+func newOrderedWriter(writer io.WriteCloser) *orderedWriter {
+	return &orderedWriter{
+		writer:                 writer,
+		expectedSequenceNumber: 0,
+		outOfOrderMessages:     make(map[int]orderedMessage),
+	}
+}
+
+func (o *orderedWriter) write(sequenceNumber int, message orderedMessage) error {
+	// Check sequence number is correct, if not store it for later
+	if sequenceNumber != o.expectedSequenceNumber {
+		if len(o.outOfOrderMessages) >= maxOutOfOrderMessages {
+			return fmt.Errorf("gave up waiting for port forward message %d after receiving %d messages past it", o.expectedSequenceNumber, len(o.outOfOrderMessages))
+		}
+		o.outOfOrderMessages[sequenceNumber] = message
+		return nil
+	}
+
+	// Process this message and any existing messages that were recieved out of order
+	for ok := true; ok; message, ok = o.outOfOrderMessages[o.expectedSequenceNumber] {
+		delete(o.outOfOrderMessages, o.expectedSequenceNumber)
+		o.expectedSequenceNumber++
+
+		if _, err := o.writer.Write(message.content); err != nil {
+			return fmt.Errorf("error writing to kubectl: %s", err)
+		}
+
+		// Closing our half of the stream is how kubectl knows the pod has hung up
+		if message.endOfStream {
+			return o.writer.Close()
+		}
+	}
+	return nil
+}
+
+func wrapStartPayload(requestId string, logId string, endpoint string, commandBeingRun string) plgn.ActionWrapper {
+	payload := kubeportforwardaction.KubePortForwardStartActionPayload{
+		RequestId:       requestId,
+		LogId:           logId,
+		Endpoint:        endpoint,
+		CommandBeingRun: commandBeingRun,
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	return plgn.ActionWrapper{
+		Action:        string(kubeportforwardaction.StartPortForward),
+		ActionPayload: payloadBytes,
+	}
+}
+
+func wrapRequestPayload(action kubeportforwardaction.PortForwardSubAction, requestId string, logId string, portForwardRequestId string, podPort int64) plgn.ActionWrapper {
+	payload := kubeportforwardaction.KubePortForwardRequestActionPayload{
+		RequestId:            requestId,
+		LogId:                logId,
+		PortForwardRequestId: portForwardRequestId,
+		PodPort:              podPort,
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	return plgn.ActionWrapper{
+		Action:        string(action),
+		ActionPayload: payloadBytes,
+	}
+}
+
+func wrapDataInPayload(requestId string, logId string, portForwardRequestId string, data []byte) plgn.ActionWrapper {
+	payload := kubeportforwardaction.KubePortForwardDataInActionPayload{
+		RequestId:            requestId,
+		LogId:                logId,
+		PortForwardRequestId: portForwardRequestId,
+		Data:                 data,
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	return plgn.ActionWrapper{
+		Action:        string(kubeportforwardaction.DataInPortForward),
+		ActionPayload: payloadBytes,
+	}
+}
+
+func wrapStopPayload(requestId string, logId string) plgn.ActionWrapper {
+	payload := kubeportforwardaction.KubePortForwardStopActionPayload{
+		RequestId: requestId,
+		LogId:     logId,
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	return plgn.ActionWrapper{
+		Action:        string(kubeportforwardaction.StopPortForward),
+		ActionPayload: payloadBytes,
+	}
+}
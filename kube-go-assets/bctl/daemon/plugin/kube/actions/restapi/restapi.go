@@ -24,6 +24,7 @@ type RestApiAction struct {
 	RequestChannel        chan plgn.ActionWrapper
 	commandBeingRun       string
 	streamResponseChannel chan smsg.StreamMessage
+	rejectChannel         chan string
 	logger                *lggr.Logger
 	ctx                   context.Context
 }
@@ -42,6 +43,7 @@ func NewRestApiAction(ctx context.Context,
 		RequestChannel:        ch,
 		ksResponseChannel:     make(chan plgn.ActionWrapper),
 		streamResponseChannel: make(chan smsg.StreamMessage, 100),
+		rejectChannel:         make(chan string, 1),
 		commandBeingRun:       commandBeingRun,
 		logger:                logger,
 		ctx:                   ctx,
@@ -79,6 +81,11 @@ func (r *RestApiAction) InputMessageHandler(writer http.ResponseWriter, request
 	select {
 	case <-r.ctx.Done():
 		return nil
+	case reason := <-r.rejectChannel:
+		rerr := fmt.Errorf("agent rejected request: %s", reason)
+		r.logger.Error(rerr)
+		http.Error(writer, reason, http.StatusTooManyRequests)
+		return rerr
 	case rsp := <-r.ksResponseChannel:
 		var apiResponse kuberest.KubeRestApiActionResponsePayload
 		if err := json.Unmarshal(rsp.ActionPayload, &apiResponse); err != nil {
@@ -110,6 +117,14 @@ func (r *RestApiAction) InputMessageHandler(writer http.ResponseWriter, request
 	return nil
 }
 
+// The agent turned down our request, so let kubectl know why instead of waiting on it
+func (r *RestApiAction) Reject(reason string) {
+	select {
+	case r.rejectChannel <- reason:
+	default:
+	}
+}
+
 func (r *RestApiAction) PushKSResponse(wrappedAction plgn.ActionWrapper) {
 	r.ksResponseChannel <- wrappedAction
 }
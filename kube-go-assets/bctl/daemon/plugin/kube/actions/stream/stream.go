@@ -25,6 +25,7 @@ type StreamAction struct {
 	ksResponseChannel      chan plgn.ActionWrapper
 	RequestChannel         chan plgn.ActionWrapper
 	streamResponseChannel  chan smsg.StreamMessage
+	rejectChannel          chan string
 	logger                 *lggr.Logger
 	ctx                    context.Context
 	commandBeingRun        string
@@ -46,6 +47,7 @@ func NewStreamAction(ctx context.Context,
 		RequestChannel:        ch,
 		ksResponseChannel:     make(chan plgn.ActionWrapper, 100),
 		streamResponseChannel: make(chan smsg.StreamMessage, 100),
+		rejectChannel:         make(chan string, 1),
 		logger:                logger,
 		ctx:                   ctx,
 		commandBeingRun:       commandBeingRun,
@@ -95,6 +97,10 @@ outOfOrderMessageHandler:
 		select {
 		case <-s.ctx.Done():
 			return nil
+		case reason := <-s.rejectChannel:
+			s.logger.Error(fmt.Errorf("agent rejected stream: %s", reason))
+			http.Error(writer, reason, http.StatusTooManyRequests)
+			return nil
 		case watchData := <-s.streamResponseChannel:
 			contentBytes, _ := base64.StdEncoding.DecodeString(watchData.Content)
 
@@ -168,6 +174,14 @@ outOfOrderMessageHandler:
 	}
 }
 
+// The agent turned down our request, so let kubectl know why instead of waiting on it
+func (s *StreamAction) Reject(reason string) {
+	select {
+	case s.rejectChannel <- reason:
+	default:
+	}
+}
+
 func (s *StreamAction) PushKSResponse(wrappedAction plgn.ActionWrapper) {
 	s.ksResponseChannel <- wrappedAction
 }
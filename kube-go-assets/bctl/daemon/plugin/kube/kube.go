@@ -11,6 +11,7 @@ import (
 	"sync"
 
 	exec "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube/actions/exec"
+	portforward "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube/actions/portforward"
 	rest "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube/actions/restapi"
 	stream "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube/actions/stream"
 	kubeutils "bastionzero.com/bctl/v1/bctl/daemon/plugin/kube/utils"
@@ -35,9 +36,10 @@ type JustRequestId struct {
 type KubeDaemonAction string
 
 const (
-	Exec    KubeDaemonAction = "exec"
-	Stream  KubeDaemonAction = "stream"
-	RestApi KubeDaemonAction = "restapi"
+	Exec        KubeDaemonAction = "exec"
+	Stream      KubeDaemonAction = "stream"
+	RestApi     KubeDaemonAction = "restapi"
+	PortForward KubeDaemonAction = "portforward"
 )
 
 // Perhaps unnecessary but it is nice to make sure that each action is implementing a common function set
@@ -45,6 +47,7 @@ type IKubeDaemonAction interface {
 	InputMessageHandler(writer http.ResponseWriter, request *http.Request) error
 	PushKSResponse(actionWrapper plgn.ActionWrapper)
 	PushStreamResponse(streamMessage smsg.StreamMessage)
+	Reject(reason string)
 }
 
 type KubeDaemonPlugin struct {
@@ -147,13 +150,22 @@ func (k *KubeDaemonPlugin) GetName() plgn.PluginName {
 }
 
 func (k *KubeDaemonPlugin) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	if err := k.PushActionResponse(action, actionPayload); err != nil {
+		return "", []byte{}, err
+	}
+
+	return k.WaitForRequest(k.ctx)
+}
+
+// Passes along the response to a request we've previously sent to the action that sent it
+func (k *KubeDaemonPlugin) PushActionResponse(action string, actionPayload []byte) error {
 	if len(actionPayload) > 0 {
 		// Get just the request ID so we can associate it with the previously started action object
 		var d JustRequestId
 		if err := json.Unmarshal(actionPayload, &d); err != nil {
 			rerr := fmt.Errorf("could not unmarshal json: %s", err)
 			k.logger.Error(rerr)
-			return "", []byte{}, rerr
+			return rerr
 		} else {
 			if act, ok := k.getActionsMap(d.RequestId); ok {
 				wrappedAction := plgn.ActionWrapper{
@@ -164,14 +176,27 @@ func (k *KubeDaemonPlugin) InputMessageHandler(action string, actionPayload []by
 			} else {
 				rerr := fmt.Errorf("unknown request ID: %v", d.RequestId)
 				k.logger.Error(rerr)
-				return "", []byte{}, rerr
+				return rerr
 			}
 		}
 	}
+	return nil
+}
 
+// The agent turned down one of our requests, everything else we have going is unaffected
+func (k *KubeDaemonPlugin) RejectRequest(requestId string, reason string) {
+	if act, ok := k.getActionsMap(requestId); ok {
+		act.Reject(reason)
+	} else {
+		k.logger.Error(fmt.Errorf("agent rejected unknown request ID: %v", requestId))
+	}
+}
+
+// Blocks until one of our actions has a request for the agent or the context is done
+func (k *KubeDaemonPlugin) WaitForRequest(ctx context.Context) (string, []byte, error) {
 	k.logger.Info("Waiting for input...")
 	select {
-	case <-k.ctx.Done():
+	case <-ctx.Done():
 		return "", []byte{}, nil
 	case actionMessage := <-k.RequestChannel:
 		msg := fmt.Sprintf("Received input from action: %v", actionMessage.Action)
@@ -243,6 +268,18 @@ func (k *KubeDaemonPlugin) rootCallback(w http.ResponseWriter, r *http.Request)
 		if err := execAction.InputMessageHandler(w, r); err != nil {
 			k.logger.Error(fmt.Errorf("error handling Exec call: %s", err))
 		}
+	} else if strings.HasSuffix(r.URL.Path, "/portforward") {
+		subLogger := k.logger.GetActionLogger(string(PortForward))
+		subLogger.AddRequestId(requestId)
+
+		portForwardAction, _ := portforward.NewPortForwardAction(k.ctx, subLogger, requestId, logId, k.RequestChannel, commandBeingRun)
+
+		k.updateActionsMap(portForwardAction, requestId)
+
+		k.logger.Info(fmt.Sprintf("Created Port Forward action with requestId %v", requestId))
+		if err := portForwardAction.InputMessageHandler(w, r); err != nil {
+			k.logger.Error(fmt.Errorf("error handling Port Forward call: %s", err))
+		}
 	} else if isStreamRequest(r) {
 		subLogger := k.logger.GetActionLogger(string(Stream))
 		subLogger.AddRequestId(requestId)
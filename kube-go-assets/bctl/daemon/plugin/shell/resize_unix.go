@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// Calls onResize with the new size every time the terminal is resized
+func watchTerminalSize(ctx context.Context, fd int, onResize func(width int, height int)) {
+	resizeChannel := make(chan os.Signal, 1)
+	signal.Notify(resizeChannel, syscall.SIGWINCH)
+	defer signal.Stop(resizeChannel)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resizeChannel:
+			if width, height, err := term.GetSize(fd); err == nil {
+				onResize(width, height)
+			}
+		}
+	}
+}
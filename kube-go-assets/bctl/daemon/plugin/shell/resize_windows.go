@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package shell
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	// Windows doesn't let us know when the console is resized, so we have to check
+	resizePollInterval = 250 * time.Millisecond
+)
+
+// Calls onResize with the new size every time the terminal is resized
+func watchTerminalSize(ctx context.Context, fd int, onResize func(width int, height int)) {
+	lastWidth, lastHeight, _ := term.GetSize(fd)
+
+	ticker := time.NewTicker(resizePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if width, height, err := term.GetSize(fd); err == nil && (width != lastWidth || height != lastHeight) {
+				lastWidth, lastHeight = width, height
+				onResize(width, height)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package shell
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/term"
+
+	shellaction "bastionzero.com/bctl/v1/bctl/agent/plugin/shell"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Size of the buffer we read the user's terminal with before sending it to the agent
+	stdinBufferSize = 4 * 1024
+)
+
+// Connects the terminal the daemon is running in to a shell on the agent's host. Unlike our other plugins
+// this one runs in the foreground, so once the shell is gone the daemon exits with it
+type ShellDaemonPlugin struct {
+	requestId string
+	logId     string
+
+	// Input and output streams
+	streamResponseChannel chan smsg.StreamMessage
+	RequestChannel        chan plgn.ActionWrapper
+
+	// Done channel to bubble up error to the user
+	DoneChannel chan string
+
+	// The agent sends us sequence numbered messages which might arrive out of order
+	expectedSequenceNumber int
+	outOfOrderMessages     map[int]smsg.StreamMessage
+
+	stdin         *os.File
+	stdout        io.Writer
+	terminalState *term.State
+	exitOnce      sync.Once
+
+	logger *lggr.Logger
+	ctx    context.Context
+}
+
+func NewShellDaemonPlugin(ctx context.Context, logger *lggr.Logger, doneChannel chan string) (*ShellDaemonPlugin, error) {
+	plugin := ShellDaemonPlugin{
+		requestId:              uuid.New().String(),
+		logId:                  uuid.New().String(),
+		streamResponseChannel:  make(chan smsg.StreamMessage, 100),
+		RequestChannel:         make(chan plgn.ActionWrapper, 100),
+		DoneChannel:            doneChannel,
+		expectedSequenceNumber: 0,
+		outOfOrderMessages:     make(map[int]smsg.StreamMessage),
+		stdin:                  os.Stdin,
+		stdout:                 os.Stdout,
+		logger:                 logger,
+		ctx:                    ctx,
+	}
+
+	// Everything the user types has to go straight to the remote shell, including things like ctrl-c
+	width, height := 0, 0
+	if fd := int(plugin.stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return &ShellDaemonPlugin{}, fmt.Errorf("could not put terminal into raw mode: %s", err)
+		}
+		plugin.terminalState = state
+
+		if width, height, err = term.GetSize(fd); err != nil {
+			logger.Error(fmt.Errorf("could not get terminal size: %s", err))
+		}
+	}
+
+	plugin.sendRequest(shellaction.OpenShell, shellaction.ShellOpenActionPayload{
+		RequestId:  plugin.requestId,
+		LogId:      plugin.logId,
+		TerminalId: os.Getenv("TERM"),
+		Width:      uint16(width),
+		Height:     uint16(height),
+	})
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case streamMessage := <-plugin.streamResponseChannel:
+				if err := plugin.handleStreamMessage(streamMessage); err != nil {
+					plugin.logger.Error(err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case doneMessage := <-plugin.DoneChannel:
+			plugin.exit(1, fmt.Sprintf("Connection closed by Bastion: %s", doneMessage))
+		}
+	}()
+
+	go plugin.readStdin()
+
+	if plugin.terminalState != nil {
+		go watchTerminalSize(ctx, int(plugin.stdin.Fd()), plugin.resize)
+	}
+
+	return &plugin, nil
+}
+
+func (s *ShellDaemonPlugin) GetName() plgn.PluginName {
+	return plgn.ShellDaemon
+}
+
+func (s *ShellDaemonPlugin) PushStreamInput(smessage smsg.StreamMessage) error {
+	s.streamResponseChannel <- smessage
+	return nil
+}
+
+func (s *ShellDaemonPlugin) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	if err := s.PushActionResponse(action, actionPayload); err != nil {
+		return "", []byte{}, err
+	}
+
+	return s.WaitForRequest(s.ctx)
+}
+
+// Our agent sends us everything about the shell through its stream, so there's nothing to do here
+func (s *ShellDaemonPlugin) PushActionResponse(action string, actionPayload []byte) error {
+	return nil
+}
+
+// Our only request is the shell, so if the agent turns it down there's nothing left for us to do
+func (s *ShellDaemonPlugin) RejectRequest(requestId string, reason string) {
+	s.exit(1, fmt.Sprintf("Could not open shell: %s", reason))
+}
+
+// Blocks until the user has done something the agent needs to know about or the context is done
+func (s *ShellDaemonPlugin) WaitForRequest(ctx context.Context) (string, []byte, error) {
+	select {
+	case <-ctx.Done():
+		return "", []byte{}, nil
+	case actionMessage := <-s.RequestChannel:
+		actionPayloadBytes, _ := json.Marshal(actionMessage.ActionPayload)
+		return actionMessage.Action, actionPayloadBytes, nil
+	}
+}
+
+func (s *ShellDaemonPlugin) readStdin() {
+	buf := make([]byte, stdinBufferSize)
+	for {
+		n, err := s.stdin.Read(buf)
+		if n > 0 {
+			// Copy what we read since our buffer gets reused before the message is sent
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			s.sendRequest(shellaction.ShellInput, shellaction.ShellInputActionPayload{
+				RequestId: s.requestId,
+				LogId:     s.logId,
+				Stdin:     data,
+			})
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Error(fmt.Errorf("error reading from terminal: %s", err))
+			}
+			break
+		}
+	}
+
+	// Nothing left for the shell to read, so there's no reason to keep it around
+	s.sendRequest(shellaction.CloseShell, shellaction.ShellCloseActionPayload{
+		RequestId: s.requestId,
+		LogId:     s.logId,
+	})
+}
+
+func (s *ShellDaemonPlugin) resize(width int, height int) {
+	s.sendRequest(shellaction.ShellResize, shellaction.ShellResizeActionPayload{
+		RequestId: s.requestId,
+		LogId:     s.logId,
+		Width:     uint16(width),
+		Height:    uint16(height),
+	})
+}
+
+func (s *ShellDaemonPlugin) sendRequest(action shellaction.ShellSubAction, payload interface{}) {
+	payloadBytes, _ := json.Marshal(payload)
+	select {
+	case <-s.ctx.Done():
+	case s.RequestChannel <- plgn.ActionWrapper{Action: string(action), ActionPayload: payloadBytes}:
+	}
+}
+
+func (s *ShellDaemonPlugin) handleStreamMessage(streamMessage smsg.StreamMessage) error {
+	if streamMessage.RequestId != s.requestId {
+		return fmt.Errorf("unknown request ID: %v", streamMessage.RequestId)
+	}
+
+	// Check sequence number is correct, if not store it for later
+	if streamMessage.SequenceNumber != s.expectedSequenceNumber {
+		s.outOfOrderMessages[streamMessage.SequenceNumber] = streamMessage
+		return nil
+	}
+
+	for {
+		contentBytes, _ := base64.StdEncoding.DecodeString(streamMessage.Content)
+
+		switch smsg.StreamType(streamMessage.Type) {
+		case smsg.ShellStdOut:
+			if _, err := s.stdout.Write(contentBytes); err != nil {
+				s.logger.Error(fmt.Errorf("error writing to terminal: %s", err))
+			}
+		case smsg.ShellQuit:
+			exitCode, _ := strconv.Atoi(string(contentBytes))
+			s.exit(exitCode, "")
+			return nil
+		default:
+			return fmt.Errorf("unhandled shell stream type: %s", streamMessage.Type)
+		}
+		s.expectedSequenceNumber++
+
+		// Process any existing messages that were recieved out of order
+		next, ok := s.outOfOrderMessages[s.expectedSequenceNumber]
+		if !ok {
+			return nil
+		}
+		delete(s.outOfOrderMessages, s.expectedSequenceNumber)
+		streamMessage = next
+	}
+}
+
+// Gives the user their terminal back and exits with the same code as the remote shell
+func (s *ShellDaemonPlugin) exit(exitCode int, message string) {
+	s.exitOnce.Do(func() {
+		if s.terminalState != nil {
+			term.Restore(int(s.stdin.Fd()), s.terminalState)
+		}
+		if message != "" {
+			fmt.Fprintln(os.Stderr, message)
+		}
+
+		s.logger.Info(fmt.Sprintf("Shell exited with code %d", exitCode))
+		os.Exit(exitCode)
+	})
+}
@@ -0,0 +1,277 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	tunnelaction "bastionzero.com/bctl/v1/bctl/agent/plugin/tunnel"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+	plgn "bastionzero.com/bctl/v1/bzerolib/plugin"
+	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Size of the buffer we read local connections with before sending it to the agent
+	tunnelBufferSize = 32 * 1024
+)
+
+// Accepts local TCP connections and forwards each one to the same host and port inside the cluster network
+type TunnelDaemonPlugin struct {
+	localPort  string
+	targetHost string
+	targetPort int
+	logId      string
+
+	// Input and output streams
+	streamResponseChannel chan smsg.StreamMessage
+	RequestChannel        chan plgn.ActionWrapper
+
+	// Done channel to bubble up error to the user
+	DoneChannel chan string
+
+	connections     map[string]*tunnelConnection
+	connectionsLock sync.Mutex
+
+	logger *lggr.Logger
+	ctx    context.Context
+}
+
+// A single local connection, the agent sends us sequence numbered messages which might arrive out of order
+type tunnelConnection struct {
+	conn                   net.Conn
+	expectedSequenceNumber int
+	outOfOrderMessages     map[int]smsg.StreamMessage
+}
+
+func NewTunnelDaemonPlugin(ctx context.Context,
+	logger *lggr.Logger,
+	localPort string,
+	targetHost string,
+	targetPort int,
+	doneChannel chan string) (*TunnelDaemonPlugin, error) {
+
+	plugin := TunnelDaemonPlugin{
+		localPort:             localPort,
+		targetHost:            targetHost,
+		targetPort:            targetPort,
+		logId:                 uuid.New().String(),
+		streamResponseChannel: make(chan smsg.StreamMessage, 100),
+		RequestChannel:        make(chan plgn.ActionWrapper, 100),
+		DoneChannel:           doneChannel,
+		connections:           make(map[string]*tunnelConnection),
+		logger:                logger,
+		ctx:                   ctx,
+	}
+
+	// Only accept connections from this machine, everyone else has to go through their own daemon
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", localPort))
+	if err != nil {
+		return &TunnelDaemonPlugin{}, fmt.Errorf("could not listen on local port %s: %s", localPort, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case streamMessage := <-plugin.streamResponseChannel:
+				if err := plugin.handleStreamMessage(streamMessage); err != nil {
+					plugin.logger.Error(err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case doneMessage := <-plugin.DoneChannel:
+				plugin.logger.Info(fmt.Sprintf("Closing tunnel: %s", doneMessage))
+				listener.Close()
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					plugin.logger.Error(fmt.Errorf("stopped accepting tunnel connections: %s", err))
+				}
+				return
+			}
+			go plugin.handleConnection(conn)
+		}
+	}()
+
+	return &plugin, nil
+}
+
+func (t *TunnelDaemonPlugin) GetName() plgn.PluginName {
+	return plgn.TunnelDaemon
+}
+
+func (t *TunnelDaemonPlugin) PushStreamInput(smessage smsg.StreamMessage) error {
+	t.streamResponseChannel <- smessage
+	return nil
+}
+
+func (t *TunnelDaemonPlugin) InputMessageHandler(action string, actionPayload []byte) (string, []byte, error) {
+	if err := t.PushActionResponse(action, actionPayload); err != nil {
+		return "", []byte{}, err
+	}
+
+	return t.WaitForRequest(t.ctx)
+}
+
+// Our agent lets us know about anything that happens to a connection through its stream, so there's nothing to do here
+func (t *TunnelDaemonPlugin) PushActionResponse(action string, actionPayload []byte) error {
+	return nil
+}
+
+// The agent turned down one of our connections, so we hang up on whoever opened it
+func (t *TunnelDaemonPlugin) RejectRequest(requestId string, reason string) {
+	t.connectionsLock.Lock()
+	connection, ok := t.connections[requestId]
+	delete(t.connections, requestId)
+	t.connectionsLock.Unlock()
+
+	if ok {
+		t.logger.Error(fmt.Errorf("agent rejected tunnel connection %s: %s", requestId, reason))
+		connection.conn.Close()
+	}
+}
+
+// Blocks until one of our connections has something for the agent or the context is done
+func (t *TunnelDaemonPlugin) WaitForRequest(ctx context.Context) (string, []byte, error) {
+	select {
+	case <-ctx.Done():
+		return "", []byte{}, nil
+	case actionMessage := <-t.RequestChannel:
+		actionPayloadBytes, _ := json.Marshal(actionMessage.ActionPayload)
+		return actionMessage.Action, actionPayloadBytes, nil
+	}
+}
+
+func (t *TunnelDaemonPlugin) handleConnection(conn net.Conn) {
+	requestId := uuid.New().String()
+	t.logger.Info(fmt.Sprintf("Accepted tunnel connection %s from %s", requestId, conn.RemoteAddr()))
+
+	t.connectionsLock.Lock()
+	t.connections[requestId] = &tunnelConnection{
+		conn:                   conn,
+		expectedSequenceNumber: 0,
+		outOfOrderMessages:     make(map[int]smsg.StreamMessage),
+	}
+	t.connectionsLock.Unlock()
+
+	t.sendRequest(tunnelaction.OpenTunnel, tunnelaction.TunnelOpenActionPayload{
+		RequestId: requestId,
+		LogId:     t.logId,
+		Host:      t.targetHost,
+		Port:      t.targetPort,
+	})
+
+	buf := make([]byte, tunnelBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			// Copy what we read since our buffer gets reused before the message is sent
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			t.sendRequest(tunnelaction.DataInTunnel, tunnelaction.TunnelDataInActionPayload{
+				RequestId: requestId,
+				LogId:     t.logId,
+				Data:      data,
+			})
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				t.logger.Info(fmt.Sprintf("Error reading from tunnel connection %s: %s", requestId, err))
+			}
+			break
+		}
+	}
+
+	// We're done sending, the connection gets closed once the agent tells us the target is done too
+	t.sendRequest(tunnelaction.CloseTunnel, tunnelaction.TunnelCloseActionPayload{
+		RequestId: requestId,
+		LogId:     t.logId,
+	})
+}
+
+func (t *TunnelDaemonPlugin) sendRequest(action tunnelaction.TunnelSubAction, payload interface{}) {
+	payloadBytes, _ := json.Marshal(payload)
+	select {
+	case <-t.ctx.Done():
+	case t.RequestChannel <- plgn.ActionWrapper{Action: string(action), ActionPayload: payloadBytes}:
+	}
+}
+
+func (t *TunnelDaemonPlugin) handleStreamMessage(streamMessage smsg.StreamMessage) error {
+	// Writing to a local connection can block, so we don't hold onto the lock while we do it. We're the only
+	// ones handling stream messages, so nobody else is using the connection's ordering state
+	t.connectionsLock.Lock()
+	connection, ok := t.connections[streamMessage.RequestId]
+	t.connectionsLock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown tunnel connection: %s", streamMessage.RequestId)
+	}
+
+	// Check sequence number is correct, if not store it for later
+	if streamMessage.SequenceNumber != connection.expectedSequenceNumber {
+		connection.outOfOrderMessages[streamMessage.SequenceNumber] = streamMessage
+		return nil
+	}
+
+	for {
+		contentBytes, _ := base64.StdEncoding.DecodeString(streamMessage.Content)
+
+		switch smsg.StreamType(streamMessage.Type) {
+		case smsg.TunnelData:
+			if _, err := connection.conn.Write(contentBytes); err != nil {
+				t.logger.Info(fmt.Sprintf("Error writing to tunnel connection %s: %s", streamMessage.RequestId, err))
+			}
+		case smsg.TunnelClose:
+			if len(contentBytes) > 0 {
+				t.logger.Error(fmt.Errorf("agent closed tunnel connection %s: %s", streamMessage.RequestId, contentBytes))
+			} else {
+				t.logger.Info(fmt.Sprintf("Tunnel connection %s closed", streamMessage.RequestId))
+			}
+			connection.conn.Close()
+
+			t.connectionsLock.Lock()
+			delete(t.connections, streamMessage.RequestId)
+			t.connectionsLock.Unlock()
+			return nil
+		default:
+			return fmt.Errorf("unhandled tunnel stream type: %s", streamMessage.Type)
+		}
+		connection.expectedSequenceNumber++
+
+		// Process any existing messages that were recieved out of order
+		next, ok := connection.outOfOrderMessages[connection.expectedSequenceNumber]
+		if !ok {
+			return nil
+		}
+		delete(connection.outOfOrderMessages, connection.expectedSequenceNumber)
+		streamMessage = next
+	}
+}
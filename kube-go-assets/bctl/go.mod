@@ -6,7 +6,12 @@ replace bastionzero.com/bctl/v1/bzerolib => ../bzerolib
 
 require (
 	bastionzero.com/bctl/v1/bzerolib v0.0.0
+	github.com/creack/pty v1.1.11
 	github.com/google/uuid v1.1.2
+	github.com/gorilla/websocket v1.4.2
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	golang.org/x/term v0.0.0-20210220032956-6a3ed077a48d
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 	k8s.io/api v0.21.3
 	k8s.io/apimachinery v0.21.3
 	k8s.io/client-go v0.21.3
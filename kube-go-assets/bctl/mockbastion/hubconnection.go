@@ -0,0 +1,86 @@
+package mockbastion
+
+import (
+	"sync"
+	"time"
+
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
+
+	"github.com/gorilla/websocket"
+)
+
+// A single client's websocket connection to one of our hubs
+type hubConnection struct {
+	id     string
+	hub    string
+	params map[string]string // the query params the client negotiated with
+
+	conn *websocket.Conn
+
+	// Whichever SignalR protocol the client asked for in its handshake
+	protocol ws.IHubProtocol
+
+	// Ref: https://github.com/gorilla/websocket/issues/119#issuecomment-198710015
+	writeLock sync.Mutex
+
+	// If set, we act like the connection has gone dead without closing it
+	silenced bool
+}
+
+func (h *hubConnection) send(target string, agentMessage wsmsg.AgentMessage) error {
+	signalRMessage := wsmsg.SignalRWrapper{
+		Target:    target,
+		Type:      signalRTypeNumber,
+		Arguments: []wsmsg.AgentMessage{agentMessage},
+	}
+
+	if msgBytes, err := h.protocol.Encode(signalRMessage); err != nil {
+		return err
+	} else {
+		return h.write(h.protocol.FrameType(), msgBytes)
+	}
+}
+
+// Our clients don't start sending until we tell them we're ready for them
+func (h *hubConnection) sendReady() error {
+	return h.send(readyTarget, wsmsg.AgentMessage{})
+}
+
+func (h *hubConnection) write(frameType int, frame []byte) error {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	if h.silenced {
+		return nil
+	}
+	return h.conn.WriteMessage(frameType, frame)
+}
+
+func (h *hubConnection) writeControl(frameType int, data []byte) error {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	if h.silenced {
+		return nil
+	}
+	return h.conn.WriteControl(frameType, data, time.Now().Add(time.Second))
+}
+
+func (h *hubConnection) silence() {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	h.silenced = true
+}
+
+func (h *hubConnection) isSilenced() bool {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	return h.silenced
+}
+
+func (h *hubConnection) close() {
+	h.conn.Close()
+}
@@ -0,0 +1,662 @@
+/*
+This package is a stand-in for Bastion that runs in-process, so the daemon and agent can be pointed at it
+instead of a real deployment. It serves the SignalR negotiate endpoints for every hub, the agent's challenge
+and registration endpoints, and relays messages between a daemon and the agent datachannel paired with it
+the same way Bastion does. Every message a client sends is recorded so tests can wait on it, and tests can
+inject messages of their own to drive one side without the other.
+
+Like Bastion, we only serve TLS. Clients have to trust our CA with ws.ConfigureTransport before connecting.
+*/
+package mockbastion
+
+import (
+	"context"
+	ed "crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	cc "bastionzero.com/bctl/v1/bctl/agent/controlchannel"
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	DaemonHubEndpoint       = "/api/v1/hub/kube"
+	ControlHubEndpoint      = "/api/v1/hub/kube-control"
+	DatachannelHubEndpoint  = "/api/v1/hub/kube-server"
+	challengeEndpoint       = "/api/v1/kube/get-challenge"
+	registerEndpoint        = "/api/v1/kube/register-agent"
+	negotiateEndpointSuffix = "/negotiate"
+
+	// SignalR
+	signalRTypeNumber      = 1
+	signalRCloseTypeNumber = 7
+
+	// Targets our clients treat specially
+	readyTarget = "ReadyBastionToClient"
+	closeTarget = "CloseConnection"
+
+	// Target we use when asking the agent to open a new datachannel
+	newDatachannelTarget = "NewDatachannelBastionToCluster"
+)
+
+// A message one of our clients sent us along with where it came from
+type RecordedMessage struct {
+	Hub          string // which of the hub endpoints the client is connected to
+	ConnectionId string
+	Target       string
+	Message      wsmsg.AgentMessage
+}
+
+type MockBastion struct {
+	// What to give the daemon and agent as their service url
+	ServiceUrl string
+
+	// The PEM encoded CA our certificate is signed with, for clients' TransportConfig
+	CaFile string
+
+	// If set, daemons have to send this as their Authorization header
+	AuthHeader string
+
+	// If set, we turn down clients that ask for MessagePack like an older Bastion would
+	DisableMessagePack bool
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	lock sync.Mutex
+
+	// Connections we've negotiated but haven't been upgraded to websockets yet, by connection id
+	negotiated map[string]negotiation
+
+	controlChannels map[string]*hubConnection
+	daemons         map[string]*hubConnection
+	seenDaemons     map[string]bool           // the daemons we've already returned from WaitForDaemon
+	datachannels    map[string]*hubConnection // by the connection id of the daemon they were opened for
+
+	// Daemons that reconnect with the same session id go back to the agent datachannel they had before
+	sessions      map[string]string // session id to the daemon connection id its datachannel was opened for
+	pairings      map[string]string // daemon connection id to the connection id its datachannel was opened for
+	pairedDaemons map[string]string // the reverse of pairings, for whichever daemon is connected now
+
+	// Messages from daemons that don't have an agent datachannel to go to yet
+	pending map[string][]pendingMessage
+
+	challenges    map[string]bool
+	registrations []cc.RegisterAgentMessage
+
+	// Everything our clients have sent us
+	messages []RecordedMessage
+
+	// Why our clients said they were going away, by connection id
+	closeReasons map[string]string
+
+	// Gets closed and replaced every time a client connects or sends us something
+	updated chan struct{}
+}
+
+type pendingMessage struct {
+	target  string
+	message wsmsg.AgentMessage
+}
+
+type negotiation struct {
+	hub    string
+	params map[string]string
+}
+
+func New() (*MockBastion, error) {
+	m := &MockBastion{
+		negotiated:      make(map[string]negotiation),
+		controlChannels: make(map[string]*hubConnection),
+		daemons:         make(map[string]*hubConnection),
+		seenDaemons:     make(map[string]bool),
+		datachannels:    make(map[string]*hubConnection),
+		sessions:        make(map[string]string),
+		pairings:        make(map[string]string),
+		pairedDaemons:   make(map[string]string),
+		pending:         make(map[string][]pendingMessage),
+		challenges:      make(map[string]bool),
+		closeReasons:    make(map[string]string),
+		updated:         make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(challengeEndpoint, m.handleChallenge)
+	mux.HandleFunc(registerEndpoint, m.handleRegister)
+	for _, hub := range []string{DaemonHubEndpoint, ControlHubEndpoint, DatachannelHubEndpoint} {
+		hub := hub
+		mux.HandleFunc(hub+negotiateEndpointSuffix, func(w http.ResponseWriter, r *http.Request) {
+			m.handleNegotiate(hub, w, r)
+		})
+		mux.HandleFunc(hub, func(w http.ResponseWriter, r *http.Request) {
+			m.handleConnect(hub, w, r)
+		})
+	}
+
+	m.server = httptest.NewTLSServer(mux)
+	m.ServiceUrl = m.server.Listener.Addr().String()
+
+	caFile, err := writeCaFile(m.server)
+	if err != nil {
+		m.server.Close()
+		return nil, err
+	}
+	m.CaFile = caFile
+	return m, nil
+}
+
+func writeCaFile(server *httptest.Server) (string, error) {
+	caFile, err := ioutil.TempFile("", "mockbastion-ca-*.pem")
+	if err != nil {
+		return "", fmt.Errorf("could not create CA file: %s", err)
+	}
+	defer caFile.Close()
+
+	if err := pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}); err != nil {
+		os.Remove(caFile.Name())
+		return "", fmt.Errorf("could not write CA file: %s", err)
+	}
+	return caFile.Name(), nil
+}
+
+// Closes every connection and stops listening
+func (m *MockBastion) Close() {
+	m.lock.Lock()
+	for _, connections := range []map[string]*hubConnection{m.controlChannels, m.daemons, m.datachannels} {
+		for _, connection := range connections {
+			connection.close()
+		}
+	}
+	m.lock.Unlock()
+
+	m.server.Close()
+	os.Remove(m.CaFile)
+}
+
+// Blocks until one of our clients has sent a message that matches or the context is done. Messages we've
+// already recorded count, so it doesn't matter if the message arrived before we started waiting
+func (m *MockBastion) WaitForMessage(ctx context.Context, match func(RecordedMessage) bool) (RecordedMessage, error) {
+	seen := 0
+	for {
+		m.lock.Lock()
+		for ; seen < len(m.messages); seen++ {
+			if match(m.messages[seen]) {
+				message := m.messages[seen]
+				m.lock.Unlock()
+				return message, nil
+			}
+		}
+		updated := m.updated
+		m.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return RecordedMessage{}, ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// Blocks until a daemon we haven't been asked about before has connected and returns its connection id
+func (m *MockBastion) WaitForDaemon(ctx context.Context) (string, error) {
+	for {
+		m.lock.Lock()
+		for id := range m.daemons {
+			if !m.seenDaemons[id] {
+				m.seenDaemons[id] = true
+				m.lock.Unlock()
+				return id, nil
+			}
+		}
+		updated := m.updated
+		m.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// Returns every message our clients have sent us so far
+func (m *MockBastion) Messages() []RecordedMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]RecordedMessage{}, m.messages...)
+}
+
+// Returns the reason a client gave when it closed its connection, if it told us it was closing
+func (m *MockBastion) CloseReason(connectionId string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	reason, ok := m.closeReasons[connectionId]
+	return reason, ok
+}
+
+// Returns every agent registration we've received so far
+func (m *MockBastion) Registrations() []cc.RegisterAgentMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]cc.RegisterAgentMessage{}, m.registrations...)
+}
+
+// Returns the connection ids of every daemon currently connected
+func (m *MockBastion) DaemonConnectionIds() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ids := []string{}
+	for id := range m.daemons {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Sends a message to a daemon as if it came from its agent
+func (m *MockBastion) SendToDaemon(daemonConnectionId string, target string, message wsmsg.AgentMessage) error {
+	m.lock.Lock()
+	daemon, ok := m.daemons[daemonConnectionId]
+	m.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no daemon connected with id %s", daemonConnectionId)
+	}
+	return daemon.send(target, message)
+}
+
+// Sends a message to the agent datachannel paired with a daemon as if it came from the daemon
+func (m *MockBastion) SendToAgent(daemonConnectionId string, target string, message wsmsg.AgentMessage) error {
+	m.lock.Lock()
+	datachannel, ok := m.datachannels[m.pairings[daemonConnectionId]]
+	m.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no agent datachannel paired with daemon %s", daemonConnectionId)
+	}
+	return datachannel.send(target, message)
+}
+
+// Drops the connection with this connection id without telling the client, like a flaky network would
+func (m *MockBastion) DropConnection(connectionId string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, connections := range []map[string]*hubConnection{m.controlChannels, m.daemons, m.datachannels} {
+		for _, connection := range connections {
+			if connection.id == connectionId {
+				connection.close()
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no connection with id %s", connectionId)
+}
+
+// Stops answering the connection with this connection id without closing it, like a connection that's only
+// half open after a laptop goes to sleep would. Nothing gets through in either direction, including pongs
+func (m *MockBastion) SilenceConnection(connectionId string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, connections := range []map[string]*hubConnection{m.controlChannels, m.daemons, m.datachannels} {
+		for _, connection := range connections {
+			if connection.id == connectionId {
+				connection.silence()
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no connection with id %s", connectionId)
+}
+
+// Tells the client with this connection id that Bastion is closing its connection
+func (m *MockBastion) CloseConnection(connectionId string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, connections := range []map[string]*hubConnection{m.controlChannels, m.daemons, m.datachannels} {
+		for _, connection := range connections {
+			if connection.id == connectionId {
+				closeMessage, _ := json.Marshal(wsmsg.CloseMessage{Message: "closed by mock bastion"})
+				return connection.send(closeTarget, wsmsg.AgentMessage{
+					MessageType:    closeTarget,
+					SchemaVersion:  wsmsg.SchemaVersion,
+					MessagePayload: closeMessage,
+				})
+			}
+		}
+	}
+	return fmt.Errorf("no connection with id %s", connectionId)
+}
+
+func (m *MockBastion) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	var challengeRequest wsmsg.GetChallengeMessage
+	if err := json.NewDecoder(r.Body).Decode(&challengeRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	challenge := uuid.New().String()
+	m.lock.Lock()
+	m.challenges[challenge] = true
+	m.lock.Unlock()
+
+	json.NewEncoder(w).Encode(wsmsg.GetChallengeResponse{Challenge: challenge})
+}
+
+func (m *MockBastion) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var registration cc.RegisterAgentMessage
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.lock.Lock()
+	m.registrations = append(m.registrations, registration)
+	m.lock.Unlock()
+}
+
+func (m *MockBastion) handleNegotiate(hub string, w http.ResponseWriter, r *http.Request) {
+	params := map[string]string{}
+	for key, values := range r.URL.Query() {
+		params[key] = values[0]
+	}
+
+	switch hub {
+	case DaemonHubEndpoint:
+		if m.AuthHeader != "" && r.Header.Get("Authorization") != m.AuthHeader {
+			http.Error(w, "bad auth header", http.StatusUnauthorized)
+			return
+		}
+	case ControlHubEndpoint:
+		if err := m.verifyAgent(params); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	connectionId := uuid.New().String()
+	m.lock.Lock()
+	m.negotiated[connectionId] = negotiation{hub: hub, params: params}
+	m.lock.Unlock()
+
+	// Our clients expect SignalR's casing, which our message struct doesn't have tags for
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"negotiateVersion": 0,
+		"connectionId":     connectionId,
+		"availableTransports": []map[string]interface{}{
+			{
+				"transport":       "WebSockets",
+				"transferFormats": []string{"Text", "Binary"},
+			},
+		},
+	})
+}
+
+// Agents have to prove they have the private key for the public key they connect with, by signing one of
+// the challenges we've given out and their agent version
+func (m *MockBastion) verifyAgent(params map[string]string) error {
+	publicKeyBytes, _ := base64.StdEncoding.DecodeString(params["public_key"])
+	if len(publicKeyBytes) != ed.PublicKeySize {
+		return fmt.Errorf("invalid public key")
+	}
+	publicKey := ed.PublicKey(publicKeyBytes)
+
+	if !verifySignature(publicKey, params["agent_version"], params["signed_agent_version"]) {
+		return fmt.Errorf("invalid agent version signature")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for challenge := range m.challenges {
+		if verifySignature(publicKey, challenge, params["solved_challenge"]) {
+			delete(m.challenges, challenge)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid solved challenge")
+}
+
+func verifySignature(publicKey ed.PublicKey, content string, signature string) bool {
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	hashBits := sha3.Sum256([]byte(content))
+	return ed.Verify(publicKey, hashBits[:], signatureBytes)
+}
+
+func (m *MockBastion) handleConnect(hub string, w http.ResponseWriter, r *http.Request) {
+	connectionId := r.URL.Query().Get("id")
+
+	m.lock.Lock()
+	negotiated, ok := m.negotiated[connectionId]
+	delete(m.negotiated, connectionId)
+	m.lock.Unlock()
+
+	if !ok || negotiated.hub != hub {
+		http.Error(w, "connection was never negotiated", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	connection := &hubConnection{
+		id:     connectionId,
+		hub:    hub,
+		params: negotiated.params,
+		conn:   conn,
+	}
+	conn.SetPingHandler(func(data string) error {
+		return connection.writeControl(websocket.PongMessage, []byte(data))
+	})
+	go m.serve(connection)
+}
+
+func (m *MockBastion) serve(connection *hubConnection) {
+	defer m.disconnect(connection)
+
+	// Our clients always start by agreeing on the SignalR protocol before anything else
+	if err := m.handshake(connection); err != nil {
+		return
+	}
+
+	m.connect(connection)
+
+	for {
+		_, rawMessage, err := connection.conn.ReadMessage()
+		if err != nil {
+			return
+		} else if connection.isSilenced() {
+			continue
+		}
+
+		// Anything after a message we can't decode is dropped, same as our clients do
+		wrappedMessages, _ := connection.protocol.Decode(rawMessage)
+		for _, wrappedMessage := range wrappedMessages {
+			if wrappedMessage.Type == signalRCloseTypeNumber {
+				m.recordClose(connection, wrappedMessage.Error)
+				continue
+			} else if wrappedMessage.Type != signalRTypeNumber {
+				continue
+			}
+
+			for _, agentMessage := range wrappedMessage.Arguments {
+				m.record(connection, wrappedMessage.Target, agentMessage)
+				m.relay(connection, wrappedMessage.Target, agentMessage)
+			}
+		}
+	}
+}
+
+func (m *MockBastion) handshake(connection *hubConnection) error {
+	_, rawMessage, err := connection.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	var handshake wsmsg.SignalRHandshakeRequest
+	if _, err := ws.DecodeHandshake(rawMessage, &handshake); err != nil {
+		return err
+	}
+
+	protocol, ok := ws.HubProtocol(handshake.Protocol)
+	if ok && m.DisableMessagePack && protocol.Name() == ws.MessagePackProtocol {
+		ok = false
+	}
+
+	if !ok {
+		rerr := fmt.Errorf("the protocol '%s' is not supported", handshake.Protocol)
+		connection.write(websocket.TextMessage, ws.EncodeHandshake(wsmsg.SignalRHandshakeResponse{Error: rerr.Error()}))
+		return rerr
+	}
+
+	connection.protocol = protocol
+	return connection.write(websocket.TextMessage, ws.EncodeHandshake(wsmsg.SignalRHandshakeResponse{}))
+}
+
+// Keeps track of a client once it's agreed on a protocol with us and does whatever Bastion would when it connects
+func (m *MockBastion) connect(connection *hubConnection) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	defer m.notify()
+
+	switch connection.hub {
+	case ControlHubEndpoint:
+		m.controlChannels[connection.id] = connection
+		connection.sendReady()
+
+	case DaemonHubEndpoint:
+		m.daemons[connection.id] = connection
+
+		// If this daemon's agent datachannel is still around, then it's just reconnecting
+		sessionId := connection.params["session_id"]
+		if pairingId, ok := m.sessions[sessionId]; ok && sessionId != "" {
+			if _, ok := m.datachannels[pairingId]; ok {
+				m.pairings[connection.id] = pairingId
+				m.pairedDaemons[pairingId] = connection.id
+				connection.sendReady()
+				return
+			}
+		}
+		m.sessions[sessionId] = connection.id
+		m.pairings[connection.id] = connection.id
+		m.pairedDaemons[connection.id] = connection.id
+
+		// Ask every agent to open a datachannel for this daemon, the daemon is ready once one of them does
+		newDatachannel, _ := json.Marshal(cc.NewDatachannelMessage{
+			ConnectionId: connection.id,
+			Role:         connection.params["assume_role"],
+			Token:        uuid.New().String(),
+		})
+		for _, control := range m.controlChannels {
+			control.send(newDatachannelTarget, wsmsg.AgentMessage{
+				MessageType:    string(wsmsg.NewDatachannel),
+				SchemaVersion:  wsmsg.SchemaVersion,
+				MessagePayload: newDatachannel,
+			})
+		}
+
+	case DatachannelHubEndpoint:
+		daemonConnectionId := connection.params["daemon_connection_id"]
+		m.datachannels[daemonConnectionId] = connection
+		connection.sendReady()
+
+		// Now the daemon has somewhere to send its messages, so let it and send anything it's already sent
+		if daemon, ok := m.daemons[m.pairedDaemons[daemonConnectionId]]; ok {
+			daemon.sendReady()
+		}
+		for _, pending := range m.pending[daemonConnectionId] {
+			connection.send(pending.target, pending.message)
+		}
+		delete(m.pending, daemonConnectionId)
+	}
+}
+
+func (m *MockBastion) disconnect(connection *hubConnection) {
+	connection.close()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch connection.hub {
+	case ControlHubEndpoint:
+		delete(m.controlChannels, connection.id)
+	case DaemonHubEndpoint:
+		delete(m.daemons, connection.id)
+		delete(m.pending, connection.id)
+		delete(m.pairings, connection.id)
+	case DatachannelHubEndpoint:
+		if m.datachannels[connection.params["daemon_connection_id"]] == connection {
+			delete(m.datachannels, connection.params["daemon_connection_id"])
+		}
+	}
+}
+
+func (m *MockBastion) record(connection *hubConnection, target string, agentMessage wsmsg.AgentMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.messages = append(m.messages, RecordedMessage{
+		Hub:          connection.hub,
+		ConnectionId: connection.id,
+		Target:       target,
+		Message:      agentMessage,
+	})
+	m.notify()
+}
+
+func (m *MockBastion) recordClose(connection *hubConnection, reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.closeReasons[connection.id] = reason
+	m.notify()
+}
+
+// Wakes up anyone waiting on our clients, must be called with the lock held
+func (m *MockBastion) notify() {
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+// Passes messages between a daemon and its agent datachannel, our clients pick their targets based on what
+// they're sending and don't care which target they receive a message on, so we keep it the same
+func (m *MockBastion) relay(connection *hubConnection, target string, agentMessage wsmsg.AgentMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch connection.hub {
+	case DaemonHubEndpoint:
+		if datachannel, ok := m.datachannels[m.pairings[connection.id]]; ok {
+			datachannel.send(target, agentMessage)
+		} else {
+			m.pending[connection.id] = append(m.pending[connection.id], pendingMessage{target: target, message: agentMessage})
+		}
+	case DatachannelHubEndpoint:
+		if daemon, ok := m.daemons[m.pairedDaemons[connection.params["daemon_connection_id"]]]; ok {
+			daemon.send(target, agentMessage)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package mockbastion
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+	ws "bastionzero.com/bctl/v1/bzerolib/channels/websocket"
+	lggr "bastionzero.com/bctl/v1/bzerolib/logger"
+)
+
+const (
+	testTarget  = "TestTarget"
+	testTimeout = 10 * time.Second
+)
+
+func newTestBastion(t *testing.T) *MockBastion {
+	m, err := New()
+	if err != nil {
+		t.Fatalf("could not start mock bastion: %s", err)
+	}
+	t.Cleanup(m.Close)
+
+	if err := ws.ConfigureTransport(ws.TransportConfig{CaFile: m.CaFile}); err != nil {
+		t.Fatalf("could not trust mock bastion's CA: %s", err)
+	}
+	return m
+}
+
+func connect(ctx context.Context, t *testing.T, m *MockBastion, hub string, params map[string]string) *ws.Websocket {
+	logger, err := lggr.NewLogger(lggr.Error, "")
+	if err != nil {
+		t.Fatalf("could not create logger: %s", err)
+	}
+
+	targetSelectHandler := func(wsmsg.AgentMessage) (string, error) {
+		return testTarget, nil
+	}
+	client, err := ws.NewWebsocket(ctx, logger, m.ServiceUrl, hub, params, map[string]string{}, targetSelectHandler, false, false, 3)
+	if err != nil {
+		t.Fatalf("could not connect to %s: %s", hub, err)
+	} else if state := client.State(); state != ws.Ready {
+		t.Fatalf("expected to be connected to %s but our websocket is %s", hub, state)
+	}
+	return client
+}
+
+func testMessage(content string) wsmsg.AgentMessage {
+	payload, _ := json.Marshal(content)
+	return wsmsg.AgentMessage{
+		MessageType:    "test",
+		SchemaVersion:  wsmsg.SchemaVersion,
+		MessagePayload: payload,
+	}
+}
+
+func receive(ctx context.Context, t *testing.T, client *ws.Websocket) string {
+	select {
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for a message")
+	case agentMessage := <-client.InputChan:
+		var content string
+		if err := json.Unmarshal(agentMessage.MessagePayload, &content); err != nil {
+			t.Fatalf("could not unmarshal message payload %s: %s", agentMessage.MessagePayload, err)
+		}
+		return content
+	}
+	return ""
+}
+
+func TestRelaysBetweenDaemonAndDatachannel(t *testing.T) {
+	tests := []struct {
+		name               string
+		disableMessagePack bool
+	}{
+		{name: "MessagePack", disableMessagePack: false},
+		{name: "JSON", disableMessagePack: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestBastion(t)
+			m.DisableMessagePack = tt.disableMessagePack
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+
+			daemon := connect(ctx, t, m, DaemonHubEndpoint, map[string]string{"session_id": "session"})
+
+			// Falling back to JSON shouldn't cost us a backoff
+			for len(daemon.StateChan) > 0 {
+				if state := <-daemon.StateChan; state == ws.Backoff {
+					t.Errorf("expected to connect without backing off")
+				}
+			}
+
+			daemonId, err := m.WaitForDaemon(ctx)
+			if err != nil {
+				t.Fatalf("daemon never connected: %s", err)
+			}
+
+			// Anything the daemon sends before its datachannel connects waits for it
+			daemon.OutputChan <- testMessage("from daemon")
+			datachannel := connect(ctx, t, m, DatachannelHubEndpoint, map[string]string{"daemon_connection_id": daemonId})
+			if content := receive(ctx, t, datachannel); content != "from daemon" {
+				t.Errorf("expected datachannel to receive %q but got %q", "from daemon", content)
+			}
+
+			datachannel.OutputChan <- testMessage("from agent")
+			if content := receive(ctx, t, daemon); content != "from agent" {
+				t.Errorf("expected daemon to receive %q but got %q", "from agent", content)
+			}
+
+			recorded, err := m.WaitForMessage(ctx, func(message RecordedMessage) bool {
+				return message.Hub == DaemonHubEndpoint && message.ConnectionId == daemonId
+			})
+			if err != nil {
+				t.Fatalf("daemon's message was never recorded: %s", err)
+			} else if recorded.Target != testTarget {
+				t.Errorf("expected daemon's message to be recorded with target %s but got %s", testTarget, recorded.Target)
+			}
+		})
+	}
+}
+
+func TestRecordsCloseReason(t *testing.T) {
+	m := newTestBastion(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	daemon := connect(ctx, t, m, DaemonHubEndpoint, map[string]string{})
+	daemonId, err := m.WaitForDaemon(ctx)
+	if err != nil {
+		t.Fatalf("daemon never connected: %s", err)
+	}
+
+	daemon.Close("going away")
+	for {
+		if reason, ok := m.CloseReason(daemonId); ok {
+			if reason != "going away" {
+				t.Errorf("expected close reason %q but got %q", "going away", reason)
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("close reason was never recorded")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRejectsUnverifiedAgents(t *testing.T) {
+	m := newTestBastion(t)
+
+	// We only ever hand out challenges to agents that ask, so this can't have been signed with one
+	negotiateUrl := ws.ServiceHttpUrl(m.ServiceUrl, ControlHubEndpoint+negotiateEndpointSuffix+"?public_key=bm90IGEga2V5")
+	response, err := ws.HttpClient().Post(negotiateUrl, "application/json", nil)
+	if err != nil {
+		t.Fatalf("could not negotiate: %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unverified agent to be turned away with %d but got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+}
+
+func TestRejectsDaemonsWithoutAuthHeader(t *testing.T) {
+	m := newTestBastion(t)
+	m.AuthHeader = "Bearer token"
+
+	negotiateUrl := ws.ServiceHttpUrl(m.ServiceUrl, DaemonHubEndpoint+negotiateEndpointSuffix)
+	response, err := ws.HttpClient().Post(negotiateUrl, "application/json", nil)
+	if err != nil {
+		t.Fatalf("could not negotiate: %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected daemon without auth header to be turned away with %d but got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+}
@@ -31,4 +31,8 @@ const (
 	// For the control channel
 	NewDatachannel MessageType = "newDatachannel" // TODO: Can we make this into a single word?
 	HealthCheck    MessageType = "healthcheck"
+
+	// So Bastion can see which datachannels are open and close any it doesn't like
+	ListDatachannels MessageType = "listDatachannels"
+	CloseDatachannel MessageType = "closeDatachannel"
 )
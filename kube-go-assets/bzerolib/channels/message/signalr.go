@@ -6,8 +6,26 @@ and not have to reinvent our message structure.
 package message
 
 type SignalRNegotiateResponse struct {
-	NegotiateVersion int
-	ConnectionId     string
+	NegotiateVersion    int
+	ConnectionId        string
+	AvailableTransports []SignalRTransport
+}
+
+// A way Bastion will let us connect, and whether it can send us text, binary or both over it
+type SignalRTransport struct {
+	Transport       string
+	TransferFormats []string
+}
+
+// The first thing we send once we've connected, to agree on how we'll encode every message after it
+type SignalRHandshakeRequest struct {
+	Protocol string `json:"protocol"`
+	Version  int    `json:"version"`
+}
+
+// Empty unless Bastion doesn't support the protocol we asked for
+type SignalRHandshakeResponse struct {
+	Error string `json:"error,omitempty"`
 }
 
 // This is our SignalR wrapper, every message that comes in thru
@@ -18,6 +36,9 @@ type SignalRWrapper struct {
 	Target    string         `json:"target"` // hub name
 	Type      int            `json:"type"`
 	Arguments []AgentMessage `json:"arguments"`
+
+	// Only for close messages, why the connection is being closed
+	Error string `json:"error,omitempty"`
 }
 
 // This is our close message struct
@@ -25,17 +25,17 @@ func newChallenge(orgId string, clusterName string, serviceUrl string, privateKe
 	}
 
 	// Make our POST request
-	response, err := http.Post("https://"+serviceUrl+challengeEndpoint, "application/json",
+	response, err := HttpClient().Post(ServiceHttpUrl(serviceUrl, challengeEndpoint), "application/json",
 		bytes.NewBuffer(challengeJson))
-	if err != nil || response.StatusCode != http.StatusOK {
-		// If the status code is unauthorized, retrun an unauth error, error just a generic one
-		if response.StatusCode == http.StatusInternalServerError {
-			return "", fmt.Errorf("500")
-		}
-		return "", fmt.Errorf("Error making post request to challenge agent. Error: %s. Response: %d", err, response.StatusCode)
+	if err != nil {
+		return "", fmt.Errorf("Error making post request to challenge agent: %s", err)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error making post request to challenge agent. Response: %d", response.StatusCode)
+	}
+
 	// Extract the challenge
 	responseDecoded := wsmsg.GetChallengeResponse{}
 	json.NewDecoder(response.Body).Decode(&responseDecoded)
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// SignalR's defaults, Bastion pings us every 15 seconds too
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultHeartbeatTimeout  = 30 * time.Second
+)
+
+// How often we check that Bastion is still there, and how long we wait to hear anything from it before we
+// decide our connection is dead. Zero values get our defaults
+type HeartbeatConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+var (
+	heartbeat = HeartbeatConfig{
+		Interval: defaultHeartbeatInterval,
+		Timeout:  defaultHeartbeatTimeout,
+	}
+	heartbeatLock sync.Mutex
+)
+
+// Should be called before we make any connections to Bastion
+func ConfigureHeartbeat(config HeartbeatConfig) error {
+	if config.Interval == 0 {
+		config.Interval = defaultHeartbeatInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultHeartbeatTimeout
+	}
+
+	// Otherwise we'd give up on Bastion before we've even asked if it's there
+	if config.Interval < 0 || config.Timeout <= config.Interval {
+		return fmt.Errorf("heartbeat timeout (%s) has to be longer than its interval (%s)", config.Timeout, config.Interval)
+	}
+
+	heartbeatLock.Lock()
+	defer heartbeatLock.Unlock()
+
+	heartbeat = config
+	return nil
+}
+
+func heartbeatConfig() HeartbeatConfig {
+	heartbeatLock.Lock()
+	defer heartbeatLock.Unlock()
+
+	return heartbeat
+}
+
+// Anything we hear from Bastion means it's still there, so every message and pong pushes back our deadline.
+// If we go too long without one, ReadMessage fails and Receive treats it like any other broken connection
+func (w *Websocket) extendReadDeadline(client *websocket.Conn) {
+	client.SetReadDeadline(time.Now().Add(heartbeatConfig().Timeout))
+}
+
+// Sends both a websocket ping, which any proxy in between us has to pass along, and a SignalR ping, which is
+// what Bastion itself is waiting on before it times us out. Runs until this connection is closed or replaced
+func (w *Websocket) sendHeartbeats(client *websocket.Conn) {
+	config := heartbeatConfig()
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			if replaced, err := w.sendHeartbeat(client, config); replaced {
+				return
+			} else if err != nil {
+				// Receive will find out the connection is broken too, it's the one that decides what to do about it
+				w.logger.Debug(fmt.Sprintf("Stopped sending heartbeats: %s", err))
+				return
+			}
+		}
+	}
+}
+
+// Returns true if we've reconnected since we started, the new connection sends its own heartbeats
+func (w *Websocket) sendHeartbeat(client *websocket.Conn, config HeartbeatConfig) (bool, error) {
+	w.socketLock.Lock()
+	defer w.socketLock.Unlock()
+
+	if w.client != client {
+		return true, nil
+	}
+
+	deadline := time.Now().Add(config.Timeout)
+	if err := client.WriteControl(websocket.PingMessage, []byte{}, deadline); err != nil {
+		return false, err
+	}
+
+	ping, err := w.protocol.Encode(wsmsg.SignalRWrapper{Type: signalRPingTypeNumber})
+	if err != nil {
+		return false, err
+	}
+	client.SetWriteDeadline(deadline)
+	return false, client.WriteMessage(w.protocol.FrameType(), ping)
+}
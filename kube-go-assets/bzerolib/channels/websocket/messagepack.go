@@ -0,0 +1,420 @@
+package websocket
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+
+	"github.com/gorilla/websocket"
+)
+
+// SignalR's MessagePack protocol. Every message is prefixed with its length and our message payloads go
+// over the wire as raw bytes instead of being base64 encoded inside of JSON.
+// Ref: https://github.com/dotnet/aspnetcore/blob/main/src/SignalR/docs/specs/HubProtocol.md#messagepack-msgpack-encoding
+type messagePackProtocol struct{}
+
+const (
+	signalRPingTypeNumber  = 6
+	signalRCloseTypeNumber = 7
+
+	// The most bytes a message's length prefix can take up
+	maxLengthPrefixSize = 5
+)
+
+func (messagePackProtocol) Name() string {
+	return MessagePackProtocol
+}
+
+func (messagePackProtocol) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (messagePackProtocol) Encode(message wsmsg.SignalRWrapper) ([]byte, error) {
+	var body []byte
+	switch message.Type {
+	case signalRTypeNumber:
+		// [type, headers, invocation id, target, arguments, stream ids]
+		body = appendArrayHeader(body, 6)
+		body = appendInt(body, int64(message.Type))
+		body = appendMapHeader(body, 0)
+		body = appendNil(body)
+		body = appendString(body, message.Target)
+		body = appendArrayHeader(body, len(message.Arguments))
+		for _, agentMessage := range message.Arguments {
+			body = appendAgentMessage(body, agentMessage)
+		}
+		body = appendArrayHeader(body, 0)
+	case signalRPingTypeNumber:
+		body = appendArrayHeader(body, 1)
+		body = appendInt(body, int64(message.Type))
+	case signalRCloseTypeNumber:
+		// [type, error, allow reconnect]
+		body = appendArrayHeader(body, 3)
+		body = appendInt(body, int64(message.Type))
+		if message.Error == "" {
+			body = appendNil(body)
+		} else {
+			body = appendString(body, message.Error)
+		}
+		body = append(body, 0xc2) // false
+	default:
+		return []byte{}, fmt.Errorf("unsupported SignalR message type for messagepack: %d", message.Type)
+	}
+
+	// Length prefixes are 7 bits at a time, least significant first
+	frame := []byte{}
+	for length := len(body); ; {
+		if length < 0x80 {
+			frame = append(frame, byte(length))
+			break
+		}
+		frame = append(frame, byte(length&0x7f)|0x80)
+		length >>= 7
+	}
+	return append(frame, body...), nil
+}
+
+func (messagePackProtocol) Decode(frame []byte) ([]wsmsg.SignalRWrapper, error) {
+	messages := []wsmsg.SignalRWrapper{}
+	for len(frame) > 0 {
+		length, prefixSize := 0, 0
+		for shift := 0; ; shift += 7 {
+			if prefixSize >= len(frame) || prefixSize >= maxLengthPrefixSize {
+				return messages, fmt.Errorf("malformed messagepack length prefix")
+			}
+			b := frame[prefixSize]
+			prefixSize++
+			length |= int(b&0x7f) << shift
+			if b&0x80 == 0 {
+				break
+			}
+		}
+
+		if length > len(frame)-prefixSize {
+			return messages, fmt.Errorf("messagepack message is longer than its frame")
+		}
+		body := frame[prefixSize : prefixSize+length]
+		frame = frame[prefixSize+length:]
+
+		message, err := decodeMessage(body)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func decodeMessage(body []byte) (wsmsg.SignalRWrapper, error) {
+	d := &msgpackDecoder{data: body}
+	value, err := d.next()
+	if err != nil {
+		return wsmsg.SignalRWrapper{}, err
+	}
+
+	fields, ok := value.([]interface{})
+	if !ok || len(fields) == 0 {
+		return wsmsg.SignalRWrapper{}, fmt.Errorf("SignalR messagepack message is not an array")
+	}
+
+	messageType, ok := fields[0].(int64)
+	if !ok {
+		return wsmsg.SignalRWrapper{}, fmt.Errorf("SignalR messagepack message has no type")
+	}
+	message := wsmsg.SignalRWrapper{Type: int(messageType)}
+
+	// We only care about the contents of invocations and why we're being closed, for everything else
+	// knowing the type is enough
+	if message.Type == signalRCloseTypeNumber && len(fields) > 1 {
+		message.Error, _ = fields[1].(string)
+		return message, nil
+	} else if message.Type != signalRTypeNumber {
+		return message, nil
+	} else if len(fields) < 5 {
+		return message, fmt.Errorf("SignalR messagepack invocation is missing fields")
+	}
+
+	if message.Target, ok = fields[3].(string); !ok {
+		return message, fmt.Errorf("SignalR messagepack invocation has no target")
+	}
+
+	arguments, ok := fields[4].([]interface{})
+	if !ok {
+		return message, fmt.Errorf("SignalR messagepack invocation has no arguments")
+	}
+	for _, argument := range arguments {
+		agentMessage, err := toAgentMessage(argument)
+		if err != nil {
+			return message, err
+		}
+		message.Arguments = append(message.Arguments, agentMessage)
+	}
+	return message, nil
+}
+
+// AgentMessages are maps keyed by the same names we use in JSON, Bastion may send them capitalized though
+func appendAgentMessage(b []byte, agentMessage wsmsg.AgentMessage) []byte {
+	b = appendMapHeader(b, 3)
+	b = appendString(b, "messageType")
+	b = appendString(b, agentMessage.MessageType)
+	b = appendString(b, "schemaVersion")
+	b = appendString(b, agentMessage.SchemaVersion)
+	b = appendString(b, "messagePayload")
+	return appendBinary(b, agentMessage.MessagePayload)
+}
+
+func toAgentMessage(value interface{}) (wsmsg.AgentMessage, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return wsmsg.AgentMessage{}, fmt.Errorf("SignalR messagepack argument is not a map")
+	}
+
+	var agentMessage wsmsg.AgentMessage
+	for key, field := range fields {
+		switch strings.ToLower(key) {
+		case "messagetype":
+			agentMessage.MessageType, _ = field.(string)
+		case "schemaversion":
+			agentMessage.SchemaVersion, _ = field.(string)
+		case "messagepayload":
+			switch payload := field.(type) {
+			case []byte:
+				agentMessage.MessagePayload = payload
+			case string:
+				agentMessage.MessagePayload = []byte(payload)
+			}
+		}
+	}
+	return agentMessage, nil
+}
+
+// Just enough MessagePack to speak SignalR with
+// Ref: https://github.com/msgpack/msgpack/blob/master/spec.md
+
+func appendNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func appendInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i < 0x80:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	default:
+		b = append(b, 0xd3)
+		return appendUint(b, uint64(i), 8)
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	switch length := len(s); {
+	case length < 32:
+		b = append(b, 0xa0|byte(length))
+	case length < 1<<8:
+		b = append(b, 0xd9, byte(length))
+	case length < 1<<16:
+		b = appendUint(append(b, 0xda), uint64(length), 2)
+	default:
+		b = appendUint(append(b, 0xdb), uint64(length), 4)
+	}
+	return append(b, s...)
+}
+
+func appendBinary(b []byte, bin []byte) []byte {
+	switch length := len(bin); {
+	case length < 1<<8:
+		b = append(b, 0xc4, byte(length))
+	case length < 1<<16:
+		b = appendUint(append(b, 0xc5), uint64(length), 2)
+	default:
+		b = appendUint(append(b, 0xc6), uint64(length), 4)
+	}
+	return append(b, bin...)
+}
+
+func appendArrayHeader(b []byte, length int) []byte {
+	switch {
+	case length < 16:
+		return append(b, 0x90|byte(length))
+	case length < 1<<16:
+		return appendUint(append(b, 0xdc), uint64(length), 2)
+	default:
+		return appendUint(append(b, 0xdd), uint64(length), 4)
+	}
+}
+
+func appendMapHeader(b []byte, length int) []byte {
+	switch {
+	case length < 16:
+		return append(b, 0x80|byte(length))
+	case length < 1<<16:
+		return appendUint(append(b, 0xde), uint64(length), 2)
+	default:
+		return appendUint(append(b, 0xdf), uint64(length), 4)
+	}
+}
+
+// Big endian, in size bytes
+func appendUint(b []byte, u uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(u>>(8*uint(i))))
+	}
+	return b
+}
+
+// Decodes into nil, bool, int64, float64, string, []byte, []interface{} and map[string]interface{}
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("unexpected end of messagepack data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) next() (interface{}, error) {
+	header, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := header[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.readMap(int(c & 0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.readArray(int(c & 0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := d.read(int(c & 0x1f))
+		return string(b), err
+	}
+
+	switch header[0] {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		length, err := d.readUint(1 << (header[0] - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.read(int(length))
+	case 0xc7, 0xc8, 0xc9:
+		// We don't use any extension types, but we still have to skip over them
+		length, err := d.readUint(1 << (header[0] - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		_, err = d.read(int(length) + 1)
+		return nil, err
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (header[0] - 0xcc))
+		return int64(u), err
+	case 0xd0:
+		u, err := d.readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return int64(u), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		_, err := d.read(1 + 1<<(header[0]-0xd4))
+		return nil, err
+	case 0xd9, 0xda, 0xdb:
+		length, err := d.readUint(1 << (header[0] - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(length))
+		return string(b), err
+	case 0xdc, 0xdd:
+		length, err := d.readUint(2 << (header[0] - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(int(length))
+	case 0xde, 0xdf:
+		length, err := d.readUint(2 << (header[0] - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(int(length))
+	default:
+		return nil, fmt.Errorf("unsupported messagepack type 0x%x", header[0])
+	}
+}
+
+func (d *msgpackDecoder) readArray(length int) ([]interface{}, error) {
+	// Every element takes at least a byte, so don't let a bad length have us allocate more than we were sent
+	if length > len(d.data)-d.pos {
+		return nil, fmt.Errorf("messagepack array is longer than its data")
+	}
+
+	array := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		value, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
+func (d *msgpackDecoder) readMap(length int) (map[string]interface{}, error) {
+	if 2*length > len(d.data)-d.pos {
+		return nil, fmt.Errorf("messagepack map is longer than its data")
+	}
+
+	m := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(key)] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,236 @@
+package websocket
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+)
+
+func testAgentMessage(payload []byte) wsmsg.AgentMessage {
+	return wsmsg.AgentMessage{
+		MessageType:    "keysplitting",
+		SchemaVersion:  wsmsg.SchemaVersion,
+		MessagePayload: payload,
+	}
+}
+
+// Prefixes a fixture's body with its length, which is always a single byte for our fixtures
+func frame(body ...[]byte) []byte {
+	joined := bytes.Join(body, nil)
+	return append([]byte{byte(len(joined))}, joined...)
+}
+
+func TestMessagePackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message wsmsg.SignalRWrapper
+	}{
+		{
+			name: "Invocation",
+			message: wsmsg.SignalRWrapper{
+				Target:    "RequestDaemonToBastionV1",
+				Type:      signalRTypeNumber,
+				Arguments: []wsmsg.AgentMessage{testAgentMessage([]byte(`{"hello":"world"}`))},
+			},
+		},
+		{
+			// Long enough that its length prefix takes more than one byte
+			name: "LargeInvocation",
+			message: wsmsg.SignalRWrapper{
+				Target:    "RequestDaemonToBastionV1",
+				Type:      signalRTypeNumber,
+				Arguments: []wsmsg.AgentMessage{testAgentMessage(bytes.Repeat([]byte{0xff}, 70000))},
+			},
+		},
+		{
+			name: "LongTarget",
+			message: wsmsg.SignalRWrapper{
+				Target:    strings.Repeat("a", 300),
+				Type:      signalRTypeNumber,
+				Arguments: []wsmsg.AgentMessage{testAgentMessage([]byte{})},
+			},
+		},
+		{
+			name:    "Ping",
+			message: wsmsg.SignalRWrapper{Type: signalRPingTypeNumber},
+		},
+		{
+			name:    "Close",
+			message: wsmsg.SignalRWrapper{Type: signalRCloseTypeNumber, Error: "going away"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := messagePackProtocol{}.Encode(tt.message)
+			if err != nil {
+				t.Fatalf("failed to encode: %s", err)
+			}
+
+			decoded, err := messagePackProtocol{}.Decode(encoded)
+			if err != nil {
+				t.Fatalf("failed to decode: %s", err)
+			} else if len(decoded) != 1 {
+				t.Fatalf("expected 1 message but decoded %d", len(decoded))
+			}
+
+			// We don't keep track of payloads being empty rather than nil
+			for i := range decoded[0].Arguments {
+				if len(decoded[0].Arguments[i].MessagePayload) == 0 {
+					decoded[0].Arguments[i].MessagePayload = tt.message.Arguments[i].MessagePayload
+				}
+			}
+			if !reflect.DeepEqual(decoded[0], tt.message) {
+				t.Errorf("expected %+v but decoded %+v", tt.message, decoded[0])
+			}
+		})
+	}
+}
+
+func TestMessagePackEncodesFixtures(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  wsmsg.SignalRWrapper
+		expected []byte
+	}{
+		{
+			name:     "Ping",
+			message:  wsmsg.SignalRWrapper{Type: signalRPingTypeNumber},
+			expected: []byte{0x02, 0x91, 0x06},
+		},
+		{
+			name:     "CloseWithoutError",
+			message:  wsmsg.SignalRWrapper{Type: signalRCloseTypeNumber},
+			expected: []byte{0x04, 0x93, 0x07, 0xc0, 0xc2},
+		},
+		{
+			name: "Invocation",
+			message: wsmsg.SignalRWrapper{
+				Target:    "Test",
+				Type:      signalRTypeNumber,
+				Arguments: []wsmsg.AgentMessage{{MessageType: "t", SchemaVersion: "1", MessagePayload: []byte("hi")}},
+			},
+			expected: frame(
+				[]byte{0x96, 0x01, 0x80, 0xc0},
+				[]byte("\xa4Test"),
+				[]byte{0x91, 0x83},
+				[]byte("\xabmessageType\xa1t"),
+				[]byte("\xadschemaVersion\xa11"),
+				[]byte("\xaemessagePayload\xc4\x02hi"),
+				[]byte{0x90},
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := messagePackProtocol{}.Encode(tt.message)
+			if err != nil {
+				t.Fatalf("failed to encode: %s", err)
+			} else if !bytes.Equal(encoded, tt.expected) {
+				t.Errorf("expected % x but encoded % x", tt.expected, encoded)
+			}
+		})
+	}
+}
+
+func TestMessagePackDecodesFixtures(t *testing.T) {
+	expected := wsmsg.SignalRWrapper{
+		Target:    "Test",
+		Type:      signalRTypeNumber,
+		Arguments: []wsmsg.AgentMessage{{MessageType: "t", SchemaVersion: "1", MessagePayload: []byte("hi")}},
+	}
+
+	tests := []struct {
+		name     string
+		frame    []byte
+		expected []wsmsg.SignalRWrapper
+	}{
+		{
+			// Bastion capitalizes its keys, sends an invocation id and may send payloads as strings
+			name: "FromBastion",
+			frame: frame(
+				[]byte{0x96, 0x01, 0x80},
+				[]byte("\xa11\xa4Test"),
+				[]byte{0x91, 0x83},
+				[]byte("\xabMessageType\xa1t"),
+				[]byte("\xadSchemaVersion\xa11"),
+				[]byte("\xaeMessagePayload\xa2hi"),
+				[]byte{0x90},
+			),
+			expected: []wsmsg.SignalRWrapper{expected},
+		},
+		{
+			name:  "SeveralInOneFrame",
+			frame: append(frame([]byte{0x91, 0x06}), frame([]byte{0x93, 0x07}, []byte("\xa4oops"), []byte{0xc3})...),
+			expected: []wsmsg.SignalRWrapper{
+				{Type: signalRPingTypeNumber},
+				{Type: signalRCloseTypeNumber, Error: "oops"},
+			},
+		},
+		{
+			// Newer versions of SignalR send a completion and other types we don't care about the contents of
+			name:     "IgnoresOtherTypes",
+			frame:    frame([]byte{0x94, 0x03, 0x80, 0xa1, 0x31, 0x02}),
+			expected: []wsmsg.SignalRWrapper{{Type: 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := messagePackProtocol{}.Decode(tt.frame)
+			if err != nil {
+				t.Fatalf("failed to decode: %s", err)
+			} else if !reflect.DeepEqual(decoded, tt.expected) {
+				t.Errorf("expected %+v but decoded %+v", tt.expected, decoded)
+			}
+		})
+	}
+}
+
+func TestMessagePackRejectsMalformedFrames(t *testing.T) {
+	ping := frame([]byte{0x91, 0x06})
+
+	tests := []struct {
+		name             string
+		frame            []byte
+		expectedMessages int
+	}{
+		{
+			name:             "Truncated",
+			frame:            append(append([]byte{}, ping...), frame([]byte{0x93, 0x07, 0xc0, 0xc2})[:3]...),
+			expectedMessages: 1,
+		},
+		{
+			name:             "LengthPrefixTooLong",
+			frame:            []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			expectedMessages: 0,
+		},
+		{
+			name:             "NotAnArray",
+			frame:            frame([]byte{0x06}),
+			expectedMessages: 0,
+		},
+		{
+			// An array that claims to be far bigger than what we were sent
+			name:             "HugeArray",
+			frame:            frame([]byte{0xdd, 0x7f, 0xff, 0xff, 0xff}),
+			expectedMessages: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := messagePackProtocol{}.Decode(tt.frame)
+			if err == nil {
+				t.Errorf("expected malformed frame to fail decoding")
+			}
+			if len(decoded) != tt.expectedMessages {
+				t.Errorf("expected the %d messages before the malformed one but decoded %d", tt.expectedMessages, len(decoded))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	wsmsg "bastionzero.com/bctl/v1/bzerolib/channels/message"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	JsonProtocol        = "json"
+	MessagePackProtocol = "messagepack"
+)
+
+// How SignalR hub messages are framed on the wire. Everything above us only deals in SignalRWrappers, so
+// we can pick whichever protocol Bastion supports when we connect
+type IHubProtocol interface {
+	Name() string
+
+	// Either websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+
+	Encode(message wsmsg.SignalRWrapper) ([]byte, error)
+
+	// A single frame can have any number of messages in it, if one is malformed we return the ones before it
+	Decode(frame []byte) ([]wsmsg.SignalRWrapper, error)
+}
+
+// Returns the protocol a client asked for by name in its handshake
+func HubProtocol(name string) (IHubProtocol, bool) {
+	switch name {
+	case JsonProtocol:
+		return jsonProtocol{}, true
+	case MessagePackProtocol:
+		return messagePackProtocol{}, true
+	default:
+		return nil, false
+	}
+}
+
+// Handshakes are always JSON and terminated, even if we're agreeing on a binary protocol
+func EncodeHandshake(handshake interface{}) []byte {
+	handshakeBytes, _ := json.Marshal(handshake)
+	return append(handshakeBytes, signalRMessageTerminatorByte)
+}
+
+// Returns whatever came after the handshake, Bastion is allowed to send it in the same frame as its first message
+func DecodeHandshake(frame []byte, handshake interface{}) ([]byte, error) {
+	i := bytes.IndexByte(frame, signalRMessageTerminatorByte)
+	if i < 0 {
+		return []byte{}, fmt.Errorf("SignalR handshake is missing its terminator")
+	}
+	return frame[i+1:], json.Unmarshal(frame[:i], handshake)
+}
+
+// SignalR's JSON protocol, where every message is terminated by a record separator
+type jsonProtocol struct{}
+
+func (jsonProtocol) Name() string {
+	return JsonProtocol
+}
+
+func (jsonProtocol) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonProtocol) Encode(message wsmsg.SignalRWrapper) ([]byte, error) {
+	// Pings and closes don't have anything but their type, and why for a close
+	switch message.Type {
+	case signalRPingTypeNumber:
+		return append([]byte(fmt.Sprintf(`{"type":%d}`, signalRPingTypeNumber)), signalRMessageTerminatorByte), nil
+	case signalRCloseTypeNumber:
+		closeBytes, _ := json.Marshal(struct {
+			Type  int    `json:"type"`
+			Error string `json:"error,omitempty"`
+		}{message.Type, message.Error})
+		return append(closeBytes, signalRMessageTerminatorByte), nil
+	}
+
+	if msgBytes, err := json.Marshal(message); err != nil {
+		return []byte{}, fmt.Errorf("error marshalling outgoing SignalR Message: %v", message)
+	} else {
+		return append(msgBytes, signalRMessageTerminatorByte), nil
+	}
+}
+
+func (jsonProtocol) Decode(frame []byte) ([]wsmsg.SignalRWrapper, error) {
+	messages := []wsmsg.SignalRWrapper{}
+	for _, msg := range bytes.Split(frame, []byte{signalRMessageTerminatorByte}) {
+		// There's nothing after our last terminator
+		if len(msg) == 0 {
+			continue
+		}
+
+		var wrappedMessage wsmsg.SignalRWrapper
+		if err := json.Unmarshal(msg, &wrappedMessage); err != nil {
+			return messages, fmt.Errorf("error unmarshalling SignalR message from Bastion: %v", string(msg))
+		}
+		messages = append(messages, wrappedMessage)
+	}
+	return messages, nil
+}
@@ -0,0 +1,16 @@
+package websocket
+
+import (
+	"net/url"
+)
+
+// Our service url is just Bastion's host, which is always served over TLS. Anything that stands in for Bastion,
+// like a local test server, has to serve TLS too and be trusted through our TransportConfig
+func ServiceHttpUrl(serviceUrl string, endpoint string) string {
+	return "https://" + serviceUrl + endpoint
+}
+
+// Same as above, but for the websocket we connect to once we've negotiated
+func serviceWebsocketUrl(serviceUrl string, endpoint string) url.URL {
+	return url.URL{Scheme: "wss", Host: serviceUrl, Path: endpoint}
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type ConnectionState string
+
+const (
+	Connecting  ConnectionState = "Connecting"  // solving our challenge, if we need one
+	Negotiating ConnectionState = "Negotiating" // negotiating with and dialing the SignalR hub
+	Ready       ConnectionState = "Ready"
+	Backoff     ConnectionState = "Backoff" // waiting before our next attempt
+	Fatal       ConnectionState = "Fatal"   // we've given up, the reason gets sent on our DoneChan
+)
+
+const (
+	initialBackoff = time.Second
+	maxBackoff     = 2 * time.Minute
+)
+
+var (
+	// Every agent backing off on the same schedule would have them all reconnect to Bastion at once,
+	// so we need our own seed rather than the default one
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+// Errors we don't expect to go away no matter how many times we try again
+type fatalError struct {
+	err error
+}
+
+func (f *fatalError) Error() string {
+	return f.err.Error()
+}
+
+// Doubles with every attempt up to our max, then picks somewhere in the upper half of that
+func backoffDelay(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 16 {
+		if exponential := initialBackoff << (attempt - 1); exponential < maxBackoff {
+			delay = exponential
+		}
+	}
+
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
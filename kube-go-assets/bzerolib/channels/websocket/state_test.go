@@ -0,0 +1,25 @@
+package websocket
+
+import (
+	"testing"
+)
+
+func TestSetStateDropsOldestWhenNoOneIsListening(t *testing.T) {
+	w := &Websocket{StateChan: make(chan ConnectionState, 2)}
+
+	w.setState(Connecting)
+	w.setState(Backoff)
+	w.setState(Connecting)
+	w.setState(Ready)
+
+	if state := w.State(); state != Ready {
+		t.Errorf("expected state %s but got %s", Ready, state)
+	}
+
+	expected := []ConnectionState{Connecting, Ready}
+	for _, state := range expected {
+		if received := <-w.StateChan; received != state {
+			t.Errorf("expected to receive state %s but got %s", state, received)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// How we reach Bastion, for clusters and laptops that sit behind an egress proxy or a TLS inspecting one
+type TransportConfig struct {
+	// If empty, we use HTTPS_PROXY, HTTP_PROXY and NO_PROXY from the environment
+	ProxyUrl string
+
+	// PEM encoded CAs we trust on top of the system's
+	CaFile string
+
+	// Optional client certificate, for proxies that require mTLS
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+var (
+	// Everything that talks to Bastion shares these so they all go through the same proxy with the same certs
+	bastionTransport = http.DefaultTransport.(*http.Transport).Clone()
+	bastionDialer    = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: connectionTimeout,
+	}
+	transportLock sync.Mutex
+)
+
+// Should be called before we make any connections to Bastion
+func ConfigureTransport(config TransportConfig) error {
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(config.ProxyUrl)
+		if err != nil || proxyUrl.Host == "" {
+			return fmt.Errorf("invalid proxy url %q", config.ProxyUrl)
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CaFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if caBytes, err := ioutil.ReadFile(config.CaFile); err != nil {
+			return fmt.Errorf("could not read CA file: %s", err)
+		} else if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no PEM encoded certificates found in CA file %s", config.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile); err != nil {
+			return fmt.Errorf("could not load client certificate: %s", err)
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	bastionTransport = transport
+	bastionDialer = &websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: connectionTimeout,
+	}
+	return nil
+}
+
+// The client to use for any HTTP request to Bastion
+func HttpClient() *http.Client {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	return &http.Client{
+		Transport: bastionTransport,
+		Timeout:   connectionTimeout,
+	}
+}
+
+func websocketDialer() *websocket.Dialer {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	return bastionDialer
+}
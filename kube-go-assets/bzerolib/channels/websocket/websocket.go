@@ -1,14 +1,13 @@
 package websocket
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"net/url"
 	"sync"
 	"time"
 
@@ -20,8 +19,11 @@ import (
 )
 
 const (
-	sleepIntervalInSeconds = 5
-	connectionTimeout      = 30 // just a reminder for now
+	connectionTimeout = 30 * time.Second
+
+	// When we're closing, we keep sending until nothing new has been queued for this long
+	drainQuietPeriod = 100 * time.Millisecond
+	closeTimeout     = 5 * time.Second
 
 	challengeEndpoint = "/api/v1/kube/get-challenge"
 
@@ -32,30 +34,55 @@ const (
 
 type IWebsocket interface {
 	Connect() error
-	Receive()
+	Receive() error
 	Send(agentMessage wsmsg.AgentMessage) error
+	Close(reason string)
 }
 
 // This will be the client that we use to store our websocket connection
 type Websocket struct {
-	client  *websocket.Conn
-	logger  *lggr.Logger
+	client *websocket.Conn
+	logger *lggr.Logger
+
+	// Whether we can send, only ever changed while holding our socketLock
 	IsReady bool
 
+	// Every state we go through while connecting is sent here. If no one is keeping up we drop the oldest
+	// ones, so whoever's listening always sees the state we ended up in
+	StateChan chan ConnectionState
+	state     ConnectionState
+	stateLock sync.Mutex
+
 	// Ref: https://github.com/gorilla/websocket/issues/119#issuecomment-198710015
 	socketLock sync.Mutex
 
+	// How we frame SignalR messages, we ask for MessagePack unless Bastion has told us it can't do it
+	protocol      IHubProtocol
+	jsonOnly      bool
+	pendingFrames []byte // anything Bastion sent in the same frame as its handshake
+
 	// These are the channels for recieving and sending messages and done
 	InputChan  chan wsmsg.AgentMessage
 	OutputChan chan wsmsg.AgentMessage
 	DoneChan   chan string
 
+	// Signalled whenever Bastion tells us it's ready for us again after we've reconnected
+	ReconnectedChan chan struct{}
+
+	// Closed once we start closing for good, and once everything we had queued has been sent
+	closing   chan struct{}
+	drained   chan struct{}
+	closeOnce sync.Once
+
 	// Function for figuring out correct Target SignalR Hub
 	targetSelectHandler func(msg wsmsg.AgentMessage) (string, error)
 
 	// Flag to indicate if we should automatically try to reconnect
 	autoReconnect bool
 
+	// How many times in a row we'll try to connect before giving up, 0 means we never do
+	maxConnectAttempts int
+
 	getChallenge bool
 
 	// Connection variables
@@ -78,16 +105,22 @@ func NewWebsocket(ctx context.Context,
 	headers map[string]string,
 	targetSelectHandler func(msg wsmsg.AgentMessage) (string, error),
 	autoReconnect bool,
-	getChallenge bool) (*Websocket, error) {
+	getChallenge bool,
+	maxConnectAttempts int) (*Websocket, error) {
 
 	ret := Websocket{
 		logger:              logger,
 		InputChan:           make(chan wsmsg.AgentMessage, 200),
 		OutputChan:          make(chan wsmsg.AgentMessage, 200),
 		DoneChan:            make(chan string),
+		ReconnectedChan:     make(chan struct{}, 1),
+		closing:             make(chan struct{}),
+		drained:             make(chan struct{}),
+		StateChan:           make(chan ConnectionState, 10),
 		targetSelectHandler: targetSelectHandler,
 		getChallenge:        getChallenge,
 		autoReconnect:       autoReconnect,
+		maxConnectAttempts:  maxConnectAttempts,
 		serviceUrl:          serviceUrl,
 		hubEndpoint:         hubEndpoint,
 		params:              params,
@@ -96,7 +129,13 @@ func NewWebsocket(ctx context.Context,
 		subscribed:          false,
 	}
 
-	ret.Connect()
+	// Whoever's using us won't be listening on our DoneChan until we return
+	if err := ret.Connect(); err != nil {
+		go func() {
+			ret.DoneChan <- fmt.Sprint(err)
+		}()
+		return &ret, nil
+	}
 
 	// Listener for any incoming messages
 	go func() {
@@ -106,8 +145,19 @@ func NewWebsocket(ctx context.Context,
 				return
 			default:
 				if err := ret.Receive(); err != nil {
-					ret.logger.Error(err)
-					ret.DoneChan <- fmt.Sprint(err)
+					select {
+					case <-ret.closing:
+						ret.logger.Info("Stopped receiving, websocket has been closed")
+					default:
+						ret.logger.Error(err)
+					}
+					ret.setState(Fatal)
+
+					// Whoever closed us isn't going to be listening
+					select {
+					case <-ret.ctx.Done():
+					case ret.DoneChan <- fmt.Sprint(err):
+					}
 					return
 				}
 			}
@@ -127,6 +177,11 @@ func (w *Websocket) subscribeToOutputChannel() {
 				select {
 				case <-w.ctx.Done():
 					return
+				case <-w.closing:
+					// We're the only ones sending, so this is the only way to be sure everything goes out in order
+					w.drainOutput()
+					close(w.drained)
+					return
 				case msg := <-w.OutputChan:
 					w.Send(msg)
 				}
@@ -138,37 +193,51 @@ func (w *Websocket) subscribeToOutputChannel() {
 // Returns error on websocket closed
 func (w *Websocket) Receive() error {
 	// Read incoming message(s)
-	_, rawMessage, err := w.client.ReadMessage()
+	var rawMessage []byte
+	var err error
+	if len(w.pendingFrames) > 0 {
+		rawMessage, w.pendingFrames = w.pendingFrames, nil
+	} else if _, rawMessage, err = w.client.ReadMessage(); err == nil {
+		w.extendReadDeadline(w.client)
+	}
 
 	if err != nil {
-		w.IsReady = false
+		w.setReady(false)
+
+		// Whatever's wrong with this connection, we're done with it. It might only be half open, so make sure
+		w.client.Close()
+
+		select {
+		case <-w.closing:
+			return errors.New("websocket closed")
+		default:
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = fmt.Errorf("haven't heard from Bastion in %s, connection is dead", heartbeatConfig().Timeout)
+		}
 
 		// Check if it's a clean exit or we don't need to reconnect
-		if websocket.IsCloseError(err, websocket.CloseNormalClosure) || !w.autoReconnect {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 			return errors.New("websocket closed")
+		} else if !w.autoReconnect {
+			return fmt.Errorf("websocket closed: %s", err)
 		} else { // else, reconnect
 			msg := fmt.Errorf("error in websocket, will attempt to reconnect: %s", err)
 			w.logger.Error(msg)
-			w.Connect()
+			if err := w.Connect(); err != nil {
+				return err
+			}
 		}
 	} else {
-		// Always trim off the termination char if its there
-		if rawMessage[len(rawMessage)-1] == signalRMessageTerminatorByte {
-			rawMessage = rawMessage[0 : len(rawMessage)-1]
+		messages, err := w.hubProtocol().Decode(rawMessage)
+		if err != nil {
+			// We still handle everything that came before the message we couldn't decode
+			w.logger.Error(err)
 		}
 
-		// Also check to see if we have multiple messages
-		splitmessages := bytes.Split(rawMessage, []byte{signalRMessageTerminatorByte})
-
-		for _, msg := range splitmessages {
-			// unwrap signalR
-			var wrappedMessage wsmsg.SignalRWrapper
-			if err := json.Unmarshal(msg, &wrappedMessage); err != nil {
-				msg := fmt.Errorf("error unmarshalling SignalR message from Bastion: %v", string(msg))
-				w.logger.Error(msg)
-				break
-			}
-
+		for _, wrappedMessage := range messages {
 			// push to channel
 			if wrappedMessage.Type != signalRTypeNumber {
 				msg := fmt.Sprintf("Ignoring SignalR message with type %v", wrappedMessage.Type)
@@ -176,7 +245,15 @@ func (w *Websocket) Receive() error {
 			} else if len(wrappedMessage.Arguments) != 0 {
 				if wrappedMessage.Target == "CloseConnection" {
 					return errors.New("closing message received; websocket closed")
-				} else if !w.subscribed && wrappedMessage.Target == "ReadyBastionToClient" {
+				} else if wrappedMessage.Target == "ReadyBastionToClient" {
+					// If we were already subscribed, then we've reconnected and anything we sent while we were
+					// gone might not have made it
+					if w.subscribed {
+						select {
+						case w.ReconnectedChan <- struct{}{}:
+						default:
+						}
+					}
 					w.subscribeToOutputChannel()
 					break
 				} else if !w.subscribed {
@@ -217,140 +294,321 @@ func (w *Websocket) Send(agentMessage wsmsg.AgentMessage) error {
 		Arguments: []wsmsg.AgentMessage{agentMessage},
 	}
 
-	if msgBytes, err := json.Marshal(signalRMessage); err != nil {
-		return fmt.Errorf("error marshalling outgoing SignalR Message: %v", signalRMessage)
+	if msgBytes, err := w.protocol.Encode(signalRMessage); err != nil {
+		return err
 	} else {
-		// Write our message to websocket
-		if err = w.client.WriteMessage(websocket.TextMessage, append(msgBytes, signalRMessageTerminatorByte)); err != nil {
-			return err
-		} else {
-			return nil
+		// Write our message to websocket, a dead connection can leave us blocked here once its buffers fill up
+		w.client.SetWriteDeadline(time.Now().Add(heartbeatConfig().Timeout))
+		return w.client.WriteMessage(w.protocol.FrameType(), msgBytes)
+	}
+}
+
+func (w *Websocket) drainOutput() {
+	for {
+		select {
+		case msg := <-w.OutputChan:
+			if err := w.Send(msg); err != nil {
+				w.logger.Error(fmt.Errorf("error sending queued message while closing: %s", err))
+			}
+		case <-time.After(drainQuietPeriod):
+			return
 		}
 	}
 }
 
-func (w *Websocket) Connect() {
-	for !w.IsReady {
-		time.Sleep(time.Second * sleepIntervalInSeconds)
-		if w.getChallenge {
-			// First get the config from the vault
-			config, _ := vault.LoadVault()
-
-			// If we have a private key, we must solve the challenge
-			solvedChallenge, err := newChallenge(w.params["org_id"], w.params["cluster_name"], w.serviceUrl, config.Data.PrivateKey)
-			if err != nil {
-				w.logger.Error(fmt.Errorf("error in getting challenge: %s", err))
-
-				// If its a 500 error, this means Bastion has rejected this request
-				if err.Error() == "500" {
-					w.logger.Error(fmt.Errorf("received 500 response on getting challenge. Sleeping forever"))
-					select {}
-				}
+// Sends everything we still have queued, tells Bastion why we're going away and closes our connection. We
+// don't reconnect after this, so whoever owns our ctx should cancel it once we return
+func (w *Websocket) Close(reason string) {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+	})
+
+	// If Bastion never told us it was ready for us, there's no one to send anything to
+	if w.subscribed {
+		select {
+		case <-w.drained:
+		case <-time.After(closeTimeout):
+			w.logger.Error(fmt.Errorf("timed out sending queued messages before closing"))
+		}
+	}
 
-				// Sleep in between
-				w.logger.Info(fmt.Sprintf("Connecting failed! Sleeping for %d seconds before attempting again", sleepIntervalInSeconds))
-				continue
-			}
+	w.socketLock.Lock()
+	defer w.socketLock.Unlock()
 
-			// Add the solved challenge to the params
-			w.params["solved_challenge"] = solvedChallenge
+	if w.client == nil {
+		return
+	}
 
-			// And sign our agent version
-			signedAgentVersion, err := signString(config.Data.PrivateKey, w.params["agent_version"])
-			if err != nil {
-				w.logger.Error(fmt.Errorf("error in signing agent version: %s", err))
+	deadline := time.Now().Add(closeTimeout)
+	if closeMessage, err := w.protocol.Encode(wsmsg.SignalRWrapper{Type: signalRCloseTypeNumber, Error: reason}); err == nil {
+		w.client.SetWriteDeadline(deadline)
+		w.client.WriteMessage(w.protocol.FrameType(), closeMessage)
+	}
+	w.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), deadline)
+	w.client.Close()
 
-				// Sleep in between
-				w.logger.Info(fmt.Sprintf("Connecting failed! Sleeping for %d seconds before attempting again", sleepIntervalInSeconds))
-				continue
-			}
+	w.IsReady = false
+	w.logger.Info(fmt.Sprintf("Closed websocket: %s", reason))
+}
 
-			// Add the agent version to the params
-			w.params["signed_agent_version"] = signedAgentVersion
+// Returns an error if we've given up on connecting
+func (w *Websocket) Connect() error {
+	for attempt := 1; ; attempt++ {
+		// Nothing can be sent until we have a new connection, whatever we had before is gone
+		w.setReady(false)
+
+		err := w.connect()
+		if err == nil {
+			w.setReady(true)
+			w.setState(Ready)
+			go w.sendHeartbeats(w.client)
+			return nil
 		}
+		w.logger.Error(err)
 
-		// First negotiate in order to get a url to connect to
-		httpClient := &http.Client{}
-		negotiateUrl := "https://" + w.serviceUrl + w.hubEndpoint + "/negotiate"
-		req, _ := http.NewRequest("POST", negotiateUrl, nil)
-
-		// Add the expected headers
-		for name, values := range w.headers {
-			// Loop over all values for the name.
-			req.Header.Set(name, values)
+		var fatal *fatalError
+		if errors.As(err, &fatal) {
+			w.setState(Fatal)
+			return err
+		} else if w.maxConnectAttempts > 0 && attempt >= w.maxConnectAttempts {
+			w.setState(Fatal)
+			return fmt.Errorf("giving up after %d attempts to connect: %s", attempt, err)
 		}
 
-		// Set any query params
-		q := req.URL.Query()
-		for key, values := range w.params {
-			q.Add(key, values)
+		delay := backoffDelay(attempt)
+		w.setState(Backoff)
+		w.logger.Info(fmt.Sprintf("Connecting failed! Waiting %s before attempting again", delay))
+
+		select {
+		case <-w.ctx.Done():
+			w.setState(Fatal)
+			return fmt.Errorf("stopped connecting: %s", w.ctx.Err())
+		case <-time.After(delay):
 		}
+	}
+}
 
-		// Add our clientProtocol param
-		q.Add("clientProtocol", "1.5")
-		req.URL.RawQuery = q.Encode()
+func (w *Websocket) State() ConnectionState {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
 
-		// Make the request and wait for the body to close
-		w.logger.Info(fmt.Sprintf("Starting negotiation with URL %s", negotiateUrl))
-		res, _ := httpClient.Do(req)
-		defer res.Body.Close()
+	return w.state
+}
 
-		if res.StatusCode == 401 {
-			// This means we have an auth issue, do not attempt to keep trying to reconnect
-			rerr := fmt.Errorf("Auth error when trying to connect. Not attempting to reconnect. Shutting down")
-			w.logger.Error(rerr)
+func (w *Websocket) setState(state ConnectionState) {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+
+	w.state = state
+
+	// We're the only ones sending and we hold the lock, so making room always lets us send
+	for {
+		select {
+		case w.StateChan <- state:
 			return
-		} else if res.StatusCode != 200 {
-			w.logger.Error(fmt.Errorf("Bad status code received on negotiation: %s", res.StatusCode))
+		default:
+			select {
+			case <-w.StateChan:
+			default:
+			}
+		}
+	}
+}
 
-			// Sleep in between
-			w.logger.Info(fmt.Sprintf("Connecting failed! Sleeping for %d seconds before attempting again", sleepIntervalInSeconds))
-			continue
+func (w *Websocket) setReady(ready bool) {
+	w.socketLock.Lock()
+	defer w.socketLock.Unlock()
+
+	w.IsReady = ready
+}
+
+// A single attempt at connecting, returns a fatalError if there's no point trying again
+func (w *Websocket) connect() error {
+	w.setState(Connecting)
+	if w.getChallenge {
+		// First get the config from the vault
+		config, _ := vault.LoadVault()
+
+		// If we have a private key, we must solve the challenge
+		solvedChallenge, err := newChallenge(w.params["org_id"], w.params["cluster_name"], w.serviceUrl, config.Data.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("error in getting challenge: %s", err)
 		}
 
-		// Extract out the connection token
-		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		var m map[string]interface{}
+		// Add the solved challenge to the params
+		w.params["solved_challenge"] = solvedChallenge
 
-		if err := json.Unmarshal(bodyBytes, &m); err != nil {
-			// TODO: Add error handling around this, we should at least retry and then bubble up the error to the user
-			w.logger.Error(fmt.Errorf("error un-marshalling negotiate response: %s", m))
+		// And sign our agent version
+		signedAgentVersion, err := signString(config.Data.PrivateKey, w.params["agent_version"])
+		if err != nil {
+			return &fatalError{fmt.Errorf("error in signing agent version: %s", err)}
 		}
 
-		connectionId := m["connectionId"]
+		// Add the agent version to the params
+		w.params["signed_agent_version"] = signedAgentVersion
+	}
+
+	// First negotiate in order to get a url to connect to
+	w.setState(Negotiating)
+	httpClient := HttpClient()
+	negotiateUrl := ServiceHttpUrl(w.serviceUrl, w.hubEndpoint+"/negotiate")
+	req, _ := http.NewRequest("POST", negotiateUrl, nil)
+
+	// Add the expected headers
+	for name, values := range w.headers {
+		// Loop over all values for the name.
+		req.Header.Set(name, values)
+	}
+
+	// Set any query params
+	q := req.URL.Query()
+	for key, values := range w.params {
+		q.Add(key, values)
+	}
+
+	// Add our clientProtocol param
+	q.Add("clientProtocol", "1.5")
+	req.URL.RawQuery = q.Encode()
+
+	// Make the request and wait for the body to close
+	w.logger.Info(fmt.Sprintf("Starting negotiation with URL %s", negotiateUrl))
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error negotiating: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		// This means we have an auth issue, do not attempt to keep trying to reconnect
+		return &fatalError{fmt.Errorf("Auth error when trying to connect. Not attempting to reconnect. Shutting down")}
+	} else if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bad status code received on negotiation: %d", res.StatusCode)
+	}
+
+	// Extract out the connection token
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	var negotiateResponse wsmsg.SignalRNegotiateResponse
+
+	if err := json.Unmarshal(bodyBytes, &negotiateResponse); err != nil {
+		return fmt.Errorf("error un-marshalling negotiate response: %s", bodyBytes)
+	} else if negotiateResponse.ConnectionId == "" {
+		return fmt.Errorf("negotiate response is missing a connection id: %s", bodyBytes)
+	}
+
+	// Add the connection id to the list of params
+	w.params["id"] = negotiateResponse.ConnectionId
+	w.params["clientProtocol"] = "1.5"
+	w.params["transport"] = "WebSockets"
+
+	// Build our url u , add our params as well
+	websocketUrl := serviceWebsocketUrl(w.serviceUrl, w.hubEndpoint)
+	q = websocketUrl.Query()
+	for key, value := range w.params {
+		q.Set(key, value)
+	}
+	websocketUrl.RawQuery = q.Encode()
+
+	msg := fmt.Sprintf("Negotiation finished, received %d. Connecting to %s", res.StatusCode, websocketUrl.String())
+	w.logger.Info(msg)
+
+	client, _, err := websocketDialer().Dial(
+		websocketUrl.String(),
+		http.Header{"Authorization": []string{w.headers["Authorization"]}})
+	if err != nil {
+		return fmt.Errorf("error dialing websocket: %s", err)
+	}
+
+	// Define our protocol and version
+	// Ref: https://github.com/dotnet/aspnetcore/blob/main/src/SignalR/docs/specs/HubProtocol.md#overview
+	protocol := w.chooseProtocol(negotiateResponse)
+	handshake := wsmsg.SignalRHandshakeRequest{
+		Protocol: protocol.Name(),
+		Version:  1,
+	}
+	if err := client.WriteMessage(websocket.TextMessage, EncodeHandshake(handshake)); err != nil {
+		client.Close()
+		return fmt.Errorf("Error when trying to agree on version for SignalR: %s", err)
+	}
 
-		// Add the connection id to the list of params
-		w.params["id"] = connectionId.(string)
-		w.params["clientProtocol"] = "1.5"
-		w.params["transport"] = "WebSockets"
+	// Bastion answers before it sends us anything else, so we know which protocol we're using before we start receiving
+	client.SetReadDeadline(time.Now().Add(connectionTimeout))
+	_, rawMessage, err := client.ReadMessage()
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("error reading SignalR handshake response: %s", err)
+	}
 
-		// Build our url u , add our params as well
-		websocketUrl := url.URL{Scheme: "wss", Host: w.serviceUrl, Path: w.hubEndpoint}
-		q = websocketUrl.Query()
-		for key, value := range w.params {
-			q.Set(key, value)
+	var handshakeResponse wsmsg.SignalRHandshakeResponse
+	pendingFrames, err := DecodeHandshake(rawMessage, &handshakeResponse)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("error un-marshalling SignalR handshake response: %s", err)
+	} else if handshakeResponse.Error != "" {
+		client.Close()
+
+		// Everyone supports JSON, so there's no reason to wait before asking for that instead
+		if protocol.Name() != JsonProtocol {
+			w.logger.Info(fmt.Sprintf("Bastion rejected the %s SignalR protocol, trying again with %s: %s", protocol.Name(), JsonProtocol, handshakeResponse.Error))
+			w.jsonOnly = true
+			return w.connect()
 		}
-		websocketUrl.RawQuery = q.Encode()
+		return fmt.Errorf("Bastion rejected the %s SignalR protocol: %s", protocol.Name(), handshakeResponse.Error)
+	}
 
-		msg := fmt.Sprintf("Negotiation finished, received %d. Connecting to %s", res.StatusCode, websocketUrl.String())
-		w.logger.Info(msg)
+	// Pongs count as hearing from Bastion too, and we answer its pings ourselves so that they do the same
+	w.extendReadDeadline(client)
+	client.SetPongHandler(func(string) error {
+		w.extendReadDeadline(client)
+		return nil
+	})
+	client.SetPingHandler(func(data string) error {
+		w.extendReadDeadline(client)
+		err := client.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(heartbeatConfig().Timeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
 
-		var err error
-		w.client, _, err = websocket.DefaultDialer.Dial(
-			websocketUrl.String(),
-			http.Header{"Authorization": []string{w.headers["Authorization"]}})
-		if err != nil {
-			w.logger.Error(err)
-		} else {
-			// Define our protocol and version
-			// Ref: https://stackoverflow.com/questions/65214787/signalr-websockets-and-go
-			if err := w.client.WriteMessage(websocket.TextMessage, append([]byte(`{"protocol": "json","version": 1}`), signalRMessageTerminatorByte)); err != nil {
-				w.logger.Info("Error when trying to agree on version for SignalR!")
-				w.client.Close()
-			} else {
-				w.IsReady = true
-				break
+	w.socketLock.Lock()
+	w.client = client
+	w.protocol = protocol
+	w.socketLock.Unlock()
+	w.pendingFrames = pendingFrames
+
+	w.logger.Info(fmt.Sprintf("Agreed on the %s SignalR protocol", protocol.Name()))
+	return nil
+}
+
+// Our protocol only changes when we reconnect, which happens while we're holding our socketLock
+func (w *Websocket) hubProtocol() IHubProtocol {
+	w.socketLock.Lock()
+	defer w.socketLock.Unlock()
+
+	return w.protocol
+}
+
+// MessagePack needs binary frames, so we only ask for it if Bastion says it can send them over websockets
+func (w *Websocket) chooseProtocol(negotiateResponse wsmsg.SignalRNegotiateResponse) IHubProtocol {
+	if w.jsonOnly {
+		return jsonProtocol{}
+	}
+
+	// Older versions of Bastion don't tell us, the handshake will fail if they can't do it
+	if len(negotiateResponse.AvailableTransports) == 0 {
+		return messagePackProtocol{}
+	}
+
+	for _, transport := range negotiateResponse.AvailableTransports {
+		if transport.Transport != "WebSockets" {
+			continue
+		}
+
+		for _, transferFormat := range transport.TransferFormats {
+			if transferFormat == "Binary" {
+				return messagePackProtocol{}
 			}
 		}
 	}
+	return jsonProtocol{}
 }
@@ -8,6 +8,24 @@ const (
 	// The responding actions of any given error type should be the same
 	KeysplittingValidationError ErrorType = "KeysplittingValidationError"
 
+	// The BZCert a Data message was signed with has expired. The daemon can recover from
+	// this by starting a new hash chain with a refreshed id token
+	BZCertExpiredError ErrorType = "BZCertExpiredError"
+
+	// The message was meant for a different agent or keysplitting session. Retrying won't help, the
+	// daemon is talking to the wrong agent
+	TargetIdMismatchError ErrorType = "TargetIdMismatchError"
+
+	// The message's timestamp was too far from the agent's clock, so it may have been captured and replayed
+	TimestampSkewError ErrorType = "TimestampSkewError"
+
+	// The agent has already accepted a Syn with the same nonce
+	ReplayedNonceError ErrorType = "ReplayedNonceError"
+
+	// The agent turned down a single request, e.g. because it's already handling too many. The message was
+	// still acked, so the hash chain and every other request are fine
+	ActionRejectedError ErrorType = "ActionRejectedError"
+
 	// This error is essentially any error that comes from executing an
 	// action aka if a file isn't found calling FUD, that error goes here.
 	KeysplittingExecutionError ErrorType = "KeysplittingExecutionError"
@@ -24,4 +42,13 @@ type ErrorMessage struct {
 	Type     string `json:"type"`
 	Message  string `json:"message"`
 	HPointer string `json:"hPointer"`
+
+	// The keysplitting session the error happened in, empty if it isn't tied to one
+	SessionId string `json:"sessionId,omitempty"`
+
+	// The request the error is about, only set on errors that don't affect anything else
+	RequestId string `json:"requestId,omitempty"`
+
+	// The daemon connection the error is about, only set on errors we report over the control channel
+	ConnectionId string `json:"connectionId,omitempty"`
 }
@@ -11,4 +11,5 @@ require (
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	k8s.io/client-go v0.21.3
 	github.com/rs/zerolog v1.24.0
+	gopkg.in/square/go-jose.v2 v2.5.1
 )
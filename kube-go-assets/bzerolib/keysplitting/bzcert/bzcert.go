@@ -24,9 +24,13 @@ type BZCert struct {
 // This function verifies the user's bzcert.  We pass in the user's SSO provider (idpProvider) and
 // their org id (e.g. called 'org' in Google jwts and 'tenantId' for microsoft) which specifies a particular
 // organization/company/group that hosts their SSO as part of a larger SSO.
+// Any provider besides Google and Microsoft also needs customIdp to tell us how to verify its tokens.
 // The function returns the hash the bzcert, the expiration time of the bzcert, and an error if there is one
-func (b *BZCert) Verify(idpProvider string, idpOrgId string) (string, time.Time, error) {
-	verifier := NewBZCertVerifier(b, idpProvider, idpOrgId)
+func (b *BZCert) Verify(idpProvider string, idpOrgId string, customIdp CustomIdpConfig) (string, time.Time, error) {
+	verifier, err := NewBZCertVerifier(b, idpProvider, idpOrgId, customIdp)
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
 	if _, err := verifier.VerifyIdToken(b.InitialIdToken, true, true); err != nil {
 		return "", time.Time{}, err
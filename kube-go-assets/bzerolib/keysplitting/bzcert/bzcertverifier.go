@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"time"
 
 	ed "crypto/ed25519"
@@ -31,6 +32,10 @@ type BZCertVerifier struct {
 	orgProvider ProviderType
 	iss         string
 	cert        *BZCert
+
+	// Only used for providers we don't have built in support for
+	orgClaim  string
+	audiences []string
 }
 
 type ProviderType string
@@ -38,31 +43,56 @@ type ProviderType string
 const (
 	Google    ProviderType = "google"
 	Microsoft ProviderType = "microsoft"
-	Custom    ProviderType = "custom"
+
+	// Any other OIDC provider, these all need a CustomIdpConfig
+	Okta     ProviderType = "okta"
+	Keycloak ProviderType = "keycloak"
+	Auth0    ProviderType = "auth0"
+	OneLogin ProviderType = "onelogin"
+	Custom   ProviderType = "custom"
 )
 
-func NewBZCertVerifier(bzcert *BZCert, idpProvider string, idpOrgId string) IBZCertVerifier {
+// How we verify tokens from an OIDC provider we don't have built in support for
+type CustomIdpConfig struct {
+	// Any valid iss requires a discovery document at <IssuerUrl>/.well-known/openid-configuration
+	IssuerUrl string
+
+	// The claim that has to match our idpOrgId, e.g. Okta doesn't have a standard one. If empty we don't check the org
+	OrgClaim string
+
+	// If any are given, tokens have to be issued to at least one of them. We need these or an OrgClaim, otherwise
+	// any token the provider issues to anyone would do
+	Audiences []string
+}
+
+func NewBZCertVerifier(bzcert *BZCert, idpProvider string, idpOrgId string, customIdp CustomIdpConfig) (IBZCertVerifier, error) {
 	provider := ProviderType(idpProvider)
-	// customIss := os.Getenv("CUSTOM_IDP")
 
-	iss := ""
+	verifier := &BZCertVerifier{
+		orgId:       idpOrgId,
+		orgProvider: provider,
+		cert:        bzcert,
+	}
+
 	switch provider {
 	case Google:
-		iss = googleUrl
+		verifier.iss = googleUrl
 	case Microsoft:
-		iss = getMicrosoftIssuerUrl(idpOrgId)
-	// case Custom:
-	// 	iss = customIss // Any valid iss requires a discovery document
+		verifier.iss = getMicrosoftIssuerUrl(idpOrgId)
+	case Okta, Keycloak, Auth0, OneLogin, Custom:
+		if customIdp.IssuerUrl == "" {
+			return &BZCertVerifier{}, fmt.Errorf("no issuer url configured for %s identity provider", provider)
+		} else if customIdp.OrgClaim == "" && len(customIdp.Audiences) == 0 {
+			return &BZCertVerifier{}, fmt.Errorf("no org claim or audiences configured for %s identity provider", provider)
+		}
+		verifier.iss = strings.TrimSuffix(customIdp.IssuerUrl, "/")
+		verifier.orgClaim = customIdp.OrgClaim
+		verifier.audiences = customIdp.Audiences
 	default:
-		return &BZCertVerifier{} // return error
+		return &BZCertVerifier{}, fmt.Errorf("unsupported identity provider: %s", idpProvider)
 	}
 
-	return &BZCertVerifier{
-		orgId:       idpOrgId,
-		orgProvider: provider,
-		iss:         iss,
-		cert:        bzcert,
-	}
+	return verifier, nil
 }
 
 func getMicrosoftIssuerUrl(orgId string) string {
@@ -82,20 +112,17 @@ func getMicrosoftIssuerUrl(orgId string) string {
 func (u *BZCertVerifier) VerifyIdToken(idtoken string, skipExpiry bool, verifyNonce bool) (time.Time, error) {
 	// Verify Token Signature
 
-	ctx := context.TODO() // Gives us non-nil empty context
-	config := &oidc.Config{
-		SkipClientIDCheck: true,
-		SkipExpiryCheck:   skipExpiry,
-		// SupportedSigningAlgs: []string{RS256, ES512},
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyFetchTimeout)
+	defer cancel()
 
-	provider, err := oidc.NewProvider(ctx, u.iss)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("Error establishing OIDC provider during validation: %v", err)
+	config := &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      skipExpiry,
+		SupportedSigningAlgs: supportedSigningAlgs,
 	}
 
-	// This checks formatting and signature validity
-	verifier := provider.Verifier(config)
+	// This checks formatting and signature validity, against keys we've cached or pinned for this issuer
+	verifier := oidc.NewVerifier(u.iss, getKeySet(u.iss), config)
 	token, err := verifier.Verify(ctx, idtoken)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("ID Token verification error: %v", err)
@@ -146,11 +173,59 @@ func (u *BZCertVerifier) VerifyIdToken(idtoken string, skipExpiry bool, verifyNo
 		if u.orgId != claims.TID {
 			return time.Time{}, fmt.Errorf("User's OrgId does not match target's expected Microsoft tid")
 		}
+	default:
+		if err := u.verifyCustomClaims(token); err != nil {
+			return time.Time{}, err
+		}
 	}
 
 	return time.Unix(claims.Death, 0), nil
 }
 
+// Custom providers don't have a standard org claim or audience, so we check whichever ones we were configured with
+func (u *BZCertVerifier) verifyCustomClaims(token *oidc.IDToken) error {
+	if u.orgClaim == "" && len(u.audiences) == 0 {
+		return fmt.Errorf("Cannot verify ID Token without an org claim or audiences to check")
+	} else if len(u.audiences) > 0 && !containsAny(token.Audience, u.audiences) {
+		return fmt.Errorf("ID Token audience %v is not one of the allowed audiences", token.Audience)
+	}
+
+	if u.orgClaim == "" {
+		return nil
+	}
+
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return fmt.Errorf("Error parsing the ID Token: %v", err)
+	}
+
+	// Some providers give us a list here, like the groups a user is in, so we accept the org being any of them
+	switch orgClaim := claims[u.orgClaim].(type) {
+	case string:
+		if orgClaim == u.orgId {
+			return nil
+		}
+	case []interface{}:
+		for _, value := range orgClaim {
+			if value == u.orgId {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("User's %s claim does not match target's expected org", u.orgClaim)
+}
+
+func containsAny(values []string, allowed []string) bool {
+	for _, value := range values {
+		for _, allowedValue := range allowed {
+			if value == allowedValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // This function takes in the BZECert, extracts all fields for verifying the AuthNonce (sent as
 //  part of the ID Token).  Returns nil if nonce is verified, else returns an error of type KeysplittingError
 func (b *BZCertVerifier) verifyAuthNonce(authNonce string) error {
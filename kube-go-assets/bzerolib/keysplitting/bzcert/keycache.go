@@ -0,0 +1,224 @@
+package bzcert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc/v3/oidc"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// How often we refresh every issuer's keys in the background
+	keyCacheTTL = time.Hour
+
+	// The longest we'll wait on an IdP for its discovery document or keys
+	keyFetchTimeout = 10 * time.Second
+
+	// If we see a key we don't know, the IdP might have rotated its keys, but we don't want a bad token
+	// to have us hammering the IdP
+	minKeyRefetchInterval = time.Minute
+)
+
+var (
+	// Every verifier shares the same keys, so we only go to each IdP once instead of on every Syn
+	issuerKeySets     = make(map[string]*issuerKeySet)
+	issuerKeySetsLock sync.Mutex
+
+	// If set, we verify every id token against these keys and never go to the network
+	pinnedKeySet     *staticKeySet
+	pinnedKeySetLock sync.Mutex
+
+	keyHttpClient = &http.Client{Timeout: keyFetchTimeout}
+
+	// We only ever verify against keys from a JWKS, so any asymmetric algorithm is fine
+	supportedSigningAlgs = []string{
+		oidc.RS256, oidc.RS384, oidc.RS512,
+		oidc.ES256, oidc.ES384, oidc.ES512,
+		oidc.PS256, oidc.PS384, oidc.PS512,
+	}
+)
+
+// Pins the keys we verify every id token against, for agents that can't reach their IdP. The keys are
+// expected in the same JWKS format the IdP serves them in
+func PinJwks(jwks []byte) error {
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(jwks, &keySet); err != nil {
+		return fmt.Errorf("malformed JWKS: %s", err)
+	} else if len(keySet.Keys) == 0 {
+		return fmt.Errorf("JWKS has no keys")
+	}
+
+	pinnedKeySetLock.Lock()
+	defer pinnedKeySetLock.Unlock()
+
+	pinnedKeySet = &staticKeySet{keys: keySet.Keys}
+	return nil
+}
+
+func getKeySet(issuer string) oidc.KeySet {
+	pinnedKeySetLock.Lock()
+	pinned := pinnedKeySet
+	pinnedKeySetLock.Unlock()
+
+	if pinned != nil {
+		return pinned
+	}
+
+	issuerKeySetsLock.Lock()
+	defer issuerKeySetsLock.Unlock()
+
+	keySet, ok := issuerKeySets[issuer]
+	if !ok {
+		keySet = &issuerKeySet{issuer: issuer}
+		issuerKeySets[issuer] = keySet
+		go keySet.refreshForever()
+	}
+	return keySet
+}
+
+type staticKeySet struct {
+	keys []jose.JSONWebKey
+}
+
+func (s *staticKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %s", err)
+	}
+
+	if payload, ok := verifyWithKeys(jws, s.keys); ok {
+		return payload, nil
+	}
+	return nil, errors.New("failed to verify id token signature against pinned keys")
+}
+
+// The keys for a single issuer, which we find through its discovery document
+type issuerKeySet struct {
+	issuer string
+
+	lock        sync.Mutex
+	keys        []jose.JSONWebKey
+	lastAttempt time.Time
+	lastErr     error
+}
+
+func (k *issuerKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %s", err)
+	}
+
+	if payload, ok := verifyWithKeys(jws, k.cachedKeys()); ok {
+		return payload, nil
+	}
+
+	// Either we've never fetched this issuer's keys or it's rotated them since we last did
+	keys, err := k.refresh(false)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch keys for %s: %s", k.issuer, err)
+	}
+
+	if payload, ok := verifyWithKeys(jws, keys); ok {
+		return payload, nil
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
+
+func (k *issuerKeySet) cachedKeys() []jose.JSONWebKey {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.keys
+}
+
+// We keep whatever keys we already have if we can't reach the IdP, so an outage there doesn't stop us
+// from verifying tokens signed with keys we've already seen. We don't hold the lock while we go to the
+// IdP so a slow IdP can't hold up verifying tokens against the keys we already have
+func (k *issuerKeySet) refresh(force bool) ([]jose.JSONWebKey, error) {
+	k.lock.Lock()
+	if !force && time.Since(k.lastAttempt) < minKeyRefetchInterval {
+		defer k.lock.Unlock()
+		return k.keys, k.lastErr
+	}
+	k.lastAttempt = time.Now()
+	k.lock.Unlock()
+
+	keys, err := fetchKeys(k.issuer)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.lastErr = err
+	if err == nil {
+		k.keys = keys
+	}
+	return k.keys, err
+}
+
+func (k *issuerKeySet) refreshForever() {
+	ticker := time.NewTicker(keyCacheTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		k.refresh(true)
+	}
+}
+
+func verifyWithKeys(jws *jose.JSONWebSignature, keys []jose.JSONWebKey) ([]byte, bool) {
+	// We don't support JWTs signed with multiple signatures
+	keyId := ""
+	if len(jws.Signatures) > 0 {
+		keyId = jws.Signatures[0].Header.KeyID
+	}
+
+	for _, key := range keys {
+		if keyId == "" || key.KeyID == keyId {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func fetchKeys(issuer string) ([]jose.JSONWebKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JwksUri string `json:"jwks_uri"`
+	}
+	if err := getJson(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("error fetching discovery document: %s", err)
+	} else if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("issuer did not match the issuer returned by provider, expected %q got %q", issuer, discovery.Issuer)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := getJson(discovery.JwksUri, &keySet); err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %s", err)
+	}
+	return keySet.Keys, nil
+}
+
+func getJson(url string, v interface{}) error {
+	response, err := keyHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	} else if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", response.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
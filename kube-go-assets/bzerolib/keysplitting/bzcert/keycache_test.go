@@ -0,0 +1,167 @@
+package bzcert
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// A fake IdP that serves whichever keys it's currently been given
+type fakeIdp struct {
+	server *httptest.Server
+
+	lock       sync.Mutex
+	keys       []jose.JSONWebKey
+	down       bool
+	keyFetches int
+}
+
+func newFakeIdp(t *testing.T) *fakeIdp {
+	f := &fakeIdp{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   f.server.URL,
+			"jwks_uri": f.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.keyFetches++
+		if f.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: f.keys})
+	})
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeIdp) setKeys(keys ...jose.JSONWebKey) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.keys = keys
+}
+
+func (f *fakeIdp) setDown(down bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.down = down
+}
+
+func (f *fakeIdp) fetches() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.keyFetches
+}
+
+func newSigningKey(t *testing.T, keyId string) (*rsa.PrivateKey, jose.JSONWebKey) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	return privateKey, jose.JSONWebKey{Key: &privateKey.PublicKey, KeyID: keyId, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+func sign(t *testing.T, privateKey *rsa.PrivateKey, keyId string) string {
+	signingKey := jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: privateKey, KeyID: keyId}}
+	signer, err := jose.NewSigner(signingKey, nil)
+	if err != nil {
+		t.Fatalf("could not create signer: %s", err)
+	}
+
+	jws, err := signer.Sign([]byte(`{"sub":"alice"}`))
+	if err != nil {
+		t.Fatalf("could not sign token: %s", err)
+	}
+	token, _ := jws.CompactSerialize()
+	return token
+}
+
+func TestVerifiesFromCacheWithoutRefetching(t *testing.T) {
+	idp := newFakeIdp(t)
+	privateKey, publicKey := newSigningKey(t, "one")
+	idp.setKeys(publicKey)
+
+	keySet := &issuerKeySet{issuer: idp.server.URL}
+	token := sign(t, privateKey, "one")
+
+	for i := 0; i < 3; i++ {
+		if _, err := keySet.VerifySignature(context.Background(), token); err != nil {
+			t.Fatalf("failed to verify token: %s", err)
+		}
+	}
+
+	if fetches := idp.fetches(); fetches != 1 {
+		t.Errorf("expected to fetch keys once but fetched them %d times", fetches)
+	}
+}
+
+func TestForcedRefreshPicksUpRotatedKeys(t *testing.T) {
+	idp := newFakeIdp(t)
+	oldPrivateKey, oldPublicKey := newSigningKey(t, "old")
+	idp.setKeys(oldPublicKey)
+
+	keySet := &issuerKeySet{issuer: idp.server.URL}
+	if _, err := keySet.VerifySignature(context.Background(), sign(t, oldPrivateKey, "old")); err != nil {
+		t.Fatalf("failed to verify token: %s", err)
+	}
+
+	// We just fetched, so an unknown key alone won't send us back to the IdP
+	newPrivateKey, newPublicKey := newSigningKey(t, "new")
+	idp.setKeys(newPublicKey)
+	newToken := sign(t, newPrivateKey, "new")
+	if _, err := keySet.VerifySignature(context.Background(), newToken); err == nil {
+		t.Fatalf("expected token signed with a key we haven't fetched to fail verification")
+	}
+
+	if _, err := keySet.refresh(true); err != nil {
+		t.Fatalf("failed to refresh keys: %s", err)
+	}
+	if _, err := keySet.VerifySignature(context.Background(), newToken); err != nil {
+		t.Errorf("failed to verify token signed with rotated key: %s", err)
+	}
+	if fetches := idp.fetches(); fetches != 2 {
+		t.Errorf("expected to fetch keys twice but fetched them %d times", fetches)
+	}
+}
+
+func TestKeepsStaleKeysWhenIdpIsDown(t *testing.T) {
+	idp := newFakeIdp(t)
+	privateKey, publicKey := newSigningKey(t, "one")
+	idp.setKeys(publicKey)
+
+	keySet := &issuerKeySet{issuer: idp.server.URL}
+	token := sign(t, privateKey, "one")
+	if _, err := keySet.VerifySignature(context.Background(), token); err != nil {
+		t.Fatalf("failed to verify token: %s", err)
+	}
+
+	idp.setDown(true)
+	keys, err := keySet.refresh(true)
+	if err == nil {
+		t.Errorf("expected refresh to fail while the IdP is down")
+	} else if len(keys) != 1 || keys[0].KeyID != "one" {
+		t.Errorf("expected to keep the keys we already had but got %v", keys)
+	}
+
+	if _, err := keySet.VerifySignature(context.Background(), token); err != nil {
+		t.Errorf("failed to verify token against stale keys: %s", err)
+	}
+}
@@ -19,6 +19,10 @@ type DataPayload struct {
 	HPointer      string `json:"hPointer"`
 	BZCertHash    string `json:"bZCertHash"`
 	ActionPayload []byte `json:"actionPayload"`
+
+	// Only set when pipelining, the hash of the latest DataAck the daemon has received so the agent's
+	// acks are part of the hash chain too
+	AckHPointer string `json:"ackHPointer,omitempty"`
 }
 
 func (d DataPayload) BuildResponsePayload(actionPayload []byte, pubKey string) (DataAckPayload, string, error) {
@@ -33,6 +33,11 @@ type KeysplittingMessage struct {
 	Type                KeysplittingPayloadType `json:"type"`
 	KeysplittingPayload interface{}             `json:"keysplittingPayload"`
 	Signature           string                  `json:"signature"`
+
+	// Identifies which hash chain this message belongs to when a datachannel is running more than one.
+	// A Syn repeats it in its signed payload, every message after that is bound to it through the hash chain
+	// so a message routed to the wrong chain just fails validation
+	SessionId string `json:"sessionId,omitempty"`
 }
 
 func (k *KeysplittingMessage) VerifySignature(publicKey string) error {
@@ -93,6 +98,13 @@ func (k *KeysplittingMessage) UnmarshalJSON(data []byte) error {
 		k.Signature = s
 	}
 
+	// Older daemons and agents only ever have one hash chain and won't send a session id
+	if sessionId, ok := objmap["sessionId"]; ok && sessionId != nil {
+		if err := json.Unmarshal(*sessionId, &k.SessionId); err != nil {
+			return err
+		}
+	}
+
 	kPayload := *objmap["keysplittingPayload"]
 	switch k.Type {
 	case Syn:
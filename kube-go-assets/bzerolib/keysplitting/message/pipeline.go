@@ -0,0 +1,14 @@
+package message
+
+// Daemons that want to have more than one Data message in flight ask for it as part of their Syn's
+// action payload and agents that support pipelining confirm the window they'll accept in their SynAck's
+// action response payload. Anyone that doesn't know about pipelining will ignore it, so we fall back to
+// waiting on a DataAck before sending the next Data message.
+//
+// When pipelining, every Data message after the first points at the hash of the previous Data message
+// instead of the hash of its DataAck, so the agent can verify the chain without us having to wait on it.
+// Those Data messages also carry the hash of the latest DataAck we've received, which binds the acks into
+// the chain and tells the agent how many of our messages are still in flight.
+type PipelineNegotiation struct {
+	PipelineWindow int `json:"pipelineWindow"`
+}
@@ -0,0 +1,15 @@
+package message
+
+// When a daemon's websocket reconnects, any Data message it had sent but not received a DataAck for may or
+// may not have made it to the agent. The daemon re-Syns with the hash of the last Data message it sent as its
+// nonce, and agents that still have the session tell it the hash of the last Data message they accepted, so
+// the daemon only resends the ones the agent never saw.
+type ResumeNegotiation struct {
+	LastDataHash string `json:"lastDataHash,omitempty"`
+}
+
+// Everything an agent might tell the daemon in its SynAck's action response payload
+type SynAckNegotiation struct {
+	PipelineNegotiation
+	ResumeNegotiation
+}
@@ -22,6 +22,9 @@ type SynPayload struct {
 	TargetId string       `json:"targetId"`
 	Nonce    string       `json:"nonce"`
 	BZCert   bzcrt.BZCert `json:"bZCert"`
+
+	// The hash chain this Syn starts, signed so that nobody else can open sessions on the daemon's behalf
+	SessionId string `json:"sessionId,omitempty"`
 }
 
 func (s SynPayload) BuildResponsePayload(actionPayload []byte, pubKey string) (SynAckPayload, string, error) {
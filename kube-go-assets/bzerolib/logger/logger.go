@@ -26,6 +26,15 @@ type Logger struct {
 }
 
 func NewLogger(debugLevel DebugLevel, logFilePath string) (*Logger, error) {
+	return newLogger(debugLevel, logFilePath, true)
+}
+
+// For when stdout belongs to someone else, like the user's terminal during a shell session
+func NewFileLogger(debugLevel DebugLevel, logFilePath string) (*Logger, error) {
+	return newLogger(debugLevel, logFilePath, false)
+}
+
+func newLogger(debugLevel DebugLevel, logFilePath string, console bool) (*Logger, error) {
 	// Let's us display stack info on errors
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	zerolog.SetGlobalLevel(debugLevel)
@@ -38,6 +47,12 @@ func NewLogger(debugLevel DebugLevel, logFilePath string) (*Logger, error) {
 			return &Logger{}, err
 		}
 
+		if !console {
+			return &Logger{
+				logger: zerolog.New(logFile).With().Timestamp().Logger(),
+			}, nil
+		}
+
 		consoleWriter := zerolog.ConsoleWriter{Out: os.Stdout}
 		multi := zerolog.MultiLevelWriter(consoleWriter, logFile)
 
@@ -0,0 +1,312 @@
+/*
+This package is just enough of a Prometheus client for us to expose our own metrics, without pulling in a
+client library and everything it depends on. Metrics register themselves when they're created, and Handler
+serves every one of them in Prometheus' text exposition format.
+Ref: https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+*/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prometheus' default buckets, they're meant for request latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(out *bytes.Buffer)
+}
+
+var (
+	registry     = make(map[string]metric)
+	registryLock sync.Mutex
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[m.name()]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// Serves every metric we've created
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryLock.Lock()
+		metrics := make([]metric, 0, len(registry))
+		for _, m := range registry {
+			metrics = append(metrics, m)
+		}
+		registryLock.Unlock()
+
+		sort.Slice(metrics, func(i, j int) bool {
+			return metrics[i].name() < metrics[j].name()
+		})
+
+		var out bytes.Buffer
+		for _, m := range metrics {
+			m.write(&out)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(out.Bytes())
+	})
+}
+
+// Everything a metric has regardless of its type, and one series for every combination of label values
+type family struct {
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+
+	series map[string][]string // label values, by their joined key
+	lock   sync.Mutex
+}
+
+func newFamily(name string, help string, metricType string, labelNames []string) family {
+	return family{
+		metricName: name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		series:     make(map[string][]string),
+	}
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+// Has to be called with our lock held
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels but was given %d values", f.metricName, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := f.series[key]; !ok {
+		f.series[key] = append([]string{}, labelValues...)
+	}
+	return key
+}
+
+// Has to be called with our lock held
+func (f *family) sortedKeys() []string {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *family) writeHeader(out *bytes.Buffer) {
+	fmt.Fprintf(out, "# HELP %s %s\n", f.metricName, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(out, "# TYPE %s %s\n", f.metricName, f.metricType)
+}
+
+// Writes a single sample, extra is for labels like a histogram's le that aren't part of the series
+func (f *family) writeSample(out *bytes.Buffer, suffix string, labelValues []string, extraName string, extraValue string, value float64) {
+	out.WriteString(f.metricName + suffix)
+
+	labels := []string{}
+	for i, labelName := range f.labelNames {
+		labels = append(labels, labelName+"="+quote(labelValues[i]))
+	}
+	if extraName != "" {
+		labels = append(labels, extraName+"="+quote(extraValue))
+	}
+	if len(labels) > 0 {
+		out.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+
+	out.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Only ever goes up, e.g. how many requests we've handled
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{
+		family: newFamily(name, help, "counter", labelNames),
+		values: make(map[string]float64),
+	}
+
+	// Without labels there's only ever one series, so it's there from the start like Prometheus' own clients do
+	if len(labelNames) == 0 {
+		c.Add(0)
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can't go down", c.metricName))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.values[c.key(labelValues)] += value
+}
+
+func (c *Counter) write(out *bytes.Buffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeHeader(out)
+	for _, key := range c.sortedKeys() {
+		c.writeSample(out, "", c.series[key], "", "", c.values[key])
+	}
+}
+
+// Can go up and down, e.g. how many connections we have open
+type Gauge struct {
+	family
+	values map[string]float64
+}
+
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+	g := &Gauge{
+		family: newFamily(name, help, "gauge", labelNames),
+		values: make(map[string]float64),
+	}
+	if len(labelNames) == 0 {
+		g.Add(0)
+	}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.values[g.key(labelValues)] += value
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.values[g.key(labelValues)] = value
+}
+
+func (g *Gauge) write(out *bytes.Buffer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.writeHeader(out)
+	for _, key := range g.sortedKeys() {
+		g.writeSample(out, "", g.series[key], "", "", g.values[key])
+	}
+}
+
+// Counts observations into buckets, e.g. how long our requests take
+type Histogram struct {
+	family
+	buckets []float64 // upper bounds, sorted
+
+	counts map[string][]uint64 // per bucket, not cumulative
+	sums   map[string]float64
+	totals map[string]uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+
+	h := &Histogram{
+		family:  newFamily(name, help, "histogram", labelNames),
+		buckets: sortedBuckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	if len(labelNames) == 0 {
+		h.lock.Lock()
+		h.counts[h.key(nil)] = make([]uint64, len(h.buckets))
+		h.lock.Unlock()
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := h.key(labelValues)
+	if _, ok := h.counts[key]; !ok {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+
+	// Anything bigger than our largest bucket only shows up in +Inf, which is just our total
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.counts[key][i]++
+	}
+	h.sums[key] += value
+	h.totals[key]++
+}
+
+func (h *Histogram) write(out *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.writeHeader(out)
+	for _, key := range h.sortedKeys() {
+		labelValues := h.series[key]
+
+		var cumulative uint64
+		for i, bucket := range h.buckets {
+			cumulative += h.counts[key][i]
+			h.writeSample(out, "_bucket", labelValues, "le", formatFloat(bucket), float64(cumulative))
+		}
+		h.writeSample(out, "_bucket", labelValues, "le", "+Inf", float64(h.totals[key]))
+		h.writeSample(out, "_sum", labelValues, "", "", h.sums[key])
+		h.writeSample(out, "_count", labelValues, "", "", float64(h.totals[key]))
+	}
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(m metric) string {
+	var out bytes.Buffer
+	m.write(&out)
+	return out.String()
+}
+
+func TestCounterFormat(t *testing.T) {
+	c := NewCounter("test_counter_requests_total", "Number of requests\nwe've handled", "code", "path")
+	c.Inc("200", "/")
+	c.Add(2, "500", `/a "quoted" \path`)
+	c.Inc("200", "/")
+
+	expected := `# HELP test_counter_requests_total Number of requests\nwe've handled
+# TYPE test_counter_requests_total counter
+test_counter_requests_total{code="200",path="/"} 2
+test_counter_requests_total{code="500",path="/a \"quoted\" \\path"} 2
+`
+	if output := written(c); output != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, output)
+	}
+}
+
+func TestUnlabelledMetricsStartAtZero(t *testing.T) {
+	c := NewCounter("test_unlabelled_total", "Counted")
+	g := NewGauge("test_unlabelled_gauge", "Gauged")
+
+	expected := "# HELP test_unlabelled_total Counted\n# TYPE test_unlabelled_total counter\ntest_unlabelled_total 0\n"
+	if output := written(c); output != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, output)
+	}
+
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	expected = "# HELP test_unlabelled_gauge Gauged\n# TYPE test_unlabelled_gauge gauge\ntest_unlabelled_gauge 1\n"
+	if output := written(g); output != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, output)
+	}
+}
+
+func TestHistogramFormat(t *testing.T) {
+	h := NewHistogram("test_histogram_seconds", "How long", []float64{1, 0.5}, "action")
+	h.Observe(0.25, "exec")
+	h.Observe(0.5, "exec")
+	h.Observe(0.75, "exec")
+	h.Observe(2, "exec")
+
+	expected := `# HELP test_histogram_seconds How long
+# TYPE test_histogram_seconds histogram
+test_histogram_seconds_bucket{action="exec",le="0.5"} 2
+test_histogram_seconds_bucket{action="exec",le="1"} 3
+test_histogram_seconds_bucket{action="exec",le="+Inf"} 4
+test_histogram_seconds_sum{action="exec"} 3.5
+test_histogram_seconds_count{action="exec"} 4
+`
+	if output := written(h); output != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, output)
+	}
+}
+
+func TestHandlerServesEveryMetricInOrder(t *testing.T) {
+	NewGauge("test_handler_b", "Second")
+	NewGauge("test_handler_a", "First")
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+	first := strings.Index(string(body), "# HELP test_handler_a")
+	second := strings.Index(string(body), "# HELP test_handler_b")
+	if first < 0 || second < 0 {
+		t.Fatalf("expected both metrics to be served but got:\n%s", body)
+	} else if first > second {
+		t.Errorf("expected metrics to be served sorted by name but got:\n%s", body)
+	}
+}
+
+func TestRegisteringTwicePanics(t *testing.T) {
+	NewCounter("test_registered_twice_total", "Once")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering the same metric twice to panic")
+		}
+	}()
+	NewCounter("test_registered_twice_total", "Twice")
+}
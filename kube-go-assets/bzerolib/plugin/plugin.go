@@ -1,22 +1,55 @@
 package plugin
 
 import (
+	"errors"
+
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
 )
 
 type PluginName string
 
 const (
-	Kube       PluginName = "kube"
-	KubeDaemon PluginName = "kubedaemon"
+	Kube         PluginName = "kube"
+	KubeDaemon   PluginName = "kubedaemon"
+	Tunnel       PluginName = "tunnel"
+	TunnelDaemon PluginName = "tunneldaemon"
+	Shell        PluginName = "shell"
+	ShellDaemon  PluginName = "shelldaemon"
 )
 
+// Plugins return errors wrapping this when they turn down a request because they're already handling too many
+var ErrTooManyActions = errors.New("too many concurrent actions")
+
+// An error that only affects a single request, so the daemon can fail just that one
+type RequestError struct {
+	RequestId string
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
 type IPlugin interface {
 	InputMessageHandler(action string, actionPayload []byte) (string, []byte, error)
 	GetName() PluginName
 	PushStreamInput(smessage smsg.StreamMessage) error
 }
 
+// Plugins that keep track of the requests they're handling
+type IRequestPlugin interface {
+	RequestIds() []string
+}
+
+// Plugins that have something to tell their users before their datachannel closes
+type IShutdownPlugin interface {
+	Shutdown(reason string)
+}
+
 type ActionWrapper struct {
 	Action        string
 	ActionPayload []byte
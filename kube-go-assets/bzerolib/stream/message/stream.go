@@ -20,5 +20,18 @@ const (
 	StdOut StreamType = "kube/exec/stdout"
 	StdIn  StreamType = "kube/exec/stdin"
 
+	// Acknowledges a flow controlled stdin chunk once the pod has it, the sequence number is the chunk's
+	StdInAck StreamType = "kube/exec/stdin/ack"
+
 	LogOut StreamType = "kube/log/stdout"
+
+	PortForwardData  StreamType = "kube/portforward/data"
+	PortForwardError StreamType = "kube/portforward/error"
+
+	TunnelData  StreamType = "tunnel/data"
+	TunnelClose StreamType = "tunnel/close"
+
+	ShellStdOut StreamType = "shell/stdout"
+	ShellStdIn  StreamType = "shell/stdin"
+	ShellQuit   StreamType = "shell/quit"
 )
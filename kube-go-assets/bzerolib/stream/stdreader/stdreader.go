@@ -3,6 +3,7 @@ package stdreader
 import (
 	"bytes"
 	"io"
+	"sync"
 
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
 )
@@ -16,6 +17,13 @@ type StdReader struct {
 	StreamType   smsg.StreamType
 	RequestId    string
 	stdinChannel chan []byte
+
+	// Whatever didn't fit into the caller's buffer on the last read
+	remainder []byte
+
+	// Once closed, whoever is reading from us gets an EOF even if nothing closes our stdin channel
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewStdReader(streamType smsg.StreamType, requestId string, stdinChannel chan []byte) *StdReader {
@@ -23,13 +31,16 @@ func NewStdReader(streamType smsg.StreamType, requestId string, stdinChannel cha
 		StreamType:   streamType,
 		RequestId:    requestId,
 		stdinChannel: stdinChannel,
+		closed:       make(chan struct{}),
 	}
 
 	return stdin
 }
 
 func (r *StdReader) Close() {
-	r.Read(EndStreamBytes)
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
 }
 
 func (r *StdReader) Read(p []byte) (int, error) {
@@ -37,7 +48,20 @@ func (r *StdReader) Read(p []byte) (int, error) {
 	if bytes.Equal(p, EndStreamBytes) {
 		return 1, io.EOF
 	}
-	stdin := <-r.stdinChannel
-	n := copy(p, stdin)
+
+	// Large chunks of stdin might not fit in p, so make sure we don't drop anything
+	if len(r.remainder) == 0 {
+		select {
+		case <-r.closed:
+			return 0, io.EOF
+		case stdin, ok := <-r.stdinChannel:
+			if !ok {
+				return 0, io.EOF
+			}
+			r.remainder = stdin
+		}
+	}
+	n := copy(p, r.remainder)
+	r.remainder = r.remainder[n:]
 	return n, nil
 }
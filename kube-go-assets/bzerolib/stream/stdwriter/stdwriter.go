@@ -2,40 +2,134 @@ package stdwriter
 
 import (
 	"encoding/base64"
+	"fmt"
+	"sync"
 
+	"bastionzero.com/bctl/v1/bzerolib/metrics"
 	smsg "bastionzero.com/bctl/v1/bzerolib/stream/message"
 )
 
+const (
+	// Large writes get split up so that no single stream message blows up the websocket
+	MaxChunkSize = 64 * 1024
+)
+
+var (
+	bytesStreamed = metrics.NewCounter(
+		"bzero_streamed_bytes_total",
+		"Bytes written to output streams, before they're encoded",
+		"type")
+)
+
 type StdWriter struct {
 	StdType        smsg.StreamType
 	outputChannel  chan smsg.StreamMessage
 	RequestId      string
 	SequenceNumber int
 	logId          string
+
+	// Whatever we're streaming and anything we tell the user ourselves, like why we're shutting down, can be
+	// written at the same time. Every write goes out whole and in sequence
+	writeLock sync.Mutex
+
+	// Flow control, if our window size is zero we never wait for the other side to acknowledge anything
+	windowSize   int
+	lastAcked    int
+	closed       bool
+	windowUpdate *sync.Cond
 }
 
 // Stdout or Stderr
 func NewStdWriter(streamType smsg.StreamType, ch chan smsg.StreamMessage, requestId string, logId string) *StdWriter {
+	return NewFlowControlledStdWriter(streamType, ch, requestId, logId, 0)
+}
+
+// Same as a regular StdWriter but will only ever have windowSize unacknowledged messages in flight
+func NewFlowControlledStdWriter(streamType smsg.StreamType, ch chan smsg.StreamMessage, requestId string, logId string, windowSize int) *StdWriter {
 	return &StdWriter{
 		StdType:        streamType,
 		outputChannel:  ch,
 		RequestId:      requestId,
 		SequenceNumber: 0,
 		logId:          logId,
+		windowSize:     windowSize,
+		lastAcked:      -1,
+		windowUpdate:   sync.NewCond(&sync.Mutex{}),
 	}
 }
 
 func (w *StdWriter) Write(p []byte) (int, error) {
-	str := base64.StdEncoding.EncodeToString(p)
-	message := smsg.StreamMessage{
-		Type:           string(w.StdType),
-		RequestId:      w.RequestId,
-		SequenceNumber: w.SequenceNumber,
-		Content:        str,
-		LogId:          w.logId,
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	written := 0
+	for {
+		chunk := p[written:]
+		if len(chunk) > MaxChunkSize {
+			chunk = chunk[:MaxChunkSize]
+		}
+
+		if err := w.waitForWindow(); err != nil {
+			return written, err
+		}
+
+		str := base64.StdEncoding.EncodeToString(chunk)
+		message := smsg.StreamMessage{
+			Type:           string(w.StdType),
+			RequestId:      w.RequestId,
+			SequenceNumber: w.SequenceNumber,
+			Content:        str,
+			LogId:          w.logId,
+		}
+		w.outputChannel <- message
+		w.SequenceNumber = w.SequenceNumber + 1
+		written += len(chunk)
+		bytesStreamed.Add(float64(len(chunk)), string(w.StdType))
+
+		if written >= len(p) {
+			return written, nil
+		}
 	}
-	w.outputChannel <- message
-	w.SequenceNumber = w.SequenceNumber + 1
+}
+
+// The sequence number our next message will have, once everything we're writing now has gone out
+func (w *StdWriter) NextSequenceNumber() int {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
 
-	return len(p), nil
+	return w.SequenceNumber
+}
+
+// Lets us know the other side has received every message up to and including sequenceNumber
+func (w *StdWriter) Ack(sequenceNumber int) {
+	w.windowUpdate.L.Lock()
+	defer w.windowUpdate.L.Unlock()
+
+	if sequenceNumber > w.lastAcked {
+		w.lastAcked = sequenceNumber
+		w.windowUpdate.Broadcast()
+	}
+}
+
+// Unblocks anyone waiting on an acknowledgement, all further writes will fail
+func (w *StdWriter) Close() {
+	w.windowUpdate.L.Lock()
+	defer w.windowUpdate.L.Unlock()
+
+	w.closed = true
+	w.windowUpdate.Broadcast()
+}
+
+func (w *StdWriter) waitForWindow() error {
+	w.windowUpdate.L.Lock()
+	defer w.windowUpdate.L.Unlock()
+
+	for !w.closed && w.windowSize > 0 && w.SequenceNumber-w.lastAcked > w.windowSize {
+		w.windowUpdate.Wait()
+	}
+
+	if w.closed {
+		return fmt.Errorf("%s writer closed", w.StdType)
+	}
+	return nil
 }